@@ -1,54 +1,89 @@
 package cert
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha512"
+	"crypto"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"fmt"
+	"io"
 	"math/big"
-	"time"
+	"net"
+	"strings"
 )
 
-// GenerateCA generates a new CA key pair with the given validity in years
-func GenerateCA(years int) (*x509.Certificate, *rsa.PrivateKey, error) {
+// GenerateCA generates a new self-signed CA key pair with the given options. If opts is nil, DefaultOptions is used
+func GenerateCA(opts *Options) (*x509.Certificate, crypto.Signer, error) {
+	return generateCA(nil, nil, opts, false)
+}
+
+// GenerateSubCA generates a new CA key pair with the given options signed by the given CA key pair.
+// If the subject is the same as the parent's, "Intermediate" is appended to the common name.
+// The validity is limited to the validity of the parent. If opts is nil, DefaultOptions is used
+func GenerateSubCA(parent *x509.Certificate, parentKey crypto.Signer, opts *Options) (*x509.Certificate, crypto.Signer, error) {
+	return generateCA(parent, parentKey, opts, false)
+}
+
+// GenerateDeviceCA generates a new CA key pair for a single device like GenerateSubCA, but the CA can't issue other CAs,
+// and it's name constrained to opts.DNSNames and opts.IPAddresses, so the certificates it issues are only trusted for the localhost names.
+// Its private key is still delivered to the device, so anyone with the key can issue certificates for those names that are trusted by every device that trusts the parent
+func GenerateDeviceCA(parent *x509.Certificate, parentKey crypto.Signer, opts *Options) (*x509.Certificate, crypto.Signer, error) {
+	return generateCA(parent, parentKey, opts, true)
+}
+
+// generateCA generates a new CA key pair signed by parent, or self-signed if parent is nil. If constrained is true, the CA is limited to issuing localhost certificates
+func generateCA(parent *x509.Certificate, parentKey crypto.Signer, opts *Options, constrained bool) (*x509.Certificate, crypto.Signer, error) {
+	opts = opts.withDefaults()
+
 	buf := make([]byte, 16)
-	if _, err := rand.Read(buf); err != nil {
+	if _, err := io.ReadFull(opts.Rand, buf); err != nil {
 		return nil, nil, fmt.Errorf("could not generate serial: %w", err)
 	}
 
 	serial := new(big.Int)
 	serial.SetBytes(buf)
 
-	key, err := rsa.GenerateKey(rand.Reader, 4096)
+	key, err := GenerateKey(opts.KeyType, opts.Rand)
 	if err != nil {
 		return nil, nil, fmt.Errorf("could not generate key: %w", err)
 	}
 
-	ski := sha512.Sum512(x509.MarshalPKCS1PublicKey(&key.PublicKey))
+	ski, err := subjectKeyID(key.Public())
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not generate subject key id: %w", err)
+	}
 
+	now := opts.Now()
 	tmpl := &x509.Certificate{
-		SerialNumber: serial,
-		Subject: pkix.Name{
-			CommonName:    "Lightspeed Filter Agent",
-			Organization:  []string{"Lightspeed Systems"},
-			Country:       []string{"US"},
-			Locality:      []string{"Austin"},
-			Province:      []string{"Texas"},
-			StreetAddress: []string{"2500 Bee Cave Road, Suite 350"},
-			PostalCode:    []string{"78746"},
-		},
-		SubjectKeyId:          ski[:],
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(years, 0, 0),
+		SerialNumber:          serial,
+		Subject:               opts.Subject,
+		SubjectKeyId:          ski,
+		NotBefore:             now,
+		NotAfter:              now.AddDate(opts.CAYears, 0, 0),
 		IsCA:                  true,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageDataEncipherment | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		KeyUsage:              keyUsage(key.Public(), true),
 		BasicConstraintsValid: true,
 	}
 
-	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if constrained {
+		constrainToLocalhost(tmpl, opts)
+	}
+
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	} else {
+		// a sub CA with its parent's subject looks self-signed, which breaks chain building
+		if tmpl.Subject.String() == parent.Subject.String() {
+			tmpl.Subject.CommonName = strings.TrimSpace(tmpl.Subject.CommonName + " Intermediate")
+		}
+		tmpl.AuthorityKeyId = parent.SubjectKeyId
+		tmpl.CRLDistributionPoints = opts.CRLDistributionPoints
+		if tmpl.NotAfter.After(parent.NotAfter) {
+			tmpl.NotAfter = parent.NotAfter
+		}
+	}
+
+	der, err := x509.CreateCertificate(opts.Rand, tmpl, parent, key.Public(), parentKey)
 	if err != nil {
 		return nil, nil, fmt.Errorf("could not generate certificate: %w", err)
 	}
@@ -61,38 +96,77 @@ func GenerateCA(years int) (*x509.Certificate, *rsa.PrivateKey, error) {
 	return cert, key, nil
 }
 
-// GenerateLocalhost generates a new key pair for localhost signed by the given CA key pair
-func GenerateLocalhost(ca *x509.Certificate, caKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey, error) {
+// constrainToLocalhost limits tmpl to issuing end-entity certificates for opts.DNSNames and opts.IPAddresses
+func constrainToLocalhost(tmpl *x509.Certificate, opts *Options) {
+	tmpl.MaxPathLen = 0
+	tmpl.MaxPathLenZero = true
+	tmpl.PermittedDNSDomainsCritical = true
+
+	tmpl.PermittedDNSDomains = opts.DNSNames
+	// without a permitted DNS name, all names must be excluded, since names of an unconstrained type are allowed
+	if len(opts.DNSNames) == 0 {
+		tmpl.ExcludedDNSDomains = []string{""}
+	}
+
+	for _, ip := range opts.IPAddresses {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		tmpl.PermittedIPRanges = append(tmpl.PermittedIPRanges, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+	}
+	if len(opts.IPAddresses) == 0 {
+		tmpl.ExcludedIPRanges = []*net.IPNet{
+			{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+			{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+		}
+	}
+}
+
+// GenerateLocalhost generates a new key pair for localhost with the given options signed by the given CA key pair.
+// The validity is limited to the validity of the CA. If opts is nil, DefaultOptions is used
+func GenerateLocalhost(ca *x509.Certificate, caKey crypto.Signer, opts *Options) (*x509.Certificate, crypto.Signer, error) {
+	opts = opts.withDefaults()
+
 	buf := make([]byte, 16)
-	if _, err := rand.Read(buf); err != nil {
+	if _, err := io.ReadFull(opts.Rand, buf); err != nil {
 		return nil, nil, fmt.Errorf("could not generate serial: %w", err)
 	}
 
 	serial := new(big.Int)
 	serial.SetBytes(buf)
 
-	key, err := rsa.GenerateKey(rand.Reader, 4096)
+	key, err := GenerateKey(opts.KeyType, opts.Rand)
 	if err != nil {
 		return nil, nil, fmt.Errorf("could not generate key: %w", err)
 	}
 
-	ski := sha512.Sum512(x509.MarshalPKCS1PublicKey(&key.PublicKey))
+	ski, err := subjectKeyID(key.Public())
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not generate subject key id: %w", err)
+	}
 
+	now := opts.Now()
 	tmpl := &x509.Certificate{
 		SerialNumber: serial,
 		Subject: pkix.Name{
-			Organization: []string{"Lightspeed Systems"},
+			Organization: opts.Subject.Organization,
 		},
-		SubjectKeyId:          ski[:],
-		DNSNames:              []string{"localhost"},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(1, 0, 0),
+		SubjectKeyId:          ski,
+		DNSNames:              opts.DNSNames,
+		IPAddresses:           opts.IPAddresses,
+		CRLDistributionPoints: opts.CRLDistributionPoints,
+		NotBefore:             now,
+		NotAfter:              now.AddDate(0, 0, opts.LeafDays),
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		KeyUsage:              keyUsage(key.Public(), false),
 		BasicConstraintsValid: true,
 	}
 
-	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if tmpl.NotAfter.After(ca.NotAfter) {
+		tmpl.NotAfter = ca.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(opts.Rand, tmpl, ca, key.Public(), caKey)
 	if err != nil {
 		return nil, nil, fmt.Errorf("could not generate certificate: %w", err)
 	}
@@ -0,0 +1,174 @@
+package cert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/korylprince/ls-relay-cert/internal/testutil"
+)
+
+// testOptions returns Options with deterministic randomness and clock. Ed25519 is used because its key generation and signatures are deterministic.
+// It isn't shared with the certtest package, since certtest imports cert
+func testOptions() *Options {
+	opts := DefaultOptions()
+	opts.KeyType = KeyTypeEd25519
+	opts.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	opts.Rand = mrand.New(mrand.NewSource(1))
+	opts.Now = testutil.Now
+	return opts
+}
+
+// describe writes the fields of c to w
+func describe(w io.Writer, name string, c *x509.Certificate) {
+	fmt.Fprintf(w, "%s:\n", name)
+	fmt.Fprintf(w, "    Subject:          %s\n", c.Subject)
+	fmt.Fprintf(w, "    Issuer:           %s\n", c.Issuer)
+	fmt.Fprintf(w, "    Serial:           %X\n", c.SerialNumber)
+	fmt.Fprintf(w, "    Not Before:       %s\n", c.NotBefore.Format(time.RFC3339))
+	fmt.Fprintf(w, "    Not After:        %s\n", c.NotAfter.Format(time.RFC3339))
+	fmt.Fprintf(w, "    CA:               %t\n", c.IsCA)
+	fmt.Fprintf(w, "    Key Type:         %s\n", KeyDescription(c.PublicKey))
+	fmt.Fprintf(w, "    Key Usage:        %d\n", c.KeyUsage)
+	fmt.Fprintf(w, "    Ext Key Usage:    %v\n", c.ExtKeyUsage)
+	fmt.Fprintf(w, "    DNS Names:        %v\n", c.DNSNames)
+	fmt.Fprintf(w, "    IP Addresses:     %v\n", c.IPAddresses)
+	fmt.Fprintf(w, "    Subject Key ID:   %X\n", c.SubjectKeyId)
+	fmt.Fprintf(w, "    Authority Key ID: %X\n", c.AuthorityKeyId)
+	fmt.Fprintf(w, "    SHA-256:          %s\n", Fingerprint(c))
+}
+
+func TestGenerateGolden(t *testing.T) {
+	opts := testOptions()
+
+	ca, caKey, err := GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+
+	subCA, subCAKey, err := GenerateSubCA(ca, caKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate sub CA: %v", err)
+	}
+
+	lh, _, err := GenerateLocalhost(subCA, subCAKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate localhost: %v", err)
+	}
+
+	if err = (&Issuer{Cert: subCA, Key: subCAKey, Chain: []*x509.Certificate{ca}}).Verify(); err != nil {
+		t.Errorf("could not verify chain: %v", err)
+	}
+	if bytes.Equal(subCA.RawSubject, ca.RawSubject) || !bytes.Equal(subCA.AuthorityKeyId, ca.SubjectKeyId) {
+		t.Error("want sub CA with a distinct subject and the CA's authority key id")
+	}
+
+	buf := new(bytes.Buffer)
+	describe(buf, "ca", ca)
+	describe(buf, "sub-ca", subCA)
+	describe(buf, "localhost", lh)
+	testutil.Golden(t, "certificates.golden", buf.Bytes())
+}
+
+func TestGenerateLocalhostValidity(t *testing.T) {
+	opts := testOptions()
+	opts.CAYears = 1
+	opts.LeafDays = 3650
+
+	ca, caKey, err := GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+
+	lh, _, err := GenerateLocalhost(ca, caKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate localhost: %v", err)
+	}
+
+	if !lh.NotBefore.Equal(testutil.Time) {
+		t.Errorf("want NotBefore %s, got %s", testutil.Time, lh.NotBefore)
+	}
+	if !lh.NotAfter.Equal(ca.NotAfter) {
+		t.Errorf("want NotAfter clamped to CA %s, got %s", ca.NotAfter, lh.NotAfter)
+	}
+}
+
+func TestGenerateDeviceCA(t *testing.T) {
+	opts := testOptions()
+
+	ca, caKey, err := GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+
+	deviceCA, deviceKey, err := GenerateDeviceCA(ca, caKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate device CA: %v", err)
+	}
+
+	if deviceCA.MaxPathLen != 0 || !deviceCA.MaxPathLenZero {
+		t.Errorf("want device CA path length 0, got %d", deviceCA.MaxPathLen)
+	}
+
+	ipOpts := testOptions()
+	ipOpts.DNSNames = nil
+	ipOpts.IPAddresses = []net.IP{net.ParseIP("::1")}
+	ipCA, ipKey, err := GenerateDeviceCA(ca, caKey, ipOpts)
+	if err != nil {
+		t.Fatalf("could not generate IP only device CA: %v", err)
+	}
+
+	subCA, subKey, err := GenerateSubCA(deviceCA, deviceKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate sub CA: %v", err)
+	}
+
+	otherOpts := testOptions()
+	otherOpts.DNSNames = []string{"example.com"}
+	otherOpts.IPAddresses = []net.IP{net.ParseIP("10.0.0.1")}
+
+	for _, test := range []struct {
+		name    string
+		chain   []*x509.Certificate
+		key     crypto.Signer
+		opts    *Options
+		wantErr bool
+	}{
+		{name: "localhost", chain: []*x509.Certificate{deviceCA}, key: deviceKey, opts: opts},
+		{name: "other names", chain: []*x509.Certificate{deviceCA}, key: deviceKey, opts: otherOpts, wantErr: true},
+		{name: "sub CA", chain: []*x509.Certificate{subCA, deviceCA}, key: subKey, opts: opts, wantErr: true},
+		{name: "IP only", chain: []*x509.Certificate{ipCA}, key: ipKey, opts: ipOpts},
+		{name: "IP only other names", chain: []*x509.Certificate{ipCA}, key: ipKey, opts: otherOpts, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			leaf, _, err := GenerateLocalhost(test.chain[0], test.key, test.opts)
+			if err != nil {
+				t.Fatalf("could not generate localhost: %v", err)
+			}
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca)
+			intermediates := x509.NewCertPool()
+			for _, c := range test.chain {
+				intermediates.AddCert(c)
+			}
+			_, err = leaf.Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				CurrentTime:   testutil.Time,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			})
+			if test.wantErr && err == nil {
+				t.Error("want verify error, got nil")
+			} else if !test.wantErr && err != nil {
+				t.Errorf("could not verify: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package cert
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+)
+
+// GenerateCRL returns a DER encoded CRL signed by issuer listing the revoked certificates. The issuer must have the CRL signing key usage.
+// number is the CRL number, which must be greater than the number of every CRL previously issued by issuer. The CRL is valid for opts.CRLDays. If opts is nil, DefaultOptions is used
+func GenerateCRL(issuer *Issuer, number *big.Int, revoked []pkix.RevokedCertificate, opts *Options) ([]byte, error) {
+	opts = opts.withDefaults()
+
+	now := opts.Now()
+	tmpl := &x509.RevocationList{
+		RevokedCertificates: revoked,
+		Number:              number,
+		ThisUpdate:          now,
+		NextUpdate:          now.AddDate(0, 0, opts.CRLDays),
+	}
+
+	der, err := x509.CreateRevocationList(opts.Rand, tmpl, issuer.Cert, issuer.Key)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign CRL: %w", err)
+	}
+
+	return der, nil
+}
@@ -0,0 +1,62 @@
+package cert
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/korylprince/ls-relay-cert/internal/testutil"
+)
+
+func TestGenerateCRL(t *testing.T) {
+	opts := testOptions()
+	opts.CRLDistributionPoints = []string{"http://example.com/v1/lsrelay/crl"}
+
+	ca, caKey, err := GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	if len(ca.CRLDistributionPoints) != 0 {
+		t.Errorf("want no CRL distribution points on self-signed CA, got %v", ca.CRLDistributionPoints)
+	}
+
+	lh, _, err := GenerateLocalhost(ca, caKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate localhost: %v", err)
+	}
+	if !reflect.DeepEqual(lh.CRLDistributionPoints, opts.CRLDistributionPoints) {
+		t.Errorf("want CRL distribution points %v, got %v", opts.CRLDistributionPoints, lh.CRLDistributionPoints)
+	}
+
+	der, err := GenerateCRL(&Issuer{Cert: ca, Key: caKey}, big.NewInt(42), []pkix.RevokedCertificate{{SerialNumber: lh.SerialNumber, RevocationTime: testutil.Time}}, opts)
+	if err != nil {
+		t.Fatalf("could not generate CRL: %v", err)
+	}
+
+	crl, err := x509.ParseCRL(der)
+	if err != nil {
+		t.Fatalf("could not parse CRL: %v", err)
+	}
+	if err = ca.CheckCRLSignature(crl); err != nil {
+		t.Errorf("could not verify CRL signature: %v", err)
+	}
+
+	parsed, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatalf("could not parse revocation list: %v", err)
+	}
+	if parsed.Number.Cmp(big.NewInt(42)) != 0 {
+		t.Errorf("want CRL number 42, got %s", parsed.Number)
+	}
+
+	if want := testutil.Time.AddDate(0, 0, 7); !crl.TBSCertList.NextUpdate.Equal(want) {
+		t.Errorf("want NextUpdate %s, got %s", want, crl.TBSCertList.NextUpdate)
+	}
+
+	revoked := crl.TBSCertList.RevokedCertificates
+	if len(revoked) != 1 || revoked[0].SerialNumber.Cmp(lh.SerialNumber) != 0 {
+		t.Errorf("want revoked serial %X, got %v", lh.SerialNumber, revoked)
+	}
+}
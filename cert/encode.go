@@ -0,0 +1,25 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"io"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// EncodePKCS12 returns a password protected PKCS #12 file containing the key pair and caCerts, using randomness from r.
+// If r is nil, crypto/rand.Reader is used. Legacy encryption is used for compatibility with macOS and Windows
+func EncodePKCS12(r io.Reader, key crypto.Signer, cert *x509.Certificate, caCerts []*x509.Certificate, password string) ([]byte, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+
+	buf, err := pkcs12.Encode(r, key, cert, caCerts, password)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode PKCS #12: %w", err)
+	}
+	return buf, nil
+}
@@ -0,0 +1,93 @@
+package cert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Issuer is a CA key pair used to issue certificates
+type Issuer struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+	// Chain is the chain of certificates that issued Cert, ordered from Cert's issuer to the root. It is empty if Cert is a root
+	Chain []*x509.Certificate
+}
+
+// Root returns the root certificate of the issuer's chain
+func (i *Issuer) Root() *x509.Certificate {
+	if len(i.Chain) == 0 {
+		return i.Cert
+	}
+	return i.Chain[len(i.Chain)-1]
+}
+
+// Intermediates returns the intermediate certificates of the issuer's chain, including Cert if it's not the root
+func (i *Issuer) Intermediates() []*x509.Certificate {
+	if len(i.Chain) == 0 {
+		return nil
+	}
+	return append([]*x509.Certificate{i.Cert}, i.Chain[:len(i.Chain)-1]...)
+}
+
+// SubIssuer returns an Issuer for the given CA key pair, which was issued by i
+func (i *Issuer) SubIssuer(cert *x509.Certificate, key crypto.Signer) *Issuer {
+	return &Issuer{Cert: cert, Key: key, Chain: append([]*x509.Certificate{i.Cert}, i.Chain...)}
+}
+
+// Verify returns an error if Cert doesn't chain to the root through Chain, or the root isn't self-signed
+func (i *Issuer) Verify() error {
+	root := i.Root()
+	if err := root.CheckSignatureFrom(root); err != nil {
+		return fmt.Errorf("root certificate is not self-signed: %w", err)
+	}
+
+	cert := i.Cert
+	for idx, parent := range i.Chain {
+		if err := cert.CheckSignatureFrom(parent); err != nil {
+			return fmt.Errorf("chain certificate %d (%s) did not issue %s: %w", idx, parent.Subject, cert.Subject, err)
+		}
+		cert = parent
+	}
+
+	return nil
+}
+
+// ChainPEM returns the PEM encoding of the given certificates
+func ChainPEM(certs ...*x509.Certificate) []byte {
+	buf := new(bytes.Buffer)
+	for _, c := range certs {
+		pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	return buf.Bytes()
+}
+
+// ParseCertificatesPEM parses all PEM encoded certificates in data
+func ParseCertificatesPEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse certificate %d: %w", len(certs), err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no CERTIFICATE block found")
+	}
+
+	return certs, nil
+}
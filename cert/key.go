@@ -0,0 +1,149 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/youmark/pkcs8"
+)
+
+// KeyType is a private key algorithm and size
+type KeyType string
+
+// Supported key types. KeyTypeEd25519 should only be used if the agent supports it
+const (
+	KeyTypeRSA2048   KeyType = "rsa2048"
+	KeyTypeRSA3072   KeyType = "rsa3072"
+	KeyTypeRSA4096   KeyType = "rsa4096"
+	KeyTypeECDSAP256 KeyType = "ecdsa-p256"
+	KeyTypeECDSAP384 KeyType = "ecdsa-p384"
+	KeyTypeEd25519   KeyType = "ed25519"
+)
+
+// DefaultKeyType is used when a KeyType isn't specified
+const DefaultKeyType = KeyTypeRSA4096
+
+// KeyTypes is the list of supported key types
+var KeyTypes = []KeyType{KeyTypeRSA2048, KeyTypeRSA3072, KeyTypeRSA4096, KeyTypeECDSAP256, KeyTypeECDSAP384, KeyTypeEd25519}
+
+// ParseKeyType returns the KeyType for the given string, or an error if the key type isn't supported
+func ParseKeyType(s string) (KeyType, error) {
+	for _, t := range KeyTypes {
+		if strings.EqualFold(s, string(t)) {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported key type: %q", s)
+}
+
+// GenerateKey generates a new private key of the given type using randomness from r. If typ is empty, DefaultKeyType is used.
+// If r is nil, crypto/rand.Reader is used
+func GenerateKey(typ KeyType, r io.Reader) (crypto.Signer, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+
+	switch typ {
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(r, 2048)
+	case KeyTypeRSA3072:
+		return rsa.GenerateKey(r, 3072)
+	case KeyTypeRSA4096, "":
+		return rsa.GenerateKey(r, 4096)
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), r)
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), r)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(r)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported key type: %q", typ)
+}
+
+// MarshalPrivateKeyPEM returns the PEM encoding of key. RSA keys are encoded as PKCS #1 "RSA PRIVATE KEY",
+// ECDSA keys as SEC 1 "EC PRIVATE KEY", and all others as PKCS #8 "PRIVATE KEY"
+func MarshalPrivateKeyPEM(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("could not marshal EC private key: %w", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal PKCS #8 private key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// MarshalEncryptedPrivateKeyPEM returns the PEM encoding of key as a PKCS #8 "ENCRYPTED PRIVATE KEY",
+// encrypted with passphrase using PBKDF2 and AES-256-CBC
+func MarshalEncryptedPrivateKeyPEM(key crypto.Signer, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase must not be empty")
+	}
+
+	der, err := pkcs8.MarshalPrivateKey(key, passphrase, pkcs8.DefaultOpts)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal encrypted PKCS #8 private key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), nil
+}
+
+// subjectKeyID returns a subject key identifier for the given public key
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	var buf []byte
+	if k, ok := pub.(*rsa.PublicKey); ok {
+		buf = x509.MarshalPKCS1PublicKey(k)
+	} else {
+		b, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return nil, fmt.Errorf("could not marshal public key: %w", err)
+		}
+		buf = b
+	}
+	ski := sha512.Sum512(buf)
+	return ski[:], nil
+}
+
+// keyUsage returns the appropriate key usage for a CA or leaf certificate with the given public key.
+// Encipherment usages only apply to RSA keys
+func keyUsage(pub crypto.PublicKey, ca bool) x509.KeyUsage {
+	_, isRSA := pub.(*rsa.PublicKey)
+	if ca {
+		if isRSA {
+			return x509.KeyUsageDigitalSignature | x509.KeyUsageDataEncipherment | x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		}
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+	if isRSA {
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	}
+	return x509.KeyUsageDigitalSignature
+}
+
+// CheckKeyPair returns an error if key is not the private key for cert
+func CheckKeyPair(cert *x509.Certificate, key crypto.Signer) error {
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return errors.New("private key does not match certificate")
+	}
+	return nil
+}
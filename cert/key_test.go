@@ -0,0 +1,45 @@
+package cert
+
+import (
+	"crypto"
+	"testing"
+)
+
+func TestEncryptedPrivateKeyPEM(t *testing.T) {
+	for _, typ := range []KeyType{KeyTypeRSA2048, KeyTypeECDSAP256, KeyTypeECDSAP384, KeyTypeEd25519} {
+		t.Run(string(typ), func(t *testing.T) {
+			key, err := GenerateKey(typ, nil)
+			if err != nil {
+				t.Fatalf("could not generate key: %v", err)
+			}
+
+			buf, err := MarshalEncryptedPrivateKeyPEM(key, []byte("secret"))
+			if err != nil {
+				t.Fatalf("could not marshal key: %v", err)
+			}
+
+			parsed, err := ParseEncryptedPrivateKeyPEM(buf, []byte("secret"))
+			if err != nil {
+				t.Fatalf("could not parse key: %v", err)
+			}
+			if !parsed.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+				t.Error("parsed key does not match original")
+			}
+
+			if _, err = ParseEncryptedPrivateKeyPEM(buf, []byte("wrong")); err == nil {
+				t.Error("want error with wrong passphrase, got nil")
+			}
+			if _, err = ParsePrivateKeyPEM(buf); err == nil {
+				t.Error("want error without passphrase, got nil")
+			}
+		})
+	}
+
+	key, err := GenerateKey(KeyTypeECDSAP256, nil)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	if _, err = MarshalEncryptedPrivateKeyPEM(key, nil); err == nil {
+		t.Error("want error with empty passphrase, got nil")
+	}
+}
@@ -0,0 +1,284 @@
+package cert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ParseCertificatePEM parses the first PEM encoded certificate in data
+func ParseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no CERTIFICATE block found")
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse certificate: %w", err)
+		}
+		return cert, nil
+	}
+}
+
+// ParsePrivateKeyPEM parses the first PEM encoded PKCS #1, SEC 1, or PKCS #8 private key in data
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	return ParseEncryptedPrivateKeyPEM(data, nil)
+}
+
+// ParseEncryptedPrivateKeyPEM parses the first PEM encoded PKCS #1, SEC 1, or PKCS #8 private key in data.
+// Encrypted PKCS #8 ("ENCRYPTED PRIVATE KEY") and legacy encrypted PEM blocks are decrypted with passphrase
+func ParseEncryptedPrivateKeyPEM(data, passphrase []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PRIVATE KEY block found")
+		}
+
+		var (
+			key interface{}
+			err error
+		)
+
+		// legacy encrypted PEM is deprecated, but still commonly used for existing CA keys
+		if x509.IsEncryptedPEMBlock(block) {
+			if len(passphrase) == 0 {
+				return nil, errors.New("private key is encrypted but no passphrase was given")
+			}
+			der, err := x509.DecryptPEMBlock(block, passphrase)
+			if err != nil {
+				return nil, fmt.Errorf("could not decrypt %s: %w", block.Type, err)
+			}
+			block = &pem.Block{Type: block.Type, Bytes: der}
+		}
+
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "ENCRYPTED PRIVATE KEY":
+			if len(passphrase) == 0 {
+				return nil, errors.New("private key is encrypted but no passphrase was given")
+			}
+			key, err = pkcs8.ParsePKCS8PrivateKey(block.Bytes, passphrase)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", block.Type, err)
+		}
+
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type: %T", key)
+		}
+		return signer, nil
+	}
+}
+
+// LoadKeyPair reads and parses the PEM encoded certificate and private key at the given paths.
+// If the private key is encrypted, it's decrypted with passphrase
+func LoadKeyPair(certPath, keyPath string, passphrase []byte) (*x509.Certificate, crypto.Signer, error) {
+	buf, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read certificate: %w", err)
+	}
+
+	cert, err := ParseCertificatePEM(buf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse certificate: %w", err)
+	}
+
+	buf, err = os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read private key: %w", err)
+	}
+
+	key, err := ParseEncryptedPrivateKeyPEM(buf, passphrase)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse private key: %w", err)
+	}
+
+	return cert, key, nil
+}
+
+// LoadPKCS12 reads and decodes the PKCS #12 file at path with the given password, returning the key pair and any additional CA certificates
+func LoadPKCS12(path, password string) (*x509.Certificate, crypto.Signer, []*x509.Certificate, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not read PKCS #12 file: %w", err)
+	}
+
+	key, cert, caCerts, err := pkcs12.DecodeChain(buf, password)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not decode PKCS #12 file: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("unsupported private key type: %T", key)
+	}
+
+	return cert, signer, caCerts, nil
+}
+
+// CAFiles specifies the location of an existing CA key pair. Either PKCS12File, CertFile and KeyFile, or CertFile and Signer must be set
+type CAFiles struct {
+	// CertFile is the path to the PEM encoded CA certificate. Any additional certificates in the file are used as ChainFile
+	CertFile string
+	// KeyFile is the path to the PEM encoded CA private key
+	KeyFile string
+	// PKCS12File is the path to the PKCS #12 encoded CA key pair
+	PKCS12File string
+	// Passphrase is used to decrypt the private key or PKCS #12 file
+	Passphrase string
+	// Signer, if set, is used as the CA private key instead of KeyFile, e.g. for a key stored in a PKCS #11 token
+	Signer crypto.Signer
+	// ChainFile is the optional path to the PEM encoded intermediate and root certificates that issued the CA, in any order.
+	// Additional certificates in a PKCS #12 file are also used
+	ChainFile string
+}
+
+// Empty returns true if no files or signer are specified
+func (f *CAFiles) Empty() bool {
+	return f.CertFile == "" && f.KeyFile == "" && f.PKCS12File == "" && f.Signer == nil
+}
+
+// LoadCA loads the CA key pair and chain specified by files and validates them with ValidateCA and Issuer.Verify
+func LoadCA(files *CAFiles) (*Issuer, error) {
+	var (
+		cert *x509.Certificate
+		key  crypto.Signer
+		pool []*x509.Certificate
+		err  error
+	)
+
+	switch {
+	case files.PKCS12File != "":
+		if files.CertFile != "" || files.KeyFile != "" || files.Signer != nil {
+			return nil, errors.New("PKCS #12 file, PEM files, and signer are mutually exclusive")
+		}
+		cert, key, pool, err = LoadPKCS12(files.PKCS12File, files.Passphrase)
+	case files.Signer != nil:
+		if files.CertFile == "" || files.KeyFile != "" {
+			return nil, errors.New("signer requires a CA certificate and no CA key")
+		}
+		key = files.Signer
+		pool, err = loadCertificates(files.CertFile)
+		if err == nil {
+			cert, pool = pool[0], pool[1:]
+		}
+	case files.CertFile != "" && files.KeyFile != "":
+		cert, key, err = LoadKeyPair(files.CertFile, files.KeyFile, []byte(files.Passphrase))
+		if err == nil {
+			pool, err = loadCertificates(files.CertFile)
+			if len(pool) > 0 {
+				pool = pool[1:]
+			}
+		}
+	default:
+		return nil, errors.New("CA certificate and key or PKCS #12 file must be specified")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if files.ChainFile != "" {
+		chain, err := loadCertificates(files.ChainFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load chain: %w", err)
+		}
+		pool = append(pool, chain...)
+	}
+
+	if err = ValidateCA(cert, key); err != nil {
+		return nil, fmt.Errorf("invalid CA: %w", err)
+	}
+
+	issuer := &Issuer{Cert: cert, Key: key}
+	if issuer.Chain, err = orderChain(cert, pool); err != nil {
+		return nil, fmt.Errorf("invalid chain: %w", err)
+	}
+
+	if err = issuer.Verify(); err != nil {
+		return nil, fmt.Errorf("invalid chain: %w", err)
+	}
+
+	return issuer, nil
+}
+
+// loadCertificates reads and parses all PEM encoded certificates in the file at path
+func loadCertificates(path string) ([]*x509.Certificate, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read certificates: %w", err)
+	}
+	return ParseCertificatesPEM(buf)
+}
+
+// orderChain returns the certificates in pool that issued cert, ordered from cert's issuer to the root
+func orderChain(cert *x509.Certificate, pool []*x509.Certificate) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for {
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+			return chain, nil
+		}
+
+		var parent *x509.Certificate
+		for _, c := range pool {
+			if bytes.Equal(cert.RawIssuer, c.RawSubject) && !c.Equal(cert) && cert.CheckSignatureFrom(c) == nil {
+				parent = c
+				break
+			}
+		}
+
+		if parent == nil {
+			return nil, fmt.Errorf("issuer of %s not found", cert.Subject)
+		}
+		if len(chain) > len(pool) {
+			return nil, errors.New("chain contains a loop")
+		}
+
+		chain = append(chain, parent)
+		cert = parent
+	}
+}
+
+// ValidateCA returns an error if cert is not a currently valid CA certificate or key does not match it
+func ValidateCA(cert *x509.Certificate, key crypto.Signer) error {
+	if err := CheckKeyPair(cert, key); err != nil {
+		return err
+	}
+
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return errors.New("certificate is not a CA")
+	}
+
+	if cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return errors.New("certificate is not valid for signing certificates")
+	}
+
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate is not valid at the current time (valid from %s to %s)", cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	}
+
+	return nil
+}
@@ -0,0 +1,304 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a CA key pair and the chain that issued it, ordered from the CA's issuer to the root
+type testCA struct {
+	cert  *x509.Certificate
+	key   crypto.Signer
+	chain []*x509.Certificate
+}
+
+// generateTestCA returns a CA issued by an intermediate and root CA
+func generateTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	opts := DefaultOptions()
+	opts.KeyType = KeyTypeECDSAP256
+
+	root, rootKey, err := GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate root: %v", err)
+	}
+	inter, interKey, err := GenerateSubCA(root, rootKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate intermediate: %v", err)
+	}
+	ca, caKey, err := GenerateSubCA(inter, interKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+
+	return &testCA{cert: ca, key: caKey, chain: []*x509.Certificate{inter, root}}
+}
+
+// marshalKey returns the PEM encoding of key, encrypted with passphrase if it's not empty
+func marshalKey(t *testing.T, key crypto.Signer, passphrase string) []byte {
+	t.Helper()
+
+	var (
+		buf []byte
+		err error
+	)
+	if passphrase == "" {
+		buf, err = MarshalPrivateKeyPEM(key)
+	} else {
+		buf, err = MarshalEncryptedPrivateKeyPEM(key, []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+	return buf
+}
+
+// selfSigned returns a self-signed certificate created from tmpl and its key
+func selfSigned(t *testing.T, tmpl *x509.Certificate) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+
+	key, err := GenerateKey(KeyTypeECDSAP256, nil)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	tmpl.SerialNumber = big.NewInt(1)
+	tmpl.Subject = pkix.Name{CommonName: "Test CA"}
+	tmpl.BasicConstraintsValid = true
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+		tmpl.NotAfter = time.Now().AddDate(1, 0, 0)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+func TestLoadCA(t *testing.T) {
+	tests := []struct {
+		name string
+		// files returns the files to write and the CAFiles that reference them, relative to the test directory
+		files func(t *testing.T, ca *testCA) (map[string][]byte, *CAFiles)
+		err   bool
+	}{
+		{
+			name: "PEM without passphrase",
+			files: func(t *testing.T, ca *testCA) (map[string][]byte, *CAFiles) {
+				return map[string][]byte{
+					"ca.pem":     ChainPEM(append([]*x509.Certificate{ca.cert}, ca.chain...)...),
+					"ca_key.pem": marshalKey(t, ca.key, ""),
+				}, &CAFiles{CertFile: "ca.pem", KeyFile: "ca_key.pem"}
+			},
+		},
+		{
+			name: "PEM with passphrase",
+			files: func(t *testing.T, ca *testCA) (map[string][]byte, *CAFiles) {
+				return map[string][]byte{
+					"ca.pem":     ChainPEM(ca.cert),
+					"ca_key.pem": marshalKey(t, ca.key, "secret"),
+					"chain.pem":  ChainPEM(ca.chain...),
+				}, &CAFiles{CertFile: "ca.pem", KeyFile: "ca_key.pem", Passphrase: "secret", ChainFile: "chain.pem"}
+			},
+		},
+		{
+			name: "PEM with wrong passphrase",
+			files: func(t *testing.T, ca *testCA) (map[string][]byte, *CAFiles) {
+				return map[string][]byte{
+					"ca.pem":     ChainPEM(append([]*x509.Certificate{ca.cert}, ca.chain...)...),
+					"ca_key.pem": marshalKey(t, ca.key, "secret"),
+				}, &CAFiles{CertFile: "ca.pem", KeyFile: "ca_key.pem", Passphrase: "wrong"}
+			},
+			err: true,
+		},
+		{
+			name: "legacy encrypted PEM",
+			files: func(t *testing.T, ca *testCA) (map[string][]byte, *CAFiles) {
+				der, err := x509.MarshalPKCS8PrivateKey(ca.key)
+				if err != nil {
+					t.Fatalf("could not marshal key: %v", err)
+				}
+				// legacy encrypted PEM is deprecated, but LoadCA still supports it for existing CA keys
+				block, err := x509.EncryptPEMBlock(rand.Reader, "PRIVATE KEY", der, []byte("secret"), x509.PEMCipherAES256)
+				if err != nil {
+					t.Fatalf("could not encrypt key: %v", err)
+				}
+				return map[string][]byte{
+					"ca.pem":     ChainPEM(append([]*x509.Certificate{ca.cert}, ca.chain...)...),
+					"ca_key.pem": pem.EncodeToMemory(block),
+				}, &CAFiles{CertFile: "ca.pem", KeyFile: "ca_key.pem", Passphrase: "secret"}
+			},
+		},
+		{
+			name: "PKCS #12 with password",
+			files: func(t *testing.T, ca *testCA) (map[string][]byte, *CAFiles) {
+				buf, err := EncodePKCS12(nil, ca.key, ca.cert, ca.chain, "secret")
+				if err != nil {
+					t.Fatalf("could not encode PKCS #12: %v", err)
+				}
+				return map[string][]byte{"ca.p12": buf}, &CAFiles{PKCS12File: "ca.p12", Passphrase: "secret"}
+			},
+		},
+		{
+			name: "PKCS #12 without password",
+			files: func(t *testing.T, ca *testCA) (map[string][]byte, *CAFiles) {
+				buf, err := EncodePKCS12(nil, ca.key, ca.cert, ca.chain, "")
+				if err != nil {
+					t.Fatalf("could not encode PKCS #12: %v", err)
+				}
+				return map[string][]byte{"ca.p12": buf}, &CAFiles{PKCS12File: "ca.p12"}
+			},
+		},
+		{
+			name: "shuffled chain",
+			files: func(t *testing.T, ca *testCA) (map[string][]byte, *CAFiles) {
+				return map[string][]byte{
+					"ca.pem":     ChainPEM(ca.cert),
+					"ca_key.pem": marshalKey(t, ca.key, ""),
+					"chain.pem":  ChainPEM(ca.chain[1], ca.chain[0]),
+				}, &CAFiles{CertFile: "ca.pem", KeyFile: "ca_key.pem", ChainFile: "chain.pem"}
+			},
+		},
+		{
+			name: "missing chain",
+			files: func(t *testing.T, ca *testCA) (map[string][]byte, *CAFiles) {
+				return map[string][]byte{
+					"ca.pem":     ChainPEM(ca.cert),
+					"ca_key.pem": marshalKey(t, ca.key, ""),
+				}, &CAFiles{CertFile: "ca.pem", KeyFile: "ca_key.pem"}
+			},
+			err: true,
+		},
+		{
+			name: "mismatched key",
+			files: func(t *testing.T, ca *testCA) (map[string][]byte, *CAFiles) {
+				key, err := GenerateKey(KeyTypeECDSAP256, nil)
+				if err != nil {
+					t.Fatalf("could not generate key: %v", err)
+				}
+				return map[string][]byte{
+					"ca.pem":     ChainPEM(append([]*x509.Certificate{ca.cert}, ca.chain...)...),
+					"ca_key.pem": marshalKey(t, key, ""),
+				}, &CAFiles{CertFile: "ca.pem", KeyFile: "ca_key.pem"}
+			},
+			err: true,
+		},
+		{
+			name: "not a CA",
+			files: func(t *testing.T, ca *testCA) (map[string][]byte, *CAFiles) {
+				cert, key := selfSigned(t, &x509.Certificate{KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign})
+				return map[string][]byte{
+					"ca.pem":     ChainPEM(cert),
+					"ca_key.pem": marshalKey(t, key, ""),
+				}, &CAFiles{CertFile: "ca.pem", KeyFile: "ca_key.pem"}
+			},
+			err: true,
+		},
+		{
+			name: "CA without CertSign",
+			files: func(t *testing.T, ca *testCA) (map[string][]byte, *CAFiles) {
+				cert, key := selfSigned(t, &x509.Certificate{IsCA: true, KeyUsage: x509.KeyUsageDigitalSignature})
+				return map[string][]byte{
+					"ca.pem":     ChainPEM(cert),
+					"ca_key.pem": marshalKey(t, key, ""),
+				}, &CAFiles{CertFile: "ca.pem", KeyFile: "ca_key.pem"}
+			},
+			err: true,
+		},
+		{
+			name: "expired CA",
+			files: func(t *testing.T, ca *testCA) (map[string][]byte, *CAFiles) {
+				cert, key := selfSigned(t, &x509.Certificate{
+					IsCA:      true,
+					KeyUsage:  x509.KeyUsageCertSign,
+					NotBefore: time.Now().AddDate(-2, 0, 0),
+					NotAfter:  time.Now().AddDate(-1, 0, 0),
+				})
+				return map[string][]byte{
+					"ca.pem":     ChainPEM(cert),
+					"ca_key.pem": marshalKey(t, key, ""),
+				}, &CAFiles{CertFile: "ca.pem", KeyFile: "ca_key.pem"}
+			},
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ca := generateTestCA(t)
+			files, caFiles := test.files(t, ca)
+
+			for name, buf := range files {
+				if err := os.WriteFile(filepath.Join(dir, name), buf, 0600); err != nil {
+					t.Fatalf("could not write %s: %v", name, err)
+				}
+			}
+			for _, path := range []*string{&caFiles.CertFile, &caFiles.KeyFile, &caFiles.PKCS12File, &caFiles.ChainFile} {
+				if *path != "" {
+					*path = filepath.Join(dir, *path)
+				}
+			}
+
+			issuer, err := LoadCA(caFiles)
+			if test.err {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not load CA: %v", err)
+			}
+
+			if !issuer.Cert.Equal(ca.cert) {
+				t.Errorf("want CA %s, got %s", ca.cert.Subject, issuer.Cert.Subject)
+			}
+			if err = CheckKeyPair(issuer.Cert, issuer.Key); err != nil {
+				t.Errorf("could not check key pair: %v", err)
+			}
+			if len(issuer.Chain) != len(ca.chain) {
+				t.Fatalf("want chain length %d, got %d", len(ca.chain), len(issuer.Chain))
+			}
+			for idx, c := range ca.chain {
+				if !issuer.Chain[idx].Equal(c) {
+					t.Errorf("chain %d: want %s, got %s", idx, c.Subject, issuer.Chain[idx].Subject)
+				}
+			}
+		})
+	}
+}
+
+func TestOrderChain(t *testing.T) {
+	ca := generateTestCA(t)
+	inter, root := ca.chain[0], ca.chain[1]
+
+	unrelated, _ := selfSigned(t, &x509.Certificate{IsCA: true, KeyUsage: x509.KeyUsageCertSign})
+
+	chain, err := orderChain(ca.cert, []*x509.Certificate{root, unrelated, inter})
+	if err != nil {
+		t.Fatalf("could not order chain: %v", err)
+	}
+	if len(chain) != 2 || !chain[0].Equal(inter) || !chain[1].Equal(root) {
+		t.Errorf("want chain [%s %s], got %v", inter.Subject, root.Subject, chain)
+	}
+
+	if _, err = orderChain(ca.cert, []*x509.Certificate{root}); err == nil {
+		t.Error("want error for chain missing the intermediate, got nil")
+	}
+}
@@ -0,0 +1,170 @@
+package cert
+
+import (
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Options is used to customize generated certificates. Zero values are replaced with the values from DefaultOptions
+type Options struct {
+	// KeyType is the key type used for generated keys
+	KeyType KeyType
+	// Subject is the subject of the CA certificate. The localhost certificate uses the same Organization
+	Subject pkix.Name
+	// DNSNames are the DNS Subject Alternative Names of the localhost certificate
+	DNSNames []string
+	// IPAddresses are the IP Subject Alternative Names of the localhost certificate
+	IPAddresses []net.IP
+	// CAYears is the validity of the CA certificate in years
+	CAYears int
+	// LeafDays is the validity of the localhost certificate in days
+	LeafDays int
+	// CRLDistributionPoints are the CRL URLs added to certificates that aren't self-signed
+	CRLDistributionPoints []string
+	// CRLDays is the validity of generated CRLs in days
+	CRLDays int
+	// Rand is the source of randomness for keys, serial numbers, and signatures. If nil, crypto/rand.Reader is used
+	Rand io.Reader
+	// Now returns the current time, used as the start of certificate validity. If nil, time.Now is used
+	Now func() time.Time
+}
+
+// DefaultOptions returns the default Options
+func DefaultOptions() *Options {
+	return &Options{
+		KeyType: DefaultKeyType,
+		Subject: pkix.Name{
+			CommonName:    "Lightspeed Filter Agent",
+			Organization:  []string{"Lightspeed Systems"},
+			Country:       []string{"US"},
+			Locality:      []string{"Austin"},
+			Province:      []string{"Texas"},
+			StreetAddress: []string{"2500 Bee Cave Road, Suite 350"},
+			PostalCode:    []string{"78746"},
+		},
+		DNSNames: []string{"localhost"},
+		CAYears:  10,
+		LeafDays: 365,
+		CRLDays:  7,
+		Rand:     rand.Reader,
+		Now:      time.Now,
+	}
+}
+
+// withDefaults returns a copy of o with zero values replaced by defaults. o may be nil
+func (o *Options) withDefaults() *Options {
+	d := DefaultOptions()
+	if o == nil {
+		return d
+	}
+
+	opts := *o
+	if opts.KeyType == "" {
+		opts.KeyType = d.KeyType
+	}
+	if opts.Subject.String() == "" {
+		opts.Subject = d.Subject
+	}
+	if len(opts.DNSNames) == 0 && len(opts.IPAddresses) == 0 {
+		opts.DNSNames = d.DNSNames
+	}
+	if opts.CAYears == 0 {
+		opts.CAYears = d.CAYears
+	}
+	if opts.LeafDays == 0 {
+		opts.LeafDays = d.LeafDays
+	}
+	if opts.CRLDays == 0 {
+		opts.CRLDays = d.CRLDays
+	}
+	if opts.Rand == nil {
+		opts.Rand = d.Rand
+	}
+	if opts.Now == nil {
+		opts.Now = d.Now
+	}
+
+	return &opts
+}
+
+// ParseName parses a distinguished name like "CN=Example CA,O=Example\, Inc.,C=US" into a pkix.Name.
+// Supported attributes are CN, O, OU, C, ST, L, STREET, POSTALCODE, and SERIALNUMBER. Commas in values must be escaped with a backslash
+func ParseName(dn string) (pkix.Name, error) {
+	var (
+		name  pkix.Name
+		parts []string
+		cur   strings.Builder
+	)
+
+	for i := 0; i < len(dn); i++ {
+		switch {
+		case dn[i] == '\\' && i+1 < len(dn):
+			i++
+			cur.WriteByte(dn[i])
+		case dn[i] == ',':
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(dn[i])
+		}
+	}
+	parts = append(parts, cur.String())
+
+	for _, part := range parts {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return pkix.Name{}, fmt.Errorf("invalid attribute: %q", part)
+		}
+
+		val := strings.TrimSpace(kv[1])
+		switch strings.ToUpper(strings.TrimSpace(kv[0])) {
+		case "CN":
+			name.CommonName = val
+		case "O":
+			name.Organization = append(name.Organization, val)
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, val)
+		case "C":
+			name.Country = append(name.Country, val)
+		case "ST":
+			name.Province = append(name.Province, val)
+		case "L":
+			name.Locality = append(name.Locality, val)
+		case "STREET":
+			name.StreetAddress = append(name.StreetAddress, val)
+		case "POSTALCODE":
+			name.PostalCode = append(name.PostalCode, val)
+		case "SERIALNUMBER":
+			name.SerialNumber = val
+		default:
+			return pkix.Name{}, fmt.Errorf("unsupported attribute: %q", kv[0])
+		}
+	}
+
+	return name, nil
+}
+
+// ParseIPs parses the given IP addresses
+func ParseIPs(ips []string) ([]net.IP, error) {
+	parsed := make([]net.IP, 0, len(ips))
+	for _, s := range ips {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %q", s)
+		}
+		parsed = append(parsed, ip)
+	}
+	return parsed, nil
+}
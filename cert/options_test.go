@@ -0,0 +1,142 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseName(t *testing.T) {
+	cases := []struct {
+		dn   string
+		want pkix.Name
+		err  bool
+	}{
+		{
+			dn:   "CN=Example CA,O=Example ISD,C=US",
+			want: pkix.Name{CommonName: "Example CA", Organization: []string{"Example ISD"}, Country: []string{"US"}},
+		},
+		{
+			dn:   "cn = Example CA, o=Example\\, Inc., OU=IT, OU=Network",
+			want: pkix.Name{CommonName: "Example CA", Organization: []string{"Example, Inc."}, OrganizationalUnit: []string{"IT", "Network"}},
+		},
+		{
+			dn:   "ST=Texas,L=Austin,STREET=1 Main St,POSTALCODE=78746,SERIALNUMBER=1234",
+			want: pkix.Name{Province: []string{"Texas"}, Locality: []string{"Austin"}, StreetAddress: []string{"1 Main St"}, PostalCode: []string{"78746"}, SerialNumber: "1234"},
+		},
+		{dn: "CN=Example,DC=example", err: true},
+		{dn: "Example CA", err: true},
+	}
+
+	for _, c := range cases {
+		name, err := ParseName(c.dn)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: want error, got %v", c.dn, name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.dn, err)
+			continue
+		}
+		if !reflect.DeepEqual(name, c.want) {
+			t.Errorf("%q: want %#v, got %#v", c.dn, c.want, name)
+		}
+	}
+}
+
+func TestParseIPs(t *testing.T) {
+	cases := []struct {
+		ips  []string
+		want []net.IP
+		err  bool
+	}{
+		{ips: nil, want: []net.IP{}},
+		{ips: []string{"127.0.0.1", " ::1 "}, want: []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback}},
+		{ips: []string{"", "  ", "10.0.0.1"}, want: []net.IP{net.ParseIP("10.0.0.1")}},
+		{ips: []string{"fe80::1", "2001:db8::1"}, want: []net.IP{net.ParseIP("fe80::1"), net.ParseIP("2001:db8::1")}},
+		{ips: []string{"::ffff:192.0.2.1"}, want: []net.IP{net.ParseIP("192.0.2.1")}},
+		{ips: []string{"localhost"}, err: true},
+		{ips: []string{"127.0.0.1", "256.0.0.1"}, err: true},
+		{ips: []string{"10.0.0.0/8"}, err: true},
+		{ips: []string{"fe80::1%en0"}, err: true},
+		{ips: []string{"[::1]"}, err: true},
+	}
+
+	for _, c := range cases {
+		ips, err := ParseIPs(c.ips)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: want error, got %v", c.ips, ips)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.ips, err)
+			continue
+		}
+		if len(ips) != len(c.want) {
+			t.Errorf("%q: want %v, got %v", c.ips, c.want, ips)
+			continue
+		}
+		for idx, ip := range ips {
+			if !ip.Equal(c.want[idx]) {
+				t.Errorf("%q: want %v, got %v", c.ips, c.want, ips)
+				break
+			}
+		}
+	}
+}
+
+func TestWithDefaults(t *testing.T) {
+	d := DefaultOptions()
+
+	opts := (*Options)(nil).withDefaults()
+	if opts.KeyType != d.KeyType || opts.CAYears != d.CAYears || opts.Rand == nil || opts.Now == nil {
+		t.Errorf("want defaults for nil options, got %+v", opts)
+	}
+
+	// unset fields are filled
+	opts = new(Options).withDefaults()
+	if opts.KeyType != d.KeyType || !reflect.DeepEqual(opts.Subject, d.Subject) || !reflect.DeepEqual(opts.DNSNames, d.DNSNames) ||
+		opts.CAYears != d.CAYears || opts.LeafDays != d.LeafDays || opts.CRLDays != d.CRLDays || opts.Rand == nil || opts.Now == nil {
+		t.Errorf("want defaults for unset fields, got %+v", opts)
+	}
+
+	// fields set by the caller aren't overwritten
+	rnd := bytes.NewReader(nil)
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	set := &Options{
+		KeyType:               KeyTypeEd25519,
+		Subject:               pkix.Name{CommonName: "Example CA"},
+		IPAddresses:           []net.IP{net.IPv6loopback},
+		CAYears:               2,
+		LeafDays:              30,
+		CRLDistributionPoints: []string{"https://example.com/crl"},
+		CRLDays:               1,
+		Rand:                  rnd,
+		Now:                   func() time.Time { return now },
+	}
+	opts = set.withDefaults()
+	if opts == set {
+		t.Error("want copy of options")
+	}
+	if opts.KeyType != KeyTypeEd25519 || opts.Subject.CommonName != "Example CA" || len(opts.Subject.Organization) != 0 ||
+		opts.CAYears != 2 || opts.LeafDays != 30 || opts.CRLDays != 1 || opts.Rand != rnd || !opts.Now().Equal(now) ||
+		!reflect.DeepEqual(opts.CRLDistributionPoints, set.CRLDistributionPoints) {
+		t.Errorf("want caller's options kept, got %+v", opts)
+	}
+	// IP addresses alone are enough for the localhost certificate, so the default DNS name isn't added
+	if len(opts.DNSNames) != 0 || len(opts.IPAddresses) != 1 {
+		t.Errorf("want only caller's IP addresses, got %v and %v", opts.DNSNames, opts.IPAddresses)
+	}
+
+	opts = (&Options{DNSNames: []string{"example.com"}}).withDefaults()
+	if !reflect.DeepEqual(opts.DNSNames, []string{"example.com"}) {
+		t.Errorf("want caller's DNS names, got %v", opts.DNSNames)
+	}
+}
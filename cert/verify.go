@@ -0,0 +1,256 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// VerifyInput specifies the files to verify
+type VerifyInput struct {
+	// Dir is the directory containing localhost.pem, localhost_key.pem, and the CA files. ca.pem and ca_key.pem are optional,
+	// since shared CA and leaf-only deliveries don't include them, but then chain.pem is required
+	Dir string
+	// Hostnames are the names the localhost certificate must be valid for. If empty, "localhost" is used
+	Hostnames []string
+	// Passphrase is used to decrypt encrypted private keys
+	Passphrase string
+	// Now is the time used to check validity. If zero, the current time is used
+	Now time.Time
+}
+
+// CertificateReport describes a certificate
+type CertificateReport struct {
+	File        string    `json:"file"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	Serial      string    `json:"serial"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	IsCA        bool      `json:"is_ca"`
+	KeyType     string    `json:"key_type"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	IPAddresses []string  `json:"ip_addresses,omitempty"`
+	SHA256      string    `json:"sha256_fingerprint"`
+}
+
+// Check is the result of a single verification check
+type Check struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// Report is the result of Verify
+type Report struct {
+	Certificates []*CertificateReport `json:"certificates"`
+	Checks       []*Check             `json:"checks"`
+
+	// Root is the root certificate found by Verify, or nil
+	Root *x509.Certificate `json:"-"`
+	// CA is the parsed ca.pem, or nil
+	CA *x509.Certificate `json:"-"`
+}
+
+// OK returns true if all checks passed
+func (r *Report) OK() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// AddCheck adds a check with name that failed if err is not nil
+func (r *Report) AddCheck(name string, err error) {
+	c := &Check{Name: name, OK: err == nil}
+	if err != nil {
+		c.Message = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// WriteText writes a human readable report to w
+func (r *Report) WriteText(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	for _, c := range r.Certificates {
+		fmt.Fprintf(buf, "%s:\n", c.File)
+		fmt.Fprintf(buf, "    Subject:     %s\n", c.Subject)
+		fmt.Fprintf(buf, "    Issuer:      %s\n", c.Issuer)
+		fmt.Fprintf(buf, "    Serial:      %s\n", c.Serial)
+		fmt.Fprintf(buf, "    Not Before:  %s\n", c.NotBefore.Format(time.RFC3339))
+		fmt.Fprintf(buf, "    Not After:   %s\n", c.NotAfter.Format(time.RFC3339))
+		fmt.Fprintf(buf, "    CA:          %t\n", c.IsCA)
+		fmt.Fprintf(buf, "    Key Type:    %s\n", c.KeyType)
+		if len(c.DNSNames) > 0 || len(c.IPAddresses) > 0 {
+			fmt.Fprintf(buf, "    SANs:        %s\n", strings.Join(append(append([]string{}, c.DNSNames...), c.IPAddresses...), ", "))
+		}
+		fmt.Fprintf(buf, "    SHA-256:     %s\n\n", c.SHA256)
+	}
+
+	for _, c := range r.Checks {
+		status := "OK  "
+		if !c.OK {
+			status = "FAIL"
+		}
+		if c.Message != "" {
+			fmt.Fprintf(buf, "[%s] %s: %s\n", status, c.Name, c.Message)
+		} else {
+			fmt.Fprintf(buf, "[%s] %s\n", status, c.Name)
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func certificateReport(file string, c *x509.Certificate) *CertificateReport {
+	r := &CertificateReport{
+		File:      file,
+		Subject:   c.Subject.String(),
+		Issuer:    c.Issuer.String(),
+		Serial:    fmt.Sprintf("%X", c.SerialNumber),
+		NotBefore: c.NotBefore,
+		NotAfter:  c.NotAfter,
+		IsCA:      c.IsCA,
+		KeyType:   KeyDescription(c.PublicKey),
+		DNSNames:  c.DNSNames,
+		SHA256:    Fingerprint(c),
+	}
+	for _, ip := range c.IPAddresses {
+		r.IPAddresses = append(r.IPAddresses, ip.String())
+	}
+	return r
+}
+
+// Verify parses the files specified by input and checks that the key pairs match, the certificates are currently valid,
+// and the localhost certificate chains to the root and covers the hostnames.
+// Files that can't be read or parsed are reported as failed checks, except for the optional ca.pem, ca_key.pem, and chain.pem
+func Verify(input *VerifyInput) *Report {
+	r := new(Report)
+	now := input.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	hostnames := input.Hostnames
+	if len(hostnames) == 0 {
+		hostnames = []string{"localhost"}
+	}
+
+	// readFile returns nil without a check if name is optional and doesn't exist
+	readFile := func(name string, optional bool) []byte {
+		buf, err := os.ReadFile(filepath.Join(input.Dir, name))
+		if err != nil {
+			if !optional || !errors.Is(err, fs.ErrNotExist) {
+				r.AddCheck("parse "+name, err)
+			}
+			return nil
+		}
+		return buf
+	}
+
+	loadCert := func(name string, optional bool) *x509.Certificate {
+		buf := readFile(name, optional)
+		if buf == nil {
+			return nil
+		}
+		c, err := ParseCertificatePEM(buf)
+		r.AddCheck("parse "+name, err)
+		if err != nil {
+			return nil
+		}
+		r.Certificates = append(r.Certificates, certificateReport(name, c))
+		r.AddCheck(name+" validity", checkValidity(c, now))
+		return c
+	}
+
+	loadKey := func(name string, optional bool, c *x509.Certificate, certName string) {
+		buf := readFile(name, optional)
+		if buf == nil {
+			return
+		}
+		key, err := ParseEncryptedPrivateKeyPEM(buf, []byte(input.Passphrase))
+		r.AddCheck("parse "+name, err)
+		if err != nil || c == nil {
+			return
+		}
+		r.AddCheck(name+" matches "+certName, CheckKeyPair(c, key))
+	}
+
+	ca := loadCert("ca.pem", true)
+	loadKey("ca_key.pem", true, ca, "ca.pem")
+	if ca != nil {
+		if !ca.BasicConstraintsValid || !ca.IsCA {
+			r.AddCheck("ca.pem is a CA", errors.New("certificate is not a CA"))
+		} else {
+			r.AddCheck("ca.pem is a CA", nil)
+		}
+	}
+
+	lh := loadCert("localhost.pem", false)
+	loadKey("localhost_key.pem", false, lh, "localhost.pem")
+
+	// chain.pem is optional if ca.pem exists
+	var chain []*x509.Certificate
+	if buf := readFile("chain.pem", ca != nil); buf != nil {
+		var err error
+		chain, err = ParseCertificatesPEM(buf)
+		r.AddCheck("parse chain.pem", err)
+		for idx, c := range chain {
+			if (ca != nil && c.Equal(ca)) || (lh != nil && c.Equal(lh)) {
+				continue
+			}
+			r.Certificates = append(r.Certificates, certificateReport(fmt.Sprintf("chain.pem[%d]", idx), c))
+		}
+	}
+
+	// find the root, which is the last certificate in chain.pem, or ca.pem if chain.pem doesn't exist
+	root := ca
+	intermediates := x509.NewCertPool()
+	if len(chain) > 0 {
+		root = chain[len(chain)-1]
+		for _, c := range chain[:len(chain)-1] {
+			intermediates.AddCert(c)
+		}
+	}
+	if ca != nil && ca != root {
+		intermediates.AddCert(ca)
+	}
+
+	if lh != nil && root != nil {
+		roots := x509.NewCertPool()
+		roots.AddCert(root)
+		for _, host := range hostnames {
+			_, err := lh.Verify(x509.VerifyOptions{
+				DNSName:       host,
+				Roots:         roots,
+				Intermediates: intermediates,
+				CurrentTime:   now,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			})
+			r.AddCheck(fmt.Sprintf("localhost.pem chains to root and covers %q", host), err)
+		}
+	}
+
+	r.Root, r.CA = root, ca
+
+	return r
+}
+
+func checkValidity(c *x509.Certificate, now time.Time) error {
+	if now.Before(c.NotBefore) {
+		return fmt.Errorf("not valid until %s", c.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(c.NotAfter) {
+		return fmt.Errorf("expired at %s", c.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
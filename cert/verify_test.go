@@ -0,0 +1,140 @@
+package cert
+
+import (
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bundle returns the files for a CA and localhost key pair
+func bundle(t *testing.T) map[string][]byte {
+	t.Helper()
+
+	opts := DefaultOptions()
+	opts.KeyType = KeyTypeECDSAP256
+
+	ca, caKey, err := GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	lh, lhKey, err := GenerateLocalhost(ca, caKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate localhost: %v", err)
+	}
+
+	caKeyPEM, err := MarshalPrivateKeyPEM(caKey)
+	if err != nil {
+		t.Fatalf("could not marshal CA key: %v", err)
+	}
+	lhKeyPEM, err := MarshalPrivateKeyPEM(lhKey)
+	if err != nil {
+		t.Fatalf("could not marshal localhost key: %v", err)
+	}
+
+	return map[string][]byte{
+		"ca.pem":            pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}),
+		"ca_key.pem":        caKeyPEM,
+		"localhost.pem":     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: lh.Raw}),
+		"localhost_key.pem": lhKeyPEM,
+		"chain.pem":         ChainPEM(lh, ca),
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		// modify changes the bundle and input before they're inspected
+		modify func(t *testing.T, files map[string][]byte, input *VerifyInput)
+		// failed are the checks that should fail. All other checks should pass
+		failed []string
+	}{
+		{
+			name:   "valid bundle",
+			modify: func(t *testing.T, files map[string][]byte, input *VerifyInput) {},
+		},
+		{
+			name: "without CA files",
+			modify: func(t *testing.T, files map[string][]byte, input *VerifyInput) {
+				delete(files, "ca.pem")
+				delete(files, "ca_key.pem")
+			},
+		},
+		{
+			name: "without chain",
+			modify: func(t *testing.T, files map[string][]byte, input *VerifyInput) {
+				delete(files, "chain.pem")
+			},
+		},
+		{
+			name: "without CA files or chain",
+			modify: func(t *testing.T, files map[string][]byte, input *VerifyInput) {
+				delete(files, "ca.pem")
+				delete(files, "ca_key.pem")
+				delete(files, "chain.pem")
+			},
+			failed: []string{"parse chain.pem"},
+		},
+		{
+			name: "mismatched key",
+			modify: func(t *testing.T, files map[string][]byte, input *VerifyInput) {
+				files["localhost_key.pem"] = bundle(t)["localhost_key.pem"]
+			},
+			failed: []string{"localhost_key.pem matches localhost.pem"},
+		},
+		{
+			name: "expired certificate",
+			modify: func(t *testing.T, files map[string][]byte, input *VerifyInput) {
+				input.Now = time.Now().AddDate(2, 0, 0)
+			},
+			failed: []string{"localhost.pem validity", `localhost.pem chains to root and covers "localhost"`},
+		},
+		{
+			name: "wrong hostname",
+			modify: func(t *testing.T, files map[string][]byte, input *VerifyInput) {
+				input.Hostnames = []string{"localhost", "example.com"}
+			},
+			failed: []string{`localhost.pem chains to root and covers "example.com"`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := bundle(t)
+			input := &VerifyInput{Dir: dir}
+			test.modify(t, files, input)
+
+			for name, buf := range files {
+				if err := os.WriteFile(filepath.Join(dir, name), buf, 0600); err != nil {
+					t.Fatalf("could not write %s: %v", name, err)
+				}
+			}
+
+			r := Verify(input)
+
+			failed := make(map[string]bool)
+			for _, name := range test.failed {
+				failed[name] = true
+			}
+
+			for _, c := range r.Checks {
+				if c.OK == failed[c.Name] {
+					t.Errorf("check %q: want ok %t, got %t: %s", c.Name, !failed[c.Name], c.OK, c.Message)
+				}
+				delete(failed, c.Name)
+			}
+			for name := range failed {
+				t.Errorf("check %q: want failed, got not run", name)
+			}
+
+			if r.OK() != (len(test.failed) == 0) {
+				text := new(strings.Builder)
+				r.WriteText(text)
+				t.Errorf("want ok %t, got %t:\n%s", len(test.failed) == 0, r.OK(), text)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/profile"
+)
+
+// checkProfile adds checks to r that the profile at path can be parsed, and the checks from profile.Check
+func checkProfile(r *cert.Report, path string) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		r.AddCheck("parse profile", err)
+		return
+	}
+
+	prof, err := profile.Parse(buf)
+	r.AddCheck("parse profile", err)
+	if err != nil {
+		return
+	}
+
+	profile.Check(r, prof)
+}
+
+// inspectFiles validates and prints a report of existing certificates and profile
+func inspectFiles(args []string) {
+	fs := flag.NewFlagSet("gen-ls-cert inspect", flag.ExitOnError)
+	flInput := fs.String("in", ".", "Input directory containing localhost.pem, localhost_key.pem, and ca.pem, ca_key.pem, or chain.pem")
+	flProfile := fs.String("profile", "", "Path to a .mobileconfig to check against ca.pem (optional)")
+	flDNS := fs.String("dns", "localhost", "Comma separated hostnames the localhost certificate must be valid for")
+	flPass := fs.String("pass", "", "The passphrase for encrypted private keys")
+	flJSON := fs.Bool("json", false, "Output the report as JSON")
+	fs.Parse(args)
+
+	report := cert.Verify(&cert.VerifyInput{
+		Dir:        *flInput,
+		Hostnames:  splitList(*flDNS),
+		Passphrase: *flPass,
+	})
+	if *flProfile != "" {
+		checkProfile(report, *flProfile)
+	}
+
+	if *flJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(report); err != nil {
+			fmt.Println("could not encode report:", err)
+			os.Exit(-1)
+		}
+	} else if err := report.WriteText(os.Stdout); err != nil {
+		fmt.Println("could not write report:", err)
+		os.Exit(-1)
+	}
+
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
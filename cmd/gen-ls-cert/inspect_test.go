@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/groob/plist"
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/profile"
+)
+
+func TestCheckProfile(t *testing.T) {
+	opts := cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeECDSAP256
+
+	root, _, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+
+	prof, err := profile.New(&profile.Config{PayloadIdentifier: "com.example", PayloadUUID: "UUID"}, root)
+	if err != nil {
+		t.Fatalf("could not generate profile: %v", err)
+	}
+	buf, err := plist.Marshal(prof)
+	if err != nil {
+		t.Fatalf("could not marshal profile: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(dir, "profile.mobileconfig"), buf, 0600); err != nil {
+		t.Fatalf("could not write profile: %v", err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "invalid.mobileconfig"), []byte("invalid"), 0600); err != nil {
+		t.Fatalf("could not write profile: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		// results are the checks and whether they should pass
+		results map[string]bool
+	}{
+		// the profile checks are tested by profile.Check
+		{name: "profile.mobileconfig", results: map[string]bool{"parse profile": true, "profile root certificate matches CA": true}},
+		{name: "invalid.mobileconfig", results: map[string]bool{"parse profile": false}},
+		{name: "missing.mobileconfig", results: map[string]bool{"parse profile": false}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &cert.Report{Root: root, CA: root}
+			checkProfile(r, filepath.Join(dir, test.name))
+
+			if len(r.Checks) != len(test.results) {
+				t.Errorf("want %d checks, got %d", len(test.results), len(r.Checks))
+			}
+			for _, c := range r.Checks {
+				if ok, exists := test.results[c.Name]; !exists || ok != c.OK {
+					t.Errorf("check %q: want ok %t, got %t: %s", c.Name, ok, c.OK, c.Message)
+				}
+			}
+		})
+	}
+}
@@ -9,69 +9,299 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/groob/plist"
+	"github.com/korylprince/ls-relay-cert/cert"
 	"github.com/korylprince/ls-relay-cert/mdm"
 	"github.com/korylprince/ls-relay-cert/profile"
+	"github.com/korylprince/ls-relay-cert/signer"
 )
 
-func main() {
-	flVersion := flag.Int("version", 1, "The version used for the profile")
-	flIdentifier := flag.String("identifier", "com.github.korylprince.ls-relay-cert", "The top level profile identifier, and a prefix for the inner payload")
-	flUUID := flag.String("uuid", "randomly generated", "The UUID used for the profile")
-	flOrg := flag.String("org", "Lightspeed Systems", "The organization used for the profile")
-	flYears := flag.Int("years", 10, "The number of years to use for the CA")
-	flOutput := flag.String("out", ".", "Output directory")
-	flag.Parse()
+// generateIntermediate generates a new unconstrained CA signed by issuer, and returns a profile and payload for it like mdm.GeneratePKIFromCA
+func generateIntermediate(issuer *cert.Issuer, opts *cert.Options, config *profile.Config) (*profile.TopLevelProfile, *mdm.Payload, error) {
+	c, ck, err := cert.GenerateSubCA(issuer.Cert, issuer.Key, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not generate CA key pair: %w", err)
+	}
+	return mdm.GeneratePKIFromCA(issuer.SubIssuer(c, ck), opts, config)
+}
 
-	if *flUUID == "randomly generated" {
-		*flUUID = strings.ToUpper(uuid.NewString())
+// splitList splits a comma separated list, ignoring empty items
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// leafFlags are the flags used to customize the localhost certificate
+type leafFlags struct {
+	leafDays *int
+	dns      *string
+	ip       *string
+	keyType  *string
+}
+
+func addLeafFlags(fs *flag.FlagSet) *leafFlags {
+	return &leafFlags{
+		leafDays: fs.Int("leaf-days", 365, "The number of days to use for the localhost certificate"),
+		dns:      fs.String("dns", "localhost", "Comma separated DNS names for the localhost certificate"),
+		ip:       fs.String("ip", "", "Comma separated IP addresses for the localhost certificate, e.g. \"127.0.0.1,::1\""),
+		keyType:  fs.String("key-type", string(cert.DefaultKeyType), "The key type to use for generated keys: rsa2048, rsa3072, rsa4096, ecdsa-p256, ecdsa-p384, or ed25519"),
+	}
+}
+
+// apply sets the flag values on opts
+func (f *leafFlags) apply(opts *cert.Options) error {
+	opts.LeafDays = *f.leafDays
+	opts.DNSNames = splitList(*f.dns)
+
+	var err error
+	if opts.KeyType, err = cert.ParseKeyType(*f.keyType); err != nil {
+		return fmt.Errorf("could not parse key type: %w", err)
+	}
+
+	if opts.IPAddresses, err = cert.ParseIPs(splitList(*f.ip)); err != nil {
+		return fmt.Errorf("could not parse IP addresses: %w", err)
+	}
+
+	return nil
+}
+
+// caFlags are the flags used to specify an existing CA key pair
+type caFlags struct {
+	cert   *string
+	key    *string
+	pkcs12 *string
+	pass   *string
+	chain  *string
+
+	pkcs11Module   *string
+	pkcs11Token    *string
+	pkcs11PIN      *string
+	pkcs11KeyLabel *string
+	pkcs11KeyID    *string
+}
+
+func addCAFlags(fs *flag.FlagSet) *caFlags {
+	return &caFlags{
+		cert:   fs.String("ca-cert", "", "Path to an existing PEM encoded CA certificate"),
+		key:    fs.String("ca-key", "", "Path to an existing PEM encoded CA private key"),
+		pkcs12: fs.String("ca-p12", "", "Path to an existing PKCS #12 encoded CA key pair, instead of -ca-cert and -ca-key"),
+		pass:   fs.String("ca-pass", "", "The passphrase for -ca-key or -ca-p12"),
+		chain:  fs.String("ca-chain", "", "Path to the PEM encoded intermediate and root certificates that issued the existing CA"),
+
+		pkcs11Module:   fs.String("ca-pkcs11-module", "", "Path to a PKCS #11 module containing the CA private key, instead of -ca-key. Requires -ca-cert"),
+		pkcs11Token:    fs.String("ca-pkcs11-token", "", "The label of the PKCS #11 token containing the CA private key"),
+		pkcs11PIN:      fs.String("ca-pkcs11-pin", "", "The PKCS #11 token user PIN"),
+		pkcs11KeyLabel: fs.String("ca-pkcs11-key-label", "", "The label of the CA private key in the PKCS #11 token"),
+		pkcs11KeyID:    fs.String("ca-pkcs11-key-id", "", "The hex encoded ID of the CA private key in the PKCS #11 token"),
 	}
+}
 
-	prof, certs, err := mdm.GeneratePKI(*flYears, &profile.Config{
-		PayloadVersion:      *flVersion,
-		PayloadIdentifier:   *flIdentifier,
-		PayloadUUID:         *flUUID,
-		PayloadOrganization: *flOrg,
+// files returns the CAFiles specified by the flags. If a PKCS #11 module is specified, its session is left open until the process exits
+func (f *caFlags) files() (*cert.CAFiles, error) {
+	files := &cert.CAFiles{
+		CertFile:   *f.cert,
+		KeyFile:    *f.key,
+		PKCS12File: *f.pkcs12,
+		Passphrase: *f.pass,
+		ChainFile:  *f.chain,
+	}
+
+	if *f.pkcs11Module == "" {
+		return files, nil
+	}
+
+	key, _, err := signer.NewPKCS11(&signer.PKCS11Config{
+		Module:     *f.pkcs11Module,
+		TokenLabel: *f.pkcs11Token,
+		PIN:        *f.pkcs11PIN,
+		KeyLabel:   *f.pkcs11KeyLabel,
+		KeyID:      *f.pkcs11KeyID,
 	})
+	if err != nil {
+		return nil, fmt.Errorf("could not load PKCS #11 key: %w", err)
+	}
+	files.Signer = key
+
+	return files, nil
+}
 
+func generate(args []string) {
+	fs := flag.NewFlagSet("gen-ls-cert", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage of gen-ls-cert:")
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output(), "\nSubcommands:\n  renew\n    \tReissue localhost.pem and localhost_key.pem from an existing CA. Run \"gen-ls-cert renew -h\" for usage\n  inspect\n    \tValidate and print a report of existing certificates and profile. Run \"gen-ls-cert inspect -h\" for usage\n  verify\n    \tVerify the signature of a signed profile. Run \"gen-ls-cert verify -h\" for usage")
+	}
+	flVersion := fs.Int("version", 1, "The version used for the profile")
+	flIdentifier := fs.String("identifier", "com.github.korylprince.ls-relay-cert", "The top level profile identifier, and a prefix for the inner payload")
+	flUUID := fs.String("uuid", "randomly generated", "The UUID used for the profile")
+	flOrg := fs.String("org", "Lightspeed Systems", "The organization used for the profile")
+	flDisplayName := fs.String("display-name", profile.DefaultDisplayName, "The display name used for the profile")
+	flDescription := fs.String("description", profile.DefaultDescription, "The description used for the profile")
+	flScope := fs.String("scope", profile.DefaultScope, "The scope used for the profile: System or User")
+	flRemovalDisallowed := fs.Bool("removal-disallowed", false, "Prevent the user from removing the profile")
+	flRemovalPassword := fs.String("removal-password", "", "Require a password to remove the profile")
+	flExpireWithCA := fs.Bool("expire-with-ca", false, "Remove the profile from devices when the CA or an intermediate expires")
+	flRemoveAfter := fs.Duration("remove-after", 0, "Remove the profile from devices after the given duration, e.g. \"720h\"")
+	flFirefox := fs.Bool("firefox", false, "Add a Firefox policy payload so Firefox trusts the system roots, including the CA")
+	flFirefoxInstall := fs.String("firefox-install", "", "Comma separated certificate paths for the Firefox policy payload to install, e.g. \"/usr/local/etc/ca.pem\"")
+	flYears := fs.Int("years", 10, "The number of years to use for a generated CA")
+	flSubject := fs.String("ca-subject", "", "The subject for a generated CA, e.g. \"CN=Example CA,O=Example ISD,C=US\" (default Lightspeed Systems)")
+	flCA := addCAFlags(fs)
+	flSubCA := fs.Bool("sub-ca", false, "Generate a new CA signed by the existing CA instead of using the existing CA directly. The new CA can't issue other CAs, and is limited to the localhost certificate's names")
+	flDeliverCAKey := fs.Bool("deliver-ca-key", false, "Use the existing CA directly and write its private key to ca_key.pem for deployment, instead of -sub-ca. Any device it's installed on can issue certificates trusted by every device that trusts the CA")
+	flIntermediate := fs.Bool("intermediate", false, "With -sub-ca, generate an intermediate CA that can issue other CAs and names, e.g. to sign device CAs, instead of a device CA")
+	flLeaf := addLeafFlags(fs)
+	flFormat := addOutputFlags(fs)
+	flSign := addSignFlags(fs)
+	flOutput := fs.String("out", ".", "Output directory")
+	fs.Parse(args)
+
+	outputs, err := flFormat.load()
 	if err != nil {
-		fmt.Println("could not generate profile and certificates:", err)
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	opts := cert.DefaultOptions()
+	opts.CAYears = *flYears
+
+	if err := flLeaf.apply(opts); err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	if *flSubject != "" {
+		var err error
+		if opts.Subject, err = cert.ParseName(*flSubject); err != nil {
+			fmt.Println("could not parse CA subject:", err)
+			os.Exit(-1)
+		}
+	}
+
+	if *flUUID == "randomly generated" {
+		*flUUID = strings.ToUpper(uuid.NewString())
+	}
+
+	config := &profile.Config{
+		PayloadVersion:           *flVersion,
+		PayloadIdentifier:        *flIdentifier,
+		PayloadUUID:              *flUUID,
+		PayloadOrganization:      *flOrg,
+		PayloadDisplayName:       *flDisplayName,
+		PayloadDescription:       *flDescription,
+		PayloadScope:             *flScope,
+		PayloadRemovalDisallowed: *flRemovalDisallowed,
+		RemovalPassword:          *flRemovalPassword,
+		ExpireWithCA:             *flExpireWithCA,
+		DurationUntilRemoval:     *flRemoveAfter,
+		FirefoxEnterpriseRoots:   *flFirefox,
+		FirefoxCertificates:      splitList(*flFirefoxInstall),
+	}
+
+	if *flIntermediate && !*flSubCA {
+		fmt.Println("-intermediate requires -sub-ca")
+		os.Exit(-1)
+	}
+
+	if *flDeliverCAKey && *flSubCA {
+		fmt.Println("-deliver-ca-key can't be used with -sub-ca")
+		os.Exit(-1)
+	}
+
+	// a PKCS #11 key can't be exported to ca_key.pem
+	if *flCA.pkcs11Module != "" && !*flSubCA {
+		fmt.Println("-ca-pkcs11-module requires -sub-ca")
 		os.Exit(-1)
 	}
 
-	// marshal profile
-	buf, err := plist.MarshalIndent(prof, "\t")
+	caFiles, err := flCA.files()
 	if err != nil {
-		fmt.Println("could not marshal plist:", err)
+		fmt.Println(err)
 		os.Exit(-1)
 	}
 
-	// write profile
-	if err := os.WriteFile(filepath.Join(*flOutput, "Lightspeed Certificate.mobileconfig"), buf, 0644); err != nil {
-		fmt.Println("could not write profile:", err)
+	signCert, signKey, signChain, err := flSign.load()
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(-1)
 	}
 
-	// write ca cert
-	if err := os.WriteFile(filepath.Join(*flOutput, "ca.pem"), []byte(certs.CA), 0644); err != nil {
-		fmt.Println("could not write ca.pem:", err)
+	var (
+		prof  *profile.TopLevelProfile
+		certs *mdm.Payload
+	)
+	if !caFiles.Empty() {
+		var issuer *cert.Issuer
+		if issuer, err = cert.LoadCA(caFiles); err != nil {
+			fmt.Println("could not load CA:", err)
+			os.Exit(-1)
+		}
+		if *flIntermediate {
+			prof, certs, err = generateIntermediate(issuer, opts, config)
+		} else if *flSubCA {
+			prof, certs, err = mdm.GeneratePKIFromSubCA(issuer, opts, config)
+		} else if *flDeliverCAKey {
+			fmt.Println("Warning: ca_key.pem contains the existing CA's private key. Any device it's installed on can issue certificates trusted by every device that trusts the CA. Use -sub-ca to generate a CA for each device instead")
+			prof, certs, err = mdm.GeneratePKIFromCA(issuer, opts, config)
+		} else {
+			fmt.Println("an existing CA requires -sub-ca to generate a CA for each device, or -deliver-ca-key to write the existing CA's private key to ca_key.pem")
+			os.Exit(-1)
+		}
+	} else if *flSubCA {
+		fmt.Println("-sub-ca requires an existing CA")
+		os.Exit(-1)
+	} else if *flDeliverCAKey {
+		fmt.Println("-deliver-ca-key requires an existing CA")
 		os.Exit(-1)
+	} else {
+		prof, certs, err = mdm.GeneratePKI(opts, config)
 	}
 
-	// write ca key
-	if err := os.WriteFile(filepath.Join(*flOutput, "ca_key.pem"), []byte(certs.CAKey), 0600); err != nil {
-		fmt.Println("could not write ca_key.pem:", err)
+	if err != nil {
+		fmt.Println("could not generate profile and certificates:", err)
 		os.Exit(-1)
 	}
 
-	// write localhost cert
-	if err := os.WriteFile(filepath.Join(*flOutput, "localhost.pem"), []byte(certs.Localhost), 0644); err != nil {
-		fmt.Println("could not write localhost.pem:", err)
+	// marshal profile, signing it if an identity is given
+	var buf []byte
+	if signCert != nil {
+		if buf, err = profile.Sign(prof, signCert, signKey, signChain...); err != nil {
+			fmt.Println("could not sign profile:", err)
+			os.Exit(-1)
+		}
+	} else if buf, err = plist.MarshalIndent(prof, "\t"); err != nil {
+		fmt.Println("could not marshal plist:", err)
 		os.Exit(-1)
 	}
 
-	// write localhost key
-	if err := os.WriteFile(filepath.Join(*flOutput, "localhost_key.pem"), []byte(certs.LocalhostKey), 0600); err != nil {
-		fmt.Println("could not write localhost_key.pem:", err)
+	// write profile
+	if err := os.WriteFile(filepath.Join(*flOutput, "Lightspeed Certificate.mobileconfig"), buf, 0644); err != nil {
+		fmt.Println("could not write profile:", err)
 		os.Exit(-1)
 	}
+
+	writeOutputs(*flOutput, certs, outputs)
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "renew":
+			renew(os.Args[2:])
+			return
+		case "inspect":
+			inspectFiles(os.Args[2:])
+			return
+		case "verify":
+			verify(os.Args[2:])
+			return
+		}
+	}
+
+	generate(os.Args[1:])
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/mdm"
+)
+
+// Output formats
+const (
+	formatPEM     = "pem"
+	formatChain   = "chain"
+	formatDER     = "der"
+	formatPKCS12  = "p12"
+	formatONC     = "onc"
+	formatWindows = "windows"
+)
+
+// outputFlags are the flags used to select output formats
+type outputFlags struct {
+	formats     *string
+	p12Pass     *string
+	keyPass     *string
+	keyPassEnv  *string
+	keyPassFile *string
+}
+
+func addOutputFlags(fs *flag.FlagSet) *outputFlags {
+	return &outputFlags{
+		formats: fs.String("format", "pem,chain", "Comma separated output formats: pem (ca.pem, ca_key.pem, localhost.pem, localhost_key.pem), chain (chain.pem), der (ca.cer, the root certificate), p12 (ca.p12, localhost.p12), onc (ca.onc, for ChromeOS), windows (install.ps1, ca.pfx, localhost.pfx)"),
+		p12Pass: fs.String("p12-pass", "", "The password for PKCS #12 output. Required for windows output, and for p12 output unless a -key-pass* passphrase is given"),
+
+		keyPass:     fs.String("key-pass", "", "If set, PEM private keys are written as encrypted PKCS #8 with this passphrase. Not allowed with windows output, since install.ps1 contains unencrypted keys"),
+		keyPassEnv:  fs.String("key-pass-env", "", "The name of an environment variable containing the passphrase, instead of -key-pass"),
+		keyPassFile: fs.String("key-pass-file", "", "The path to a file containing the passphrase, instead of -key-pass"),
+	}
+}
+
+// keyPassphrase returns the passphrase for PEM private keys, or nil if keys shouldn't be encrypted
+func (f *outputFlags) keyPassphrase() ([]byte, error) {
+	set := 0
+	for _, v := range []string{*f.keyPass, *f.keyPassEnv, *f.keyPassFile} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, errors.New("only one of -key-pass, -key-pass-env, and -key-pass-file may be given")
+	}
+
+	switch {
+	case *f.keyPass != "":
+		return []byte(*f.keyPass), nil
+	case *f.keyPassEnv != "":
+		pass, ok := os.LookupEnv(*f.keyPassEnv)
+		if !ok || pass == "" {
+			return nil, fmt.Errorf("environment variable %s is empty", *f.keyPassEnv)
+		}
+		return []byte(pass), nil
+	case *f.keyPassFile != "":
+		buf, err := os.ReadFile(*f.keyPassFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read passphrase file: %w", err)
+		}
+		pass := bytes.TrimRight(buf, "\r\n")
+		if len(pass) == 0 {
+			return nil, errors.New("passphrase file is empty")
+		}
+		return pass, nil
+	}
+
+	return nil, nil
+}
+
+// parse returns the set of selected formats
+func (f *outputFlags) parse() (map[string]bool, error) {
+	formats := make(map[string]bool)
+	for _, format := range splitList(*f.formats) {
+		switch format {
+		case formatPEM, formatChain, formatDER, formatPKCS12, formatONC, formatWindows:
+			formats[format] = true
+		default:
+			return nil, fmt.Errorf("unknown format: %q", format)
+		}
+	}
+	return formats, nil
+}
+
+// outputOptions are the parsed output flags
+type outputOptions struct {
+	formats map[string]bool
+	// keyPass is the passphrase for PEM private keys, or nil if keys shouldn't be encrypted
+	keyPass []byte
+	p12Pass string
+}
+
+// load parses and validates the output flags
+func (f *outputFlags) load() (*outputOptions, error) {
+	formats, err := f.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	pass, err := f.keyPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	// install.ps1 writes the PEM private keys unencrypted, which would undo -key-pass*
+	if pass != nil && formats[formatWindows] {
+		return nil, errors.New("windows output contains unencrypted private keys and can't be used with -key-pass, -key-pass-env, or -key-pass-file")
+	}
+
+	// PKCS #12 outputs always contain the localhost private key, so they must be password protected
+	p12Pass := *f.p12Pass
+	if p12Pass == "" {
+		p12Pass = string(pass)
+	}
+	if p12Pass == "" && (formats[formatPKCS12] || formats[formatWindows]) {
+		return nil, errors.New("p12 and windows output contain private keys and require -p12-pass or -key-pass, -key-pass-env, or -key-pass-file")
+	}
+
+	return &outputOptions{formats: formats, keyPass: pass, p12Pass: p12Pass}, nil
+}
+
+// writeFile writes data to name in dir, exiting on error
+func writeFile(dir, name string, data []byte, perm os.FileMode) {
+	if err := os.WriteFile(filepath.Join(dir, name), data, perm); err != nil {
+		fmt.Printf("could not write %s: %v\n", name, err)
+		os.Exit(-1)
+	}
+}
+
+// writeOutputs writes certs to dir in the selected formats. If certs.CA is empty, only localhost outputs are written
+func writeOutputs(dir string, certs *mdm.Payload, opts *outputOptions) {
+	formats, pass := opts.formats, opts.keyPass
+
+	if formats[formatPEM] {
+		if certs.CA != "" {
+			writeFile(dir, "ca.pem", []byte(certs.CA), 0644)
+			writeFile(dir, "ca_key.pem", encryptKey("ca_key.pem", certs.CAKey, pass), 0600)
+		}
+		writeFile(dir, "localhost.pem", []byte(certs.Localhost), 0644)
+		writeFile(dir, "localhost_key.pem", encryptKey("localhost_key.pem", certs.LocalhostKey, pass), 0600)
+	}
+
+	if formats[formatChain] {
+		writeFile(dir, "chain.pem", []byte(certs.Chain), 0644)
+	}
+
+	if formats[formatONC] {
+		buf, err := mdm.ONC(certs)
+		if err != nil {
+			fmt.Println("could not generate ONC:", err)
+			os.Exit(-1)
+		}
+		writeFile(dir, "ca.onc", buf, 0644)
+	}
+
+	if formats[formatWindows] {
+		buf, err := mdm.WindowsInstallScript(certs)
+		if err != nil {
+			fmt.Println("could not generate install script:", err)
+			os.Exit(-1)
+		}
+		writeFile(dir, "install.ps1", buf, 0600)
+	}
+
+	if !formats[formatDER] && !formats[formatPKCS12] && !formats[formatWindows] {
+		return
+	}
+
+	// chain is ordered from the localhost certificate to the root
+	chain, err := cert.ParseCertificatesPEM([]byte(certs.Chain))
+	if err != nil {
+		fmt.Println("could not parse chain:", err)
+		os.Exit(-1)
+	}
+
+	// the CA outputs need the CA certificate after the localhost certificate
+	minLen := 1
+	if certs.CA != "" {
+		minLen = 2
+	}
+	if len(chain) < minLen {
+		fmt.Printf("chain has %d certificates, want at least %d\n", len(chain), minLen)
+		os.Exit(-1)
+	}
+
+	if formats[formatDER] {
+		writeFile(dir, "ca.cer", chain[len(chain)-1].Raw, 0644)
+	}
+
+	if formats[formatPKCS12] {
+		if certs.CA != "" {
+			writePKCS12(dir, "ca.p12", certs.CAKey, chain[1], chain[2:], opts.p12Pass)
+		}
+		writePKCS12(dir, "localhost.p12", certs.LocalhostKey, chain[0], chain[1:], opts.p12Pass)
+	}
+
+	if formats[formatWindows] {
+		if certs.CA != "" {
+			writePKCS12(dir, "ca.pfx", certs.CAKey, chain[1], chain[2:], opts.p12Pass)
+		}
+		writePKCS12(dir, "localhost.pfx", certs.LocalhostKey, chain[0], chain[1:], opts.p12Pass)
+	}
+}
+
+// encryptKey returns the PEM encoded key encrypted with pass, or the key unchanged if pass is nil
+func encryptKey(name, keyPEM string, pass []byte) []byte {
+	if pass == nil {
+		return []byte(keyPEM)
+	}
+
+	key, err := cert.ParsePrivateKeyPEM([]byte(keyPEM))
+	if err != nil {
+		fmt.Printf("could not parse key for %s: %v\n", name, err)
+		os.Exit(-1)
+	}
+
+	buf, err := cert.MarshalEncryptedPrivateKeyPEM(key, pass)
+	if err != nil {
+		fmt.Printf("could not encrypt %s: %v\n", name, err)
+		os.Exit(-1)
+	}
+
+	return buf
+}
+
+// writePKCS12 writes the PEM encoded key, cert, and caCerts to name in dir as a PKCS #12 file
+func writePKCS12(dir, name, keyPEM string, c *x509.Certificate, caCerts []*x509.Certificate, password string) {
+	key, err := cert.ParsePrivateKeyPEM([]byte(keyPEM))
+	if err != nil {
+		fmt.Printf("could not parse key for %s: %v\n", name, err)
+		os.Exit(-1)
+	}
+
+	buf, err := cert.EncodePKCS12(nil, key, c, caCerts, password)
+	if err != nil {
+		fmt.Printf("could not encode %s: %v\n", name, err)
+		os.Exit(-1)
+	}
+
+	writeFile(dir, name, buf, 0600)
+}
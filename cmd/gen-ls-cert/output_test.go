@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/mdm"
+	"github.com/korylprince/ls-relay-cert/profile"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// readFile returns the contents of name in dir
+func readFile(t *testing.T, dir, name string) []byte {
+	t.Helper()
+	buf, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatalf("could not read %s: %v", name, err)
+	}
+	return buf
+}
+
+// checkPKCS12 decodes the PKCS #12 file name in dir and checks it contains the key pair for c and caCerts
+func checkPKCS12(t *testing.T, dir, name string, c *x509.Certificate, caCerts []*x509.Certificate) {
+	t.Helper()
+
+	key, got, gotCACerts, err := pkcs12.DecodeChain(readFile(t, dir, name), "secret")
+	if err != nil {
+		t.Fatalf("could not decode %s: %v", name, err)
+	}
+	if !got.Equal(c) {
+		t.Errorf("%s: want certificate %s, got %s", name, c.Subject, got.Subject)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		t.Fatalf("%s: unsupported private key type: %T", name, key)
+	}
+	if err = cert.CheckKeyPair(got, signer); err != nil {
+		t.Errorf("%s: %v", name, err)
+	}
+
+	if len(gotCACerts) != len(caCerts) {
+		t.Fatalf("%s: want %d CA certificates, got %d", name, len(caCerts), len(gotCACerts))
+	}
+	for idx, c := range caCerts {
+		if !gotCACerts[idx].Equal(c) {
+			t.Errorf("%s: CA certificate %d: want %s, got %s", name, idx, c.Subject, gotCACerts[idx].Subject)
+		}
+	}
+}
+
+func TestWriteOutputs(t *testing.T) {
+	opts := cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeECDSAP256
+	config := &profile.Config{PayloadIdentifier: "com.example", PayloadUUID: "UUID"}
+
+	root, rootKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	issuer := &cert.Issuer{Cert: root, Key: rootKey}
+
+	_, rootPayload, err := mdm.GeneratePKIFromCA(issuer, opts, config)
+	if err != nil {
+		t.Fatalf("could not generate PKI: %v", err)
+	}
+	_, subPayload, err := mdm.GeneratePKIFromSubCA(issuer, opts, config)
+	if err != nil {
+		t.Fatalf("could not generate PKI from sub-CA: %v", err)
+	}
+	leafPayload, err := mdm.GenerateLeaf(issuer, opts)
+	if err != nil {
+		t.Fatalf("could not generate leaf: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		payload *mdm.Payload
+		// files are the files that should be written
+		files []string
+	}{
+		{name: "root CA", payload: rootPayload, files: []string{"ca.pem", "ca_key.pem", "localhost.pem", "localhost_key.pem", "chain.pem", "ca.cer", "ca.p12", "localhost.p12", "ca.pfx", "localhost.pfx", "install.ps1"}},
+		{name: "sub-CA", payload: subPayload, files: []string{"ca.pem", "ca_key.pem", "localhost.pem", "localhost_key.pem", "chain.pem", "ca.cer", "ca.p12", "localhost.p12", "ca.pfx", "localhost.pfx", "install.ps1"}},
+		{name: "leaf only", payload: leafPayload, files: []string{"localhost.pem", "localhost_key.pem", "chain.pem", "ca.cer", "localhost.p12", "localhost.pfx", "install.ps1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeOutputs(dir, test.payload, &outputOptions{
+				formats: map[string]bool{formatPEM: true, formatChain: true, formatDER: true, formatPKCS12: true, formatWindows: true},
+				p12Pass: "secret",
+			})
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("could not read output directory: %v", err)
+			}
+			if len(entries) != len(test.files) {
+				t.Errorf("want %d files, got %d", len(test.files), len(entries))
+			}
+
+			chain, err := cert.ParseCertificatesPEM(readFile(t, dir, "chain.pem"))
+			if err != nil {
+				t.Fatalf("could not parse chain.pem: %v", err)
+			}
+			if len(chain) < 2 || !chain[len(chain)-1].Equal(root) {
+				t.Fatalf("want chain ending in root, got %d certificates", len(chain))
+			}
+
+			lh, lhKey, err := cert.LoadKeyPair(filepath.Join(dir, "localhost.pem"), filepath.Join(dir, "localhost_key.pem"), nil)
+			if err != nil {
+				t.Fatalf("could not load localhost key pair: %v", err)
+			}
+			if err = cert.CheckKeyPair(lh, lhKey); err != nil {
+				t.Errorf("localhost key pair: %v", err)
+			}
+			if !lh.Equal(chain[0]) {
+				t.Error("want localhost.pem first in chain.pem")
+			}
+
+			der, err := x509.ParseCertificate(readFile(t, dir, "ca.cer"))
+			if err != nil {
+				t.Fatalf("could not parse ca.cer: %v", err)
+			}
+			if !der.Equal(root) {
+				t.Errorf("want ca.cer to be the root, got %s", der.Subject)
+			}
+
+			checkPKCS12(t, dir, "localhost.p12", chain[0], chain[1:])
+			checkPKCS12(t, dir, "localhost.pfx", chain[0], chain[1:])
+
+			if test.payload.CA == "" {
+				return
+			}
+
+			ca, caKey, err := cert.LoadKeyPair(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca_key.pem"), nil)
+			if err != nil {
+				t.Fatalf("could not load CA key pair: %v", err)
+			}
+			if err = cert.CheckKeyPair(ca, caKey); err != nil {
+				t.Errorf("CA key pair: %v", err)
+			}
+			if !ca.Equal(chain[1]) {
+				t.Error("want ca.pem second in chain.pem")
+			}
+
+			checkPKCS12(t, dir, "ca.p12", chain[1], chain[2:])
+			checkPKCS12(t, dir, "ca.pfx", chain[1], chain[2:])
+		})
+	}
+}
+
+func TestOutputFlags(t *testing.T) {
+	dir := t.TempDir()
+	passFile := filepath.Join(dir, "pass")
+	if err := os.WriteFile(passFile, []byte("file-secret\n"), 0600); err != nil {
+		t.Fatalf("could not write passphrase file: %v", err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyFile, []byte("\n"), 0600); err != nil {
+		t.Fatalf("could not write passphrase file: %v", err)
+	}
+	t.Setenv("TEST_KEY_PASS", "env-secret")
+
+	tests := []struct {
+		args    []string
+		keyPass string
+		p12Pass string
+		err     bool
+	}{
+		{args: []string{}},
+		{args: []string{"-key-pass", "secret"}, keyPass: "secret", p12Pass: "secret"},
+		{args: []string{"-key-pass-env", "TEST_KEY_PASS"}, keyPass: "env-secret", p12Pass: "env-secret"},
+		{args: []string{"-key-pass-file", passFile}, keyPass: "file-secret", p12Pass: "file-secret"},
+		{args: []string{"-key-pass-env", "TEST_KEY_PASS_UNSET"}, err: true},
+		{args: []string{"-key-pass-file", emptyFile}, err: true},
+		{args: []string{"-key-pass-file", filepath.Join(dir, "missing")}, err: true},
+		{args: []string{"-key-pass", "secret", "-key-pass-env", "TEST_KEY_PASS"}, err: true},
+		{args: []string{"-format", "p12", "-key-pass", "secret"}, keyPass: "secret", p12Pass: "secret"},
+		{args: []string{"-format", "p12", "-key-pass", "secret", "-p12-pass", "other"}, keyPass: "secret", p12Pass: "other"},
+		{args: []string{"-format", "p12"}, err: true},
+		{args: []string{"-format", "windows", "-p12-pass", "other"}, p12Pass: "other"},
+		{args: []string{"-format", "windows", "-p12-pass", "other", "-key-pass", "secret"}, err: true},
+		{args: []string{"-format", "windows", "-p12-pass", "other", "-key-pass-file", passFile}, err: true},
+		{args: []string{"-format", "pem,unknown"}, err: true},
+	}
+
+	for _, test := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		f := addOutputFlags(fs)
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatalf("%v: could not parse flags: %v", test.args, err)
+		}
+
+		opts, err := f.load()
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: want error, got nil", test.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.args, err)
+			continue
+		}
+		if string(opts.keyPass) != test.keyPass {
+			t.Errorf("%v: want key passphrase %q, got %q", test.args, test.keyPass, opts.keyPass)
+		}
+		if opts.p12Pass != test.p12Pass {
+			t.Errorf("%v: want PKCS #12 password %q, got %q", test.args, test.p12Pass, opts.p12Pass)
+		}
+	}
+}
+
+func TestWriteOutputsEncryptedKeys(t *testing.T) {
+	opts := cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeECDSAP256
+
+	_, payload, err := mdm.GeneratePKI(opts, &profile.Config{PayloadIdentifier: "com.example", PayloadUUID: "UUID"})
+	if err != nil {
+		t.Fatalf("could not generate PKI: %v", err)
+	}
+
+	dir := t.TempDir()
+	writeOutputs(dir, payload, &outputOptions{formats: map[string]bool{formatPEM: true}, keyPass: []byte("secret")})
+
+	for _, name := range []string{"ca", "localhost"} {
+		certPath, keyPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"_key.pem")
+		if _, _, err = cert.LoadKeyPair(certPath, keyPath, nil); err == nil {
+			t.Errorf("%s: want error without passphrase, got nil", name)
+		}
+		if _, _, err = cert.LoadKeyPair(certPath, keyPath, []byte("wrong")); err == nil {
+			t.Errorf("%s: want error with wrong passphrase, got nil", name)
+		}
+
+		c, key, err := cert.LoadKeyPair(certPath, keyPath, []byte("secret"))
+		if err != nil {
+			t.Fatalf("%s: could not load key pair: %v", name, err)
+		}
+		if err = cert.CheckKeyPair(c, key); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/mdm"
+)
+
+// renew reissues the localhost key pair and chain from an existing CA key pair
+func renew(args []string) {
+	fs := flag.NewFlagSet("gen-ls-cert renew", flag.ExitOnError)
+	flInput := fs.String("in", ".", "Input directory containing ca.pem, ca_key.pem, and optionally chain.pem, if -ca-cert and -ca-key or -ca-p12 aren't given")
+	flCA := addCAFlags(fs)
+	flLeaf := addLeafFlags(fs)
+	flFormat := addOutputFlags(fs)
+	flOutput := fs.String("out", "", "Output directory (default the input directory)")
+	fs.Parse(args)
+
+	outputs, err := flFormat.load()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	if *flOutput == "" {
+		*flOutput = *flInput
+	}
+
+	opts := cert.DefaultOptions()
+	if err := flLeaf.apply(opts); err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	caFiles, err := flCA.files()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	if caFiles.Empty() {
+		caFiles.CertFile = filepath.Join(*flInput, "ca.pem")
+		caFiles.KeyFile = filepath.Join(*flInput, "ca_key.pem")
+
+		// ca.pem only contains the CA, so the chain for a sub CA is loaded from chain.pem
+		if chain := filepath.Join(*flInput, "chain.pem"); caFiles.ChainFile == "" {
+			if _, err = os.Stat(chain); err == nil {
+				caFiles.ChainFile = chain
+			}
+		}
+	}
+
+	issuer, err := cert.LoadCA(caFiles)
+	if err != nil {
+		fmt.Println("could not load CA:", err)
+		os.Exit(-1)
+	}
+
+	certs, err := mdm.GenerateLeaf(issuer, opts)
+	if err != nil {
+		fmt.Println("could not generate certificates:", err)
+		os.Exit(-1)
+	}
+
+	writeOutputs(*flOutput, certs, outputs)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/profile"
+)
+
+// signFlags are the flags used to specify the identity used to sign the profile
+type signFlags struct {
+	identity *string
+	cert     *string
+	key      *string
+	pass     *string
+}
+
+func addSignFlags(fs *flag.FlagSet) *signFlags {
+	return &signFlags{
+		identity: fs.String("sign-identity", "", "Path to a PKCS #12 encoded identity, e.g. Developer ID, used to sign the profile. Included CA certificates are added to the signature"),
+		cert:     fs.String("sign-cert", "", "Path to a PEM encoded certificate used to sign the profile, instead of -sign-identity. Additional certificates in the file are added to the signature"),
+		key:      fs.String("sign-key", "", "Path to the PEM encoded private key for -sign-cert"),
+		pass:     fs.String("sign-pass", "", "The password for -sign-identity or -sign-key"),
+	}
+}
+
+// load returns the signing key pair and chain specified by the flags. If no identity is specified, a nil certificate is returned
+func (f *signFlags) load() (*x509.Certificate, crypto.Signer, []*x509.Certificate, error) {
+	switch {
+	case *f.identity != "" && (*f.cert != "" || *f.key != ""):
+		return nil, nil, nil, errors.New("-sign-identity and -sign-cert/-sign-key are mutually exclusive")
+	case *f.identity != "":
+		c, key, chain, err := cert.LoadPKCS12(*f.identity, *f.pass)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("could not load signing identity: %w", err)
+		}
+		return c, key, chain, nil
+	case *f.cert != "" && *f.key != "":
+		c, key, err := cert.LoadKeyPair(*f.cert, *f.key, []byte(*f.pass))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("could not load signing key pair: %w", err)
+		}
+		buf, err := os.ReadFile(*f.cert)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("could not read signing certificate: %w", err)
+		}
+		chain, err := cert.ParseCertificatesPEM(buf)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("could not parse signing certificate: %w", err)
+		}
+		return c, key, chain[1:], nil
+	case *f.cert != "" || *f.key != "":
+		return nil, nil, nil, errors.New("-sign-cert and -sign-key must be used together")
+	}
+
+	return nil, nil, nil, nil
+}
+
+// verify verifies the signature of an existing signed profile
+func verify(args []string) {
+	fs := flag.NewFlagSet("gen-ls-cert verify", flag.ExitOnError)
+	flProfile := fs.String("profile", "Lightspeed Certificate.mobileconfig", "Path to the signed profile")
+	flRoots := fs.String("roots", "", "Path to PEM encoded root certificates the signer must chain to (default the system roots)")
+	flNoChain := fs.Bool("no-chain", false, "Only verify the signature, not that the signer chains to a trusted root")
+	fs.Parse(args)
+
+	buf, err := os.ReadFile(*flProfile)
+	if err != nil {
+		fmt.Println("could not read profile:", err)
+		os.Exit(-1)
+	}
+
+	var roots *x509.CertPool
+	switch {
+	case *flNoChain:
+	case *flRoots != "":
+		rootsBuf, err := os.ReadFile(*flRoots)
+		if err != nil {
+			fmt.Println("could not read roots:", err)
+			os.Exit(-1)
+		}
+		certs, err := cert.ParseCertificatesPEM(rootsBuf)
+		if err != nil {
+			fmt.Println("could not parse roots:", err)
+			os.Exit(-1)
+		}
+		roots = x509.NewCertPool()
+		for _, c := range certs {
+			roots.AddCert(c)
+		}
+	default:
+		if roots, err = x509.SystemCertPool(); err != nil {
+			fmt.Println("could not load system roots:", err)
+			os.Exit(-1)
+		}
+	}
+
+	signer, err := profile.Verify(buf, roots)
+	if signer != nil {
+		fmt.Println("Signer:     ", signer.Subject)
+		fmt.Println("Issuer:     ", signer.Issuer)
+		fmt.Println("Not After:  ", signer.NotAfter.Format(time.RFC3339))
+		fmt.Println("SHA-256:    ", cert.Fingerprint(signer))
+	}
+	if err != nil {
+		fmt.Println("[FAIL]", err)
+		os.Exit(1)
+	}
+
+	if roots == nil {
+		fmt.Println("[OK  ] signature verified (chain not checked)")
+		return
+	}
+	fmt.Println("[OK  ] signature and chain verified")
+}
@@ -3,18 +3,62 @@ package main
 import "time"
 
 type Config struct {
-	MDMPrefix           string        `required:"true"`
-	MDMToken            string        `required:"true"`
-	SigningIdentity     string        `required:"true"`
-	CacheSize           int           `default:"1024"`
-	CacheTTL            time.Duration `default:"5m"`
-	CachePrefix         string        `required:"true"`
-	PayloadVersion      int           `default:"1"`
-	PayloadIdentifier   string        `default:"com.github.korylprince.ls-relay-cert"`
-	PayloadUUID         string        `required:"true"`
-	PayloadOrganization string        `required:"true"`
-	ProxyHeaders        bool          `default:"false"`
-	DeliverRate         int           `default:"2"`  // deliver requests per minute
-	FileRate            int           `default:"10"` // file requests per minute
-	ListenAddr          string        `default:":80"`
+	MDMPrefix            string        `required:"true"`
+	MDMToken             string        `required:"true"`
+	MDMBackend           string        `default:"micromdm"` // micromdm, nanomdm, or jamf. For jamf, MDMToken is the OAuth client secret
+	MDMClientID          string        // OAuth client ID, required for jamf
+	JamfCleanupAge       time.Duration `default:"24h"` // for jamf, pkgs containing private keys and their policies are deleted once the policy completes, or after this long if it hasn't run
+	AckTimeout           time.Duration // if set, deliveries wait for each command to be acknowledged by the webhook and are rolled back on failure. Requires WebhookToken
+	SigningIdentity      string        `required:"true"`
+	CacheSize            int           `default:"1024"`
+	CacheTTL             time.Duration `default:"5m"`
+	CachePrefix          string        `required:"true"`
+	KeyType              string        `default:"rsa4096"` // rsa2048, rsa3072, rsa4096, ecdsa-p256, ecdsa-p384, or ed25519
+	CASubject            string        // e.g. "CN=Example CA,O=Example ISD,C=US". If empty, the Lightspeed Systems subject is used
+	CAYears              int           `default:"10"`
+	LeafDays             int           `default:"365"`
+	LeafDNSNames         []string      `default:"localhost"`
+	LeafIPAddresses      []string
+	CACertFile           string // optional PEM CA certificate. If set, it's delivered instead of a newly generated CA
+	CAKeyFile            string // optional PEM CA private key, used if CAKeySource is file
+	CAKeySource          string `default:"file"` // file or pkcs11
+	PKCS11Module         string // path to the PKCS #11 module, used if CAKeySource is pkcs11
+	PKCS11TokenLabel     string
+	PKCS11PIN            string
+	PKCS11KeyLabel       string
+	PKCS11KeyID          string        // hex encoded
+	CAPKCS12File         string        // optional PKCS #12 CA key pair, instead of CACertFile and CAKeyFile
+	CAPassphrase         string        // optional passphrase for CAKeyFile or CAPKCS12File
+	CAChainFile          string        // optional PEM intermediate and root certificates that issued the CA
+	IssueDeviceCA        bool          `default:"false"` // if true, a new per-device CA signed by the configured CA is delivered. This is the default if neither SharedCA nor DeliverCAKey is set. The device CA is limited to the localhost names, but any device can issue certificates for them trusted by every device. Leaf-only deliveries aren't supported, since device CA keys aren't kept
+	DeliverCAKey         bool          `default:"false"` // if true, the configured CA and its private key are delivered to every device instead of a per-device CA. Any device can then issue certificates trusted by every device
+	SharedCA             bool          `default:"false"` // if true, the configured CA's profile is identical for all devices and the CA key isn't delivered. The profile is sent again with every full delivery; leaf-only deliveries only send the localhost key pair
+	RegistryFile         string        // optional JSON file used to record the serial numbers of issued certificates until they expire or are replaced by a later delivery. If empty, records are lost on restart
+	EncryptProfiles      bool          `default:"false"` // if true, profiles are encrypted to the device's MDM identity certificate. Requires the nanomdm backend and NANOMDMSTORAGEDIR, and the server won't start without them
+	NanoMDMStorageDir    string        // optional path of nanomdm's file storage (-storage file), used to read device identity certificates from <dir>/<UDID>/identity_cert.pem. Other nanomdm storage backends aren't supported, and the directory must be readable on this host
+	CRLURL               string        // optional public URL of /v1/lsrelay/crl, added to certificates issued by the configured CA. Requires a CA, and can't be used with DeliverCAKey
+	CRLDays              int           `default:"7"`
+	DeviceFile           string        // optional JSON file used to record device serial numbers and UDIDs from the nanomdm webhook and the devices API. If empty, devices are lost on restart
+	WebhookToken         string        // password for the /v1/lsrelay/webhook basic auth, required for nanomdm. If empty, the webhook is disabled
+	AdminToken           string        // bearer token required for the revoke, certificates, status, and devices APIs. If empty, they're disabled. Requests to the jobs API with it aren't rate limited
+	PayloadVersion       int           `default:"1"`
+	PayloadIdentifier    string        `default:"com.github.korylprince.ls-relay-cert"`
+	PayloadUUID          string        `required:"true"`
+	PayloadOrganization  string        `required:"true"`
+	PayloadDisplayName   string        // if empty, "Lightspeed Relay Smart Agent" is used
+	PayloadDescription   string        // if empty, "Root Certificate for Lightspeed Relay Smart Agent" is used
+	PayloadScope         string        `default:"System"` // System or User
+	RemovalDisallowed    bool          `default:"false"`  // if true, the user can't remove the profile
+	RemovalPassword      string        // optional password required to remove the profile
+	ExpireWithCA         bool          `default:"false"` // if true, profiles are removed from devices when the CA or an intermediate expires
+	DurationUntilRemoval time.Duration // if set, profiles are removed from devices this long after they're installed, e.g. "720h". If ExpireWithCA is also set, whichever is earlier is used
+	FirefoxRoots         bool          `default:"false"` // if true, the profile configures Firefox to trust the system roots, including the CA. FirefoxCertificates are paths of certificates Firefox installs, e.g. /usr/local/etc/ca.pem
+	FirefoxCertificates  []string
+	ProxyHeaders         bool   `default:"false"`
+	DeliverRate          int    `default:"2"`  // deliver requests per minute
+	DeliverWorkers       int    `default:"2"`  // concurrent deliveries
+	DeliverQueueSize     int    `default:"64"` // queued deliveries before deliver requests are rejected with 503
+	FileRate             int    `default:"10"` // file requests per minute
+	JobRate              int    `default:"60"` // job requests per minute
+	ListenAddr           string `default:":80"`
 }
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/korylprince/ls-relay-cert/mdm"
 )
 
@@ -15,37 +16,14 @@ type HTTPService struct {
 	*mdm.MDM
 }
 
-// DeliverHandler delivers the payload to the serial number specified in the request
-func (s *HTTPService) DeliverHandler() http.Handler {
+// jsonHandler returns a handler that writes the status code and JSON body returned by fn. fn can set response headers on w.
+// If body is an error or nil, a generic response with the status code is written and the error is logged.
+// If the error is a publicError, its message is written as the description instead
+func jsonHandler(fn func(w http.ResponseWriter, r *http.Request, l *Log) (int, interface{})) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		l := r.Context().Value(ContextKeyLog).(*Log)
 
-		code, body := func(w http.ResponseWriter, r *http.Request) (int, interface{}) {
-			type request struct {
-				SerialNumber string `json:"serial_number"`
-			}
-
-			req := new(request)
-			dec := json.NewDecoder(r.Body)
-			if err := dec.Decode(req); err != nil {
-				return http.StatusBadRequest, fmt.Errorf("could not parse request: %w", err)
-			}
-
-			if req.SerialNumber == "" {
-				return http.StatusBadRequest, errors.New("empty serial_number")
-			}
-
-			l.SerialNumber = req.SerialNumber
-
-			if err := s.Deliver(req.SerialNumber); err != nil {
-				if errors.Is(err, mdm.ErrNotFound) {
-					return http.StatusNotFound, err
-				}
-				return http.StatusInternalServerError, fmt.Errorf("could not deliver payload: %w", err)
-			}
-
-			return http.StatusOK, nil
-		}(w, r)
+		code, body := fn(w, r, l)
 
 		type response struct {
 			Code        int    `json:"code"`
@@ -54,10 +32,14 @@ func (s *HTTPService) DeliverHandler() http.Handler {
 
 		if err, ok := body.(error); ok || body == nil {
 			resp := response{Code: code, Description: http.StatusText(code)}
-			body = resp
 			if ok {
 				l.Error = err.Error()
+				var perr *publicError
+				if errors.As(err, &perr) {
+					resp.Description = perr.Error()
+				}
 			}
+			body = resp
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -72,6 +54,195 @@ func (s *HTTPService) DeliverHandler() http.Handler {
 	})
 }
 
+// publicError is an error whose message is safe to return to the client, e.g. to explain how to fix the request
+type publicError struct {
+	err error
+}
+
+func (e *publicError) Error() string {
+	return e.err.Error()
+}
+
+func (e *publicError) Unwrap() error {
+	return e.err
+}
+
+// retryAfter is the Retry-After header value, in seconds, returned when the delivery queue is full
+const retryAfter = "60"
+
+// DeliverHandler queues a delivery of the payload to the serial number specified in the request and returns the redacted job.
+// If the request mode is "leaf", only a new localhost key pair is delivered. Leaf mode requires SharedCA or DeliverCAKey, so it can't be used in either default configuration:
+// it's rejected with 501 Not Implemented without a CA, and with 400 Bad Request with IssueDeviceCA, since device CA keys aren't kept. The response explains the limitation.
+// The job's progress is returned by JobHandler.
+// If the device already has a queued or running job, it's returned with 409 Conflict
+func (s *HTTPService) DeliverHandler() http.Handler {
+	return jsonHandler(func(w http.ResponseWriter, r *http.Request, l *Log) (int, interface{}) {
+		type request struct {
+			SerialNumber string `json:"serial_number"`
+			Mode         string `json:"mode"`
+		}
+
+		req := new(request)
+		dec := json.NewDecoder(r.Body)
+		if err := dec.Decode(req); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("could not parse request: %w", err)
+		}
+
+		if req.SerialNumber == "" {
+			return http.StatusBadRequest, errors.New("empty serial_number")
+		}
+
+		l.SerialNumber = req.SerialNumber
+
+		switch req.Mode {
+		case "", mdm.ModeFull:
+			req.Mode = mdm.ModeFull
+		case mdm.ModeLeaf:
+			// leaf-only delivery depends on the server's configuration, not the request
+			if err := s.CanDeliverLeaf(); err != nil {
+				err = &publicError{fmt.Errorf("%w: leaf-only renewal requires a CA with SHAREDCA or DELIVERCAKEY, use mode %q to deliver a new CA and profile instead", err, mdm.ModeFull)}
+				if errors.Is(err, mdm.ErrLeafDeviceCA) {
+					return http.StatusBadRequest, err
+				}
+				return http.StatusNotImplemented, err
+			}
+		default:
+			return http.StatusBadRequest, fmt.Errorf("unknown mode: %q", req.Mode)
+		}
+
+		// the device is looked up before queueing the job, so unknown devices are rejected immediately
+		udid, err := s.SerialToUDID(req.SerialNumber)
+		if err != nil {
+			if errors.Is(err, mdm.ErrNotFound) {
+				return http.StatusNotFound, err
+			}
+			return http.StatusInternalServerError, fmt.Errorf("could not get UDID: %w", err)
+		}
+
+		job, err := s.Submit(req.SerialNumber, udid, req.Mode)
+		switch {
+		case errors.Is(err, mdm.ErrJobExists):
+			// the device's active job is returned instead of starting a concurrent delivery
+			l.JobID = job.ID
+			l.Error = err.Error()
+			w.Header().Set("Location", "/v1/lsrelay/jobs/"+job.ID)
+			return http.StatusConflict, job.Redacted()
+		case errors.Is(err, mdm.ErrQueueFull):
+			w.Header().Set("Retry-After", retryAfter)
+			return http.StatusServiceUnavailable, err
+		case err != nil:
+			return http.StatusInternalServerError, fmt.Errorf("could not queue delivery: %w", err)
+		}
+
+		l.JobID = job.ID
+		w.Header().Set("Location", "/v1/lsrelay/jobs/"+job.ID)
+
+		return http.StatusAccepted, job.Redacted()
+	})
+}
+
+// JobHandler returns the delivery job with the ID in the request path. If redact is true, the job is returned without the fields that identify the device
+func (s *HTTPService) JobHandler(redact bool) http.Handler {
+	return jsonHandler(func(w http.ResponseWriter, r *http.Request, l *Log) (int, interface{}) {
+		id := mux.Vars(r)["id"]
+		l.JobID = id
+
+		job, err := s.Job(id)
+		if err != nil {
+			if errors.Is(err, mdm.ErrJobNotFound) {
+				return http.StatusNotFound, err
+			}
+			return http.StatusInternalServerError, fmt.Errorf("could not get job: %w", err)
+		}
+
+		l.SerialNumber = job.SerialNumber
+
+		if redact {
+			return http.StatusOK, job.Redacted()
+		}
+		return http.StatusOK, job
+	})
+}
+
+// RevokeHandler revokes all certificates issued to the serial number specified in the request and returns them
+func (s *HTTPService) RevokeHandler() http.Handler {
+	return jsonHandler(func(w http.ResponseWriter, r *http.Request, l *Log) (int, interface{}) {
+		type request struct {
+			SerialNumber string `json:"serial_number"`
+		}
+
+		type response struct {
+			Certificates []mdm.Record `json:"certificates"`
+		}
+
+		req := new(request)
+		dec := json.NewDecoder(r.Body)
+		if err := dec.Decode(req); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("could not parse request: %w", err)
+		}
+
+		if req.SerialNumber == "" {
+			return http.StatusBadRequest, errors.New("empty serial_number")
+		}
+
+		l.SerialNumber = req.SerialNumber
+
+		records, err := s.Revoke(req.SerialNumber)
+		if err != nil {
+			if errors.Is(err, mdm.ErrNotFound) {
+				return http.StatusNotFound, err
+			}
+			return http.StatusInternalServerError, fmt.Errorf("could not revoke certificates: %w", err)
+		}
+
+		return http.StatusOK, &response{Certificates: records}
+	})
+}
+
+// CertificatesHandler returns the certificates issued to the serial number in the request path
+func (s *HTTPService) CertificatesHandler() http.Handler {
+	return jsonHandler(func(w http.ResponseWriter, r *http.Request, l *Log) (int, interface{}) {
+		type response struct {
+			Certificates []mdm.Record `json:"certificates"`
+		}
+
+		serial := mux.Vars(r)["serial"]
+		l.SerialNumber = serial
+
+		records := s.Records(serial)
+		if len(records) == 0 {
+			return http.StatusNotFound, mdm.ErrNotFound
+		}
+
+		return http.StatusOK, &response{Certificates: records}
+	})
+}
+
+// CRLHandler serves the DER encoded CRL signed by the configured CA
+func (s *HTTPService) CRLHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := r.Context().Value(ContextKeyLog).(*Log)
+
+		crl, err := s.CRL()
+		if err != nil {
+			l.Error = err.Error()
+
+			if errors.Is(err, mdm.ErrNoCA) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("404 Not Found"))
+				return
+			}
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("500 Internal Server Error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		http.ServeContent(w, r, "ca.crl", time.Time{}, bytes.NewReader(crl))
+	})
+}
+
 // FileStoreHandler is a file handler. If the handler is not mounted at "/", then it should be wrapped in http.StripPrefix so the handler sees the request rooted at /
 func (s *HTTPService) FileStoreHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -104,3 +275,77 @@ func (s *HTTPService) FileStoreHandler() http.Handler {
 		http.ServeContent(w, r, "payload.pkg", time.Now(), bytes.NewReader(file))
 	})
 }
+
+// WebhookHandler handles MDM webhook events, updating the status of delivered commands from acknowledge events.
+// If devices is not nil, the serial numbers and UDIDs of enrolling devices are recorded in it
+func (s *HTTPService) WebhookHandler(devices *mdm.DeviceDirectory) http.Handler {
+	return jsonHandler(func(w http.ResponseWriter, r *http.Request, l *Log) (int, interface{}) {
+		event := new(mdm.WebhookEvent)
+		dec := json.NewDecoder(r.Body)
+		if err := dec.Decode(event); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("could not parse event: %w", err)
+		}
+
+		if devices != nil {
+			if err := devices.HandleWebhook(event); err != nil {
+				return http.StatusInternalServerError, fmt.Errorf("could not handle %s event: %w", event.Topic, err)
+			}
+		}
+
+		if err := s.HandleWebhook(event); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("could not handle %s event: %w", event.Topic, err)
+		}
+
+		return http.StatusOK, nil
+	})
+}
+
+// DevicesHandler records the serial numbers and UDIDs in the request in devices, so devices that enrolled before the webhook was set up can be delivered to
+func (s *HTTPService) DevicesHandler(devices *mdm.DeviceDirectory) http.Handler {
+	return jsonHandler(func(w http.ResponseWriter, r *http.Request, l *Log) (int, interface{}) {
+		type request struct {
+			// Devices maps serial numbers to UDIDs
+			Devices map[string]string `json:"devices"`
+		}
+
+		req := new(request)
+		dec := json.NewDecoder(r.Body)
+		if err := dec.Decode(req); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("could not parse request: %w", err)
+		}
+
+		if len(req.Devices) == 0 {
+			return http.StatusBadRequest, errors.New("empty devices")
+		}
+
+		for serial, udid := range req.Devices {
+			if serial == "" || udid == "" {
+				return http.StatusBadRequest, errors.New("empty serial number or UDID")
+			}
+		}
+
+		if err := devices.SetDevices(req.Devices); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("could not record devices: %w", err)
+		}
+
+		return http.StatusOK, nil
+	})
+}
+
+// StatusHandler returns the status of the latest delivery to the serial number in the request path
+func (s *HTTPService) StatusHandler() http.Handler {
+	return jsonHandler(func(w http.ResponseWriter, r *http.Request, l *Log) (int, interface{}) {
+		serial := mux.Vars(r)["serial"]
+		l.SerialNumber = serial
+
+		delivery, err := s.Delivery(serial)
+		if err != nil {
+			if errors.Is(err, mdm.ErrNotFound) {
+				return http.StatusNotFound, err
+			}
+			return http.StatusInternalServerError, fmt.Errorf("could not get delivery: %w", err)
+		}
+
+		return http.StatusOK, delivery
+	})
+}
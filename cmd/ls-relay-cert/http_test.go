@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	macospkg "github.com/korylprince/go-macos-pkg"
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/mdm"
+	"github.com/korylprince/ls-relay-cert/profile"
+)
+
+// testBackend is an mdm.Backend for devices with serial numbers starting with SERIAL, whose UDID is the serial number.
+// If devices is not nil, devices are looked up in it instead
+type testBackend struct {
+	devices mdm.DeviceLookup
+}
+
+func (b testBackend) LookupDevice(serial string) (string, error) {
+	if b.devices != nil {
+		return b.devices.LookupDevice(serial)
+	}
+	if !strings.HasPrefix(serial, "SERIAL") {
+		return "", mdm.ErrNotFound
+	}
+	return serial, nil
+}
+
+func (b testBackend) InstallProfile(udid string, profile []byte) (string, error) {
+	return "PROFILE", nil
+}
+
+func (b testBackend) InstallEnterpriseApplication(udid string, manifest *macospkg.Manifest) (string, error) {
+	return "PKG", nil
+}
+
+// discard is an io.WriteCloser that discards logs
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
+
+func (discard) Close() error { return nil }
+
+// testServer returns a server for config that runs one job at a time and queues one job. jobDone is called after each job finishes.
+// If devices is not nil, devices are looked up in it
+func testServer(t *testing.T, config *Config, devices *mdm.DeviceDirectory, jobDone func(job *mdm.Job)) *httptest.Server {
+	t.Helper()
+
+	opts := cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeRSA2048
+	c, key, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate identity: %v", err)
+	}
+	buf, err := cert.EncodePKCS12(nil, key, c, nil, "")
+	if err != nil {
+		t.Fatalf("could not encode identity: %v", err)
+	}
+	identity := filepath.Join(t.TempDir(), "identity.p12")
+	if err = os.WriteFile(identity, buf, 0600); err != nil {
+		t.Fatalf("could not write identity: %v", err)
+	}
+
+	backend := testBackend{}
+	if devices != nil {
+		backend.devices = devices
+	}
+
+	opts = cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeEd25519
+	m, err := mdm.New(&mdm.Config{
+		SigningIdentity: identity,
+		CacheSize:       10,
+		CacheTTL:        time.Minute,
+		CertOptions:     opts,
+		Backend:         backend,
+		Workers:         1,
+		QueueSize:       1,
+		JobDone:         jobDone,
+		Config:          &profile.Config{PayloadIdentifier: "com.example", PayloadUUID: "UUID", PayloadOrganization: "Example"},
+	})
+	if err != nil {
+		t.Fatalf("could not create mdm: %v", err)
+	}
+
+	srv := httptest.NewServer(LogHandler(NewLogger(discard{}), newRouter(config, &HTTPService{MDM: m}, devices)))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDeliverHandler(t *testing.T) {
+	// the worker is blocked after the first job finishes, so later jobs stay queued
+	finished := make(chan *mdm.Job, 1)
+	release := make(chan struct{})
+	defer close(release)
+	srv := testServer(t, &Config{DeliverRate: 10, JobRate: 4, AdminToken: "admin"}, nil, func(job *mdm.Job) {
+		finished <- job
+		<-release
+	})
+
+	deliver := func(serial string) (*http.Response, *mdm.Job) {
+		t.Helper()
+		res, err := http.Post(srv.URL+"/v1/lsrelay/deliver", "application/json", strings.NewReader(`{"serial_number": "`+serial+`"}`))
+		if err != nil {
+			t.Fatalf("could not deliver: %v", err)
+		}
+		defer res.Body.Close()
+		job := new(mdm.Job)
+		if err = json.NewDecoder(res.Body).Decode(job); err != nil {
+			t.Fatalf("could not parse response: %v", err)
+		}
+		return res, job
+	}
+
+	getJob := func(location, token string) (*http.Response, *mdm.Job) {
+		t.Helper()
+		r, err := http.NewRequest("GET", srv.URL+location, nil)
+		if err != nil {
+			t.Fatalf("could not create request: %v", err)
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("could not get job: %v", err)
+		}
+		defer res.Body.Close()
+		job := new(mdm.Job)
+		if err = json.NewDecoder(res.Body).Decode(job); err != nil {
+			t.Fatalf("could not parse response: %v", err)
+		}
+		return res, job
+	}
+
+	res, first := deliver("SERIAL1")
+	if res.StatusCode != http.StatusAccepted || first.ID == "" || first.SerialNumber != "" || first.Mode != mdm.ModeFull {
+		t.Fatalf("want 202 with redacted job, got %d: %+v", res.StatusCode, first)
+	}
+	location := res.Header.Get("Location")
+	if location != "/v1/lsrelay/jobs/"+first.ID {
+		t.Errorf("want Location of job, got %q", location)
+	}
+
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for job")
+	}
+
+	res, second := deliver("SERIAL2")
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("want 202, got %d", res.StatusCode)
+	}
+
+	// a device only has one active job
+	res, job := deliver("SERIAL2")
+	if res.StatusCode != http.StatusConflict || job.ID != second.ID || res.Header.Get("Location") != "/v1/lsrelay/jobs/"+second.ID {
+		t.Errorf("want 409 with active job %s, got %d: %+v", second.ID, res.StatusCode, job)
+	}
+
+	res, _ = deliver("SERIAL3")
+	if res.StatusCode != http.StatusServiceUnavailable || res.Header.Get("Retry-After") != retryAfter {
+		t.Errorf("want 503 with Retry-After, got %d, %q", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+
+	if res, _ = deliver("OTHER"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("want 404 for unknown device, got %d", res.StatusCode)
+	}
+
+	// the job fails if xar isn't installed to build its pkg
+	res, job = getJob(location, "admin")
+	if res.StatusCode != http.StatusOK || job.ID != first.ID || job.SerialNumber != "SERIAL1" || job.Error == "" || job.FinishedAt == nil {
+		t.Errorf("want 200 with finished job, got %d: %+v", res.StatusCode, job)
+	}
+
+	if res, _ = getJob("/v1/lsrelay/jobs/"+second.ID, "admin"); res.StatusCode != http.StatusOK {
+		t.Errorf("want 200, got %d", res.StatusCode)
+	}
+	if res, _ = getJob("/v1/lsrelay/jobs/unknown", "admin"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("want 404 for unknown job, got %d", res.StatusCode)
+	}
+
+	// the jobs API doesn't require a token, and an invalid token is ignored, but the job is redacted
+	if res, job = getJob(location, ""); res.StatusCode != http.StatusOK || job.ID != first.ID || job.SerialNumber != "" || job.Error != "" || job.FinishedAt == nil {
+		t.Errorf("want 200 with redacted job, got %d: %+v", res.StatusCode, job)
+	}
+	if res, _ = getJob(location, "invalid"); res.StatusCode != http.StatusOK {
+		t.Errorf("want 200 for invalid token, got %d", res.StatusCode)
+	}
+	if res, _ = getJob("/v1/lsrelay/jobs/unknown", ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("want 404 for unknown job, got %d", res.StatusCode)
+	}
+	if res, _ = getJob("/v1/lsrelay/jobs/"+second.ID, ""); res.StatusCode != http.StatusOK {
+		t.Errorf("want 200, got %d", res.StatusCode)
+	}
+
+	// JobRate requests are allowed each minute for all jobs together, unless they have the admin token
+	if res, _ = getJob(location, ""); res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("want 429, got %d", res.StatusCode)
+	}
+	if res, _ = getJob(location, "admin"); res.StatusCode != http.StatusOK {
+		t.Errorf("want 200 for admin token, got %d", res.StatusCode)
+	}
+}
+
+func TestDeliverHandlerLeaf(t *testing.T) {
+	srv := testServer(t, &Config{DeliverRate: 10, JobRate: 10}, nil, nil)
+
+	res, err := http.Post(srv.URL+"/v1/lsrelay/deliver", "application/json", strings.NewReader(`{"serial_number": "SERIAL1", "mode": "leaf"}`))
+	if err != nil {
+		t.Fatalf("could not deliver: %v", err)
+	}
+	defer res.Body.Close()
+
+	// leaf-only renewal isn't supported without a CA, and the response explains why
+	body := new(struct {
+		Description string `json:"description"`
+	})
+	if err = json.NewDecoder(res.Body).Decode(body); err != nil {
+		t.Fatalf("could not parse response: %v", err)
+	}
+	if res.StatusCode != http.StatusNotImplemented || !strings.Contains(body.Description, "SHAREDCA or DELIVERCAKEY") {
+		t.Errorf("want 501 with explanation, got %d: %q", res.StatusCode, body.Description)
+	}
+}
+
+func TestJobHandlerWithoutAdminToken(t *testing.T) {
+	finished := make(chan *mdm.Job, 1)
+	srv := testServer(t, &Config{DeliverRate: 10, JobRate: 10}, nil, func(job *mdm.Job) { finished <- job })
+
+	res, err := http.Post(srv.URL+"/v1/lsrelay/deliver", "application/json", strings.NewReader(`{"serial_number": "SERIAL1"}`))
+	if err != nil {
+		t.Fatalf("could not deliver: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("want 202, got %d", res.StatusCode)
+	}
+
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for job")
+	}
+
+	// the Location of a job is available without AdminToken, but the job is redacted
+	res, err = http.Get(srv.URL + res.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("could not get job: %v", err)
+	}
+	defer res.Body.Close()
+	job := new(mdm.Job)
+	if err = json.NewDecoder(res.Body).Decode(job); err != nil {
+		t.Fatalf("could not parse response: %v", err)
+	}
+	if res.StatusCode != http.StatusOK || job.SerialNumber != "" || job.Error != "" || job.FinishedAt == nil {
+		t.Errorf("want 200 with redacted finished job, got %d: %+v", res.StatusCode, job)
+	}
+}
+
+func TestDevicesHandler(t *testing.T) {
+	devices, err := mdm.NewDeviceDirectory("")
+	if err != nil {
+		t.Fatalf("could not create device directory: %v", err)
+	}
+	finished := make(chan *mdm.Job, 1)
+	srv := testServer(t, &Config{DeliverRate: 10, JobRate: 10, AdminToken: "admin"}, devices, func(job *mdm.Job) { finished <- job })
+
+	post := func(path, token, body string) int {
+		t.Helper()
+		r, err := http.NewRequest("POST", srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("could not create request: %v", err)
+		}
+		r.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("could not complete request: %v", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// devices that enrolled before the webhook was set up aren't in the directory
+	if code := post("/v1/lsrelay/deliver", "", `{"serial_number": "SERIAL1"}`); code != http.StatusNotFound {
+		t.Errorf("want 404 for unknown device, got %d", code)
+	}
+
+	for _, test := range []struct {
+		token string
+		body  string
+		code  int
+	}{
+		{token: "", body: `{"devices": {"SERIAL1": "UDID1"}}`, code: http.StatusUnauthorized},
+		{token: "invalid", body: `{"devices": {"SERIAL1": "UDID1"}}`, code: http.StatusUnauthorized},
+		{token: "admin", body: `invalid`, code: http.StatusBadRequest},
+		{token: "admin", body: `{"devices": {}}`, code: http.StatusBadRequest},
+		{token: "admin", body: `{"devices": {"SERIAL1": ""}}`, code: http.StatusBadRequest},
+		{token: "admin", body: `{"devices": {"SERIAL1": "UDID1", "SERIAL2": "UDID2"}}`, code: http.StatusOK},
+	} {
+		if code := post("/v1/lsrelay/devices", test.token, test.body); code != test.code {
+			t.Errorf("%s with token %q: want %d, got %d", test.body, test.token, test.code, code)
+		}
+	}
+
+	if udid, err := devices.LookupDevice("SERIAL2"); err != nil || udid != "UDID2" {
+		t.Errorf("want UDID2, got %q, %v", udid, err)
+	}
+
+	if code := post("/v1/lsrelay/deliver", "", `{"serial_number": "SERIAL1"}`); code != http.StatusAccepted {
+		t.Fatalf("want 202 for seeded device, got %d", code)
+	}
+
+	select {
+	case job := <-finished:
+		if job.SerialNumber != "SERIAL1" {
+			t.Errorf("want job for SERIAL1, got %q", job.SerialNumber)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for job")
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/korylprince/ls-relay-cert/mdm"
 )
 
 type contextKey int
@@ -26,6 +28,7 @@ type Log struct {
 	Status       int       `json:"status"`
 	Size         int       `json:"size"`
 	SerialNumber string    `json:"serial_number,omitempty"`
+	JobID        string    `json:"job_id,omitempty"`
 	Error        string    `json:"error,omitempty"`
 }
 
@@ -91,3 +94,21 @@ func LogHandler(logger *Logger, next http.Handler) http.Handler {
 		logger.Write(l)
 	})
 }
+
+// JobLog returns a log entry for the finished delivery job
+func JobLog(job *mdm.Job) *Log {
+	l := &Log{
+		Level:        "info",
+		Time:         *job.FinishedAt,
+		URL:          "/v1/lsrelay/jobs/" + job.ID,
+		Status:       200,
+		SerialNumber: job.SerialNumber,
+		JobID:        job.ID,
+		Error:        job.Error,
+	}
+	if job.Status == mdm.JobFailed {
+		l.Level = "error"
+		l.Status = 500
+	}
+	return l
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/didip/tollbooth"
@@ -12,8 +14,10 @@ import (
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/korylprince/ls-relay-cert/cert"
 	"github.com/korylprince/ls-relay-cert/mdm"
 	"github.com/korylprince/ls-relay-cert/profile"
+	"github.com/korylprince/ls-relay-cert/signer"
 )
 
 // LimitHandler is a middleware that performs rate-limiting given http.Handler struct.
@@ -49,6 +53,102 @@ func LimitHandler(lmt *limiter.Limiter, next http.Handler) http.Handler {
 	return http.HandlerFunc(middle)
 }
 
+// RouteLimitHandler is like LimitHandler, but requests are limited as if their path were route.
+// Rate limits are kept for each path, so this limits requests to a route with path parameters together
+func RouteLimitHandler(lmt *limiter.Limiter, route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limited := r.Clone(r.Context())
+		limited.URL.Path = route
+		LimitHandler(lmt, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			next.ServeHTTP(w, r)
+		})).ServeHTTP(w, limited)
+	})
+}
+
+// authorized returns true if r has an "Authorization: Bearer <token>" header with the given token, or basic auth with the token as the password
+func authorized(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") && subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1 {
+		return true
+	}
+	if _, pass, ok := r.BasicAuth(); ok && subtle.ConstantTimeCompare([]byte(pass), []byte(token)) == 1 {
+		return true
+	}
+	return false
+}
+
+// BypassHandler is a middleware that serves requests authorized with the given token with bypass, and all other requests with next,
+// e.g. so that rate limits don't apply to admins
+func BypassHandler(token string, bypass, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorized(r, token) {
+			bypass.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AuthHandler is a middleware that requires an "Authorization: Bearer <token>" header with the given token,
+// or basic auth with the token as the password, e.g. for webhooks configured with credentials in the URL
+func AuthHandler(token string, next http.Handler) http.Handler {
+	type response struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	}
+
+	middle := func(w http.ResponseWriter, r *http.Request) {
+		if authorized(r, token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body := response{Code: http.StatusUnauthorized, Description: http.StatusText(http.StatusUnauthorized)}
+		l := r.Context().Value(ContextKeyLog).(*Log)
+		l.Error = "invalid token"
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+
+		e := json.NewEncoder(w)
+		if err := e.Encode(body); err != nil {
+			l.Error = err.Error()
+		}
+	}
+
+	return http.HandlerFunc(middle)
+}
+
+func certOptions(config *Config) (*cert.Options, error) {
+	opts := cert.DefaultOptions()
+
+	keyType, err := cert.ParseKeyType(config.KeyType)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse key type: %w", err)
+	}
+	opts.KeyType = keyType
+
+	if config.CASubject != "" {
+		if opts.Subject, err = cert.ParseName(config.CASubject); err != nil {
+			return nil, fmt.Errorf("could not parse CA subject: %w", err)
+		}
+	}
+
+	if opts.IPAddresses, err = cert.ParseIPs(config.LeafIPAddresses); err != nil {
+		return nil, fmt.Errorf("could not parse leaf IP addresses: %w", err)
+	}
+
+	opts.DNSNames = config.LeafDNSNames
+	opts.CAYears = config.CAYears
+	opts.LeafDays = config.LeafDays
+	opts.CRLDays = config.CRLDays
+	if config.CRLURL != "" {
+		opts.CRLDistributionPoints = []string{config.CRLURL}
+	}
+
+	return opts, nil
+}
+
 func RunServer() error {
 	config := new(Config)
 	err := envconfig.Process("", config)
@@ -56,6 +156,13 @@ func RunServer() error {
 		return fmt.Errorf("could not process configuration from environment: %w", err)
 	}
 
+	certOptions, err := certOptions(config)
+	if err != nil {
+		return fmt.Errorf("could not parse certificate options: %w", err)
+	}
+
+	logger := NewLogger(os.Stdout)
+
 	mdmConfig := &mdm.Config{
 		MDMPrefix:       config.MDMPrefix,
 		MDMToken:        config.MDMToken,
@@ -63,21 +170,135 @@ func RunServer() error {
 		CacheSize:       config.CacheSize,
 		CacheTTL:        config.CacheTTL,
 		CachePrefix:     config.CachePrefix,
+		CertOptions:     certOptions,
+		IssueDeviceCA:   config.IssueDeviceCA,
+		DeliverCAKey:    config.DeliverCAKey,
+		SharedCA:        config.SharedCA,
+		RegistryFile:    config.RegistryFile,
+		AckTimeout:      config.AckTimeout,
+		Workers:         config.DeliverWorkers,
+		QueueSize:       config.DeliverQueueSize,
+		JobDone:         func(job *mdm.Job) { logger.Write(JobLog(job)) },
 		Config: &profile.Config{
-			PayloadVersion:      config.PayloadVersion,
-			PayloadIdentifier:   config.PayloadIdentifier,
-			PayloadUUID:         config.PayloadUUID,
-			PayloadOrganization: config.PayloadOrganization,
+			PayloadVersion:           config.PayloadVersion,
+			PayloadIdentifier:        config.PayloadIdentifier,
+			PayloadUUID:              config.PayloadUUID,
+			PayloadOrganization:      config.PayloadOrganization,
+			PayloadDisplayName:       config.PayloadDisplayName,
+			PayloadDescription:       config.PayloadDescription,
+			PayloadScope:             config.PayloadScope,
+			PayloadRemovalDisallowed: config.RemovalDisallowed,
+			RemovalPassword:          config.RemovalPassword,
+			ExpireWithCA:             config.ExpireWithCA,
+			DurationUntilRemoval:     config.DurationUntilRemoval,
+			FirefoxEnterpriseRoots:   config.FirefoxRoots,
+			FirefoxCertificates:      config.FirefoxCertificates,
 		},
 	}
 
+	if config.AckTimeout > 0 && (config.WebhookToken == "" || config.MDMBackend == mdm.BackendJamf) {
+		return fmt.Errorf("ACKTIMEOUT requires WEBHOOKTOKEN and a %s or %s backend", mdm.BackendMicroMDM, mdm.BackendNanoMDM)
+	}
+
+	var (
+		devices *mdm.DeviceDirectory
+		lookup  mdm.DeviceLookup
+	)
+	if config.MDMBackend == mdm.BackendNanoMDM {
+		if config.WebhookToken == "" {
+			return fmt.Errorf("WEBHOOKTOKEN is required for %s", config.MDMBackend)
+		}
+		if devices, err = mdm.NewDeviceDirectory(config.DeviceFile); err != nil {
+			return fmt.Errorf("could not load device directory: %w", err)
+		}
+		lookup = devices
+	}
+
+	mdmConfig.Backend, err = mdm.NewBackend(&mdm.BackendConfig{
+		Type:       config.MDMBackend,
+		Prefix:     config.MDMPrefix,
+		Token:      config.MDMToken,
+		ClientID:   config.MDMClientID,
+		Devices:    lookup,
+		StorageDir: config.NanoMDMStorageDir,
+	})
+	if err != nil {
+		return fmt.Errorf("could not create mdm backend: %w", err)
+	}
+
+	if jamf, ok := mdmConfig.Backend.(*mdm.Jamf); ok {
+		go cleanupJamf(jamf, config.JamfCleanupAge)
+	}
+
+	// the backend is checked by mdm.New, since only nanomdm with NANOMDMSTORAGEDIR can return device certificates
+	mdmConfig.EncryptProfiles = config.EncryptProfiles
+
+	caFiles := &cert.CAFiles{
+		CertFile:   config.CACertFile,
+		PKCS12File: config.CAPKCS12File,
+		Passphrase: config.CAPassphrase,
+		ChainFile:  config.CAChainFile,
+	}
+
+	if config.CAKeyFile != "" || config.CAKeySource == signer.TypePKCS11 {
+		key, closer, err := signer.New(&signer.Config{
+			Type:       config.CAKeySource,
+			KeyFile:    config.CAKeyFile,
+			Passphrase: config.CAPassphrase,
+			PKCS11: &signer.PKCS11Config{
+				Module:     config.PKCS11Module,
+				TokenLabel: config.PKCS11TokenLabel,
+				PIN:        config.PKCS11PIN,
+				KeyLabel:   config.PKCS11KeyLabel,
+				KeyID:      config.PKCS11KeyID,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("could not load CA key: %w", err)
+		}
+		defer closer.Close()
+		caFiles.Signer = key
+	}
+
+	if !caFiles.Empty() {
+		if mdmConfig.CA, err = cert.LoadCA(caFiles); err != nil {
+			return fmt.Errorf("could not load CA: %w", err)
+		}
+	}
+
 	mdm, err := mdm.New(mdmConfig)
 	if err != nil {
 		return fmt.Errorf("could not create mdm: %w", err)
 	}
 
-	h := &HTTPService{MDM: mdm}
+	if config.DeliverCAKey {
+		fmt.Println("Warning: DELIVERCAKEY is set, so the CA private key is delivered to every device. Any device can issue certificates trusted by every device")
+	}
+
+	handler := LogHandler(logger, newRouter(config, &HTTPService{MDM: mdm}, devices))
+	if config.ProxyHeaders {
+		handler = handlers.ProxyHeaders(handler)
+	}
 
+	fmt.Println("Listening on:", config.ListenAddr)
+
+	return http.ListenAndServe(config.ListenAddr, handler)
+}
+
+// jamfCleanupInterval is how often delivered Jamf Pro packages are cleaned up
+const jamfCleanupInterval = 5 * time.Minute
+
+// cleanupJamf periodically deletes the packages and policies of deliveries that have completed or are older than maxAge
+func cleanupJamf(jamf *mdm.Jamf, maxAge time.Duration) {
+	for range time.Tick(jamfCleanupInterval) {
+		if err := jamf.Cleanup(time.Now(), maxAge); err != nil {
+			fmt.Println("Error: could not clean up jamf packages:", err)
+		}
+	}
+}
+
+// newRouter returns a router with the API routes for h. If devices is not nil, the webhook records enrolling devices in it, and the devices API seeds it
+func newRouter(config *Config, h *HTTPService, devices *mdm.DeviceDirectory) *mux.Router {
 	r := mux.NewRouter()
 
 	lmt := limiter.New(&limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour}).
@@ -97,19 +318,53 @@ func RunServer() error {
 			LimitHandler(lmt,
 				h.FileStoreHandler())))
 
-	logger := NewLogger(os.Stdout)
+	r.Methods("HEAD", "GET").Path("/v1/lsrelay/crl").Handler(h.CRLHandler())
 
-	handler := LogHandler(logger, r)
-	if config.ProxyHeaders {
-		handler = handlers.ProxyHeaders(handler)
+	if config.WebhookToken != "" {
+		r.Methods("POST").Path("/v1/lsrelay/webhook").Handler(
+			AuthHandler(config.WebhookToken,
+				h.WebhookHandler(devices)))
 	}
 
-	fmt.Println("Listening on:", config.ListenAddr)
+	if config.AdminToken != "" {
+		r.Methods("POST").Path("/v1/lsrelay/revoke").Handler(
+			AuthHandler(config.AdminToken,
+				h.RevokeHandler()))
+		r.Methods("GET").Path("/v1/lsrelay/certificates/{serial}").Handler(
+			AuthHandler(config.AdminToken,
+				h.CertificatesHandler()))
+		r.Methods("GET").Path("/v1/lsrelay/status/{serial}").Handler(
+			AuthHandler(config.AdminToken,
+				h.StatusHandler()))
 
-	return http.ListenAndServe(config.ListenAddr, handler)
+		if devices != nil {
+			r.Methods("POST").Path("/v1/lsrelay/devices").Handler(
+				AuthHandler(config.AdminToken,
+					h.DevicesHandler(devices)))
+		}
+	}
+
+	// job IDs are random UUIDs only known to the client that queued the job, so the jobs API doesn't require a token, but jobs are redacted without the admin token.
+	// Requests for all jobs are limited together so IDs can't be guessed, except for requests with the admin token
+	lmt = limiter.New(&limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour}).
+		SetMax(float64(config.JobRate) / 60).
+		SetBurst(config.JobRate).
+		SetIPLookups([]string{"RemoteAddr"})
+	var jobs http.Handler = RouteLimitHandler(lmt, "/v1/lsrelay/jobs/", h.JobHandler(true))
+	if config.AdminToken != "" {
+		jobs = BypassHandler(config.AdminToken, h.JobHandler(false), jobs)
+	}
+	r.Methods("GET").Path("/v1/lsrelay/jobs/{id}").Handler(jobs)
+
+	return r
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "revoke" {
+		revoke(os.Args[2:])
+		return
+	}
+
 	err := RunServer()
 	if err != nil {
 		fmt.Println("Error: could not start server:", err)
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/korylprince/ls-relay-cert/mdm"
+)
+
+// revokeSerial revokes the certificates issued to the device with serial using the server at url, and returns the revoked certificates
+func revokeSerial(url, token, serial string) ([]mdm.Record, error) {
+	type response struct {
+		Code         int          `json:"code"`
+		Description  string       `json:"description"`
+		Certificates []mdm.Record `json:"certificates"`
+	}
+
+	j, err := json.Marshal(map[string]string{"serial_number": serial})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal request: %w", err)
+	}
+
+	r, err := http.NewRequest("POST", strings.TrimSuffix(url, "/")+"/v1/lsrelay/revoke", bytes.NewBuffer(j))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not complete request: %w", err)
+	}
+	defer res.Body.Close()
+
+	resp := new(response)
+	dec := json.NewDecoder(res.Body)
+	if err = dec.Decode(resp); err != nil {
+		return nil, fmt.Errorf("could not parse response: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not revoke: %d %s", resp.Code, resp.Description)
+	}
+
+	return resp.Certificates, nil
+}
+
+// revoke revokes the certificates issued to the device serial numbers given as arguments using a running server
+func revoke(args []string) {
+	fs := flag.NewFlagSet("ls-relay-cert revoke", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage of ls-relay-cert revoke: ls-relay-cert revoke [flags] <serial number>...")
+		fs.PrintDefaults()
+	}
+	flURL := fs.String("url", "http://localhost", "The base URL of the ls-relay-cert server")
+	flToken := fs.String("token", "", "The server's admin token (default $ADMINTOKEN)")
+	fs.Parse(args)
+
+	if *flToken == "" {
+		*flToken = os.Getenv("ADMINTOKEN")
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, serial := range fs.Args() {
+		records, err := revokeSerial(*flURL, *flToken, serial)
+		if err != nil {
+			fmt.Printf("%s: %v\n", serial, err)
+			failed = true
+			continue
+		}
+		for _, rec := range records {
+			fmt.Printf("%s: revoked certificate serial %s (expires %s)\n", serial, rec.Serial, rec.NotAfter.Format(time.RFC3339))
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -4,6 +4,7 @@ go 1.17
 
 require (
 	github.com/ReneKroon/ttlcache/v2 v2.10.0
+	github.com/ThalesIgnite/crypto11 v1.2.5
 	github.com/didip/tollbooth v4.0.2+incompatible
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/handlers v1.5.1
@@ -11,15 +12,20 @@ require (
 	github.com/groob/plist v0.0.0-20210519001750-9f754062e6d6
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/korylprince/go-macos-pkg v1.3.5
+	github.com/youmark/pkcs8 v0.0.0-20201027041543-1326539a0a0a
 	go.mozilla.org/pkcs7 v0.0.0-20210826202110-33d05740a352
-	golang.org/x/crypto v0.0.0-20211202192323-5770296d904e
+	golang.org/x/crypto v0.0.0-20220331220935-ae2d96664a29
+	software.sslmate.com/src/go-pkcs12 v0.2.0
 )
 
 require (
 	github.com/felixge/httpsnoop v1.0.2 // indirect
 	github.com/korylprince/go-cpio-odc v0.9.4 // indirect
 	github.com/korylprince/goxar v0.0.0-20211111233330-e9f257bcdf25 // indirect
+	github.com/miekg/pkcs11 v1.0.3-0.20190429190417-a667d056470f // indirect
 	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/thales-e-security/pool v0.0.2 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 	golang.org/x/time v0.0.0-20211116232009-f0f3c7e86c11 // indirect
 )
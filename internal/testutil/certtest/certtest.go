@@ -0,0 +1,18 @@
+// Package certtest contains certificate helpers shared by the tests of packages that import cert. cert's own tests can't import it
+package certtest
+
+import (
+	mrand "math/rand"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/internal/testutil"
+)
+
+// Options returns certificate options with deterministic randomness and clock. Ed25519 is used because its key generation and signatures are deterministic
+func Options() *cert.Options {
+	opts := cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeEd25519
+	opts.Rand = mrand.New(mrand.NewSource(1))
+	opts.Now = testutil.Now
+	return opts
+}
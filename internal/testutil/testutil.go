@@ -0,0 +1,41 @@
+// Package testutil contains helpers shared by the tests of this module. It doesn't import other packages of the module, so their in-package tests can use it
+package testutil
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// Time is the fixed time used by tests
+var Time = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Now returns Time, and is used as the clock of tests
+func Now() time.Time {
+	return Time
+}
+
+// Golden compares got to the golden file testdata/name, or updates it if -update is given
+func Golden(t testing.TB, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatalf("could not update golden file: %v", err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read golden file: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s does not match golden file:\n--- got ---\n%s\n--- want ---\n%s", name, got, want)
+	}
+}
@@ -0,0 +1,91 @@
+package mdm
+
+import (
+	"crypto/x509"
+	"fmt"
+
+	macospkg "github.com/korylprince/go-macos-pkg"
+)
+
+// Backend types
+const (
+	BackendMicroMDM = "micromdm"
+	BackendNanoMDM  = "nanomdm"
+	BackendJamf     = "jamf"
+)
+
+// DeviceLookup looks up devices by serial number
+type DeviceLookup interface {
+	// LookupDevice returns the UDID of the device with serial. If the device is not found, ErrNotFound is returned
+	LookupDevice(serial string) (string, error)
+}
+
+// Backend is an MDM server that commands are sent to
+type Backend interface {
+	DeviceLookup
+	// InstallProfile enqueues an InstallProfile command with the signed profile for the device with udid, and returns the command UUID.
+	// If the backend doesn't send MDM commands itself, e.g. Jamf Pro, an empty command UUID is returned
+	InstallProfile(udid string, profile []byte) (string, error)
+	// InstallEnterpriseApplication enqueues an InstallEnterpriseApplication command with manifest for the device with udid, and returns the command UUID
+	InstallEnterpriseApplication(udid string, manifest *macospkg.Manifest) (string, error)
+}
+
+// DeviceCertificateSource is a Backend that can return device MDM identity certificates, used to encrypt profiles to devices
+type DeviceCertificateSource interface {
+	// CheckDeviceCertificates returns an error if the backend's configuration can't return device certificates
+	CheckDeviceCertificates() error
+	// DeviceCertificate returns the MDM identity certificate of the device with udid
+	DeviceCertificate(udid string) (*x509.Certificate, error)
+}
+
+// PackageInstaller is a Backend that installs pkgs itself, instead of with an InstallEnterpriseApplication command for a pkg hosted by the FileStore
+type PackageInstaller interface {
+	// InstallPackage uploads the signed pkg and installs it on the device with udid, and returns the command UUID.
+	// If the installation isn't an MDM command whose status can be tracked, an empty command UUID is returned
+	InstallPackage(udid string, pkg []byte) (string, error)
+}
+
+// CommandUUIDSender is a Backend that sends commands with command UUIDs chosen by the caller, e.g. NanoMDM.
+// Its commands are tracked before they're sent, so an acknowledgment can't be received before the command is known
+type CommandUUIDSender interface {
+	// InstallProfileWithUUID is InstallProfile with commandUUID as the command UUID
+	InstallProfileWithUUID(udid, commandUUID string, profile []byte) error
+	// InstallEnterpriseApplicationWithUUID is InstallEnterpriseApplication with commandUUID as the command UUID
+	InstallEnterpriseApplicationWithUUID(udid, commandUUID string, manifest *macospkg.Manifest) error
+}
+
+// BackendConfig configures NewBackend
+type BackendConfig struct {
+	// Type is BackendMicroMDM, BackendNanoMDM, or BackendJamf
+	Type string
+	// Prefix is the URL of the server, e.g. https://mdm.example.com
+	Prefix string
+	// Token is the API key, or the OAuth client secret for Jamf Pro
+	Token string
+	// ClientID is the OAuth client ID, required for Jamf Pro
+	ClientID string
+	// Devices looks up devices by serial number, required for NanoMDM, which can't look up devices itself
+	Devices DeviceLookup
+	// StorageDir is the path of NanoMDM's file storage, used to read device identity certificates. It's optional, and only used for NanoMDM (see NanoMDM.StorageDir)
+	StorageDir string
+}
+
+// NewBackend returns a new Backend for config
+func NewBackend(config *BackendConfig) (Backend, error) {
+	switch config.Type {
+	case BackendMicroMDM:
+		return &MicroMDM{Prefix: config.Prefix, Token: config.Token}, nil
+	case BackendNanoMDM:
+		if config.Devices == nil {
+			return nil, fmt.Errorf("%s requires a device lookup", config.Type)
+		}
+		return &NanoMDM{Prefix: config.Prefix, Token: config.Token, Devices: config.Devices, StorageDir: config.StorageDir}, nil
+	case BackendJamf:
+		if config.ClientID == "" {
+			return nil, fmt.Errorf("%s requires a client ID", config.Type)
+		}
+		return &Jamf{Prefix: config.Prefix, ClientID: config.ClientID, ClientSecret: config.Token}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend: %q", config.Type)
+	}
+}
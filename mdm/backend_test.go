@@ -0,0 +1,700 @@
+package mdm
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/groob/plist"
+	macospkg "github.com/korylprince/go-macos-pkg"
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/internal/testutil/certtest"
+	"github.com/korylprince/ls-relay-cert/profile"
+)
+
+func TestMicroMDM(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "micromdm" || pass != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "unauthorized"}`))
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v1/devices":
+			q := new(struct {
+				FilterSerial []string `json:"filter_serial"`
+			})
+			if err := json.NewDecoder(r.Body).Decode(q); err != nil {
+				t.Errorf("could not decode query: %v", err)
+			}
+			if len(q.FilterSerial) == 1 && q.FilterSerial[0] == "SERIAL" {
+				w.Write([]byte(`{"devices": [{"udid": "UDID"}]}`))
+				return
+			}
+			w.Write([]byte(`{"devices": []}`))
+		case "/v1/commands":
+			cmd := make(map[string]interface{})
+			if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+				t.Errorf("could not decode command: %v", err)
+			}
+			if cmd["udid"] != "UDID" {
+				w.Write([]byte(`{"error": "unknown device"}`))
+				return
+			}
+			switch cmd["request_type"] {
+			case "InstallProfile":
+				if cmd["payload"] != "cHJvZmlsZQ==" {
+					t.Errorf("unexpected payload: %v", cmd["payload"])
+				}
+			case "InstallEnterpriseApplication":
+				if _, ok := cmd["manifest"].(map[string]interface{}); !ok {
+					t.Errorf("unexpected manifest: %v", cmd["manifest"])
+				}
+			default:
+				t.Errorf("unexpected request type: %v", cmd["request_type"])
+			}
+			w.Write([]byte(`{"payload": {"command_uuid": "COMMAND"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	var b Backend = &MicroMDM{Prefix: srv.URL, Token: "token"}
+
+	udid, err := b.LookupDevice("SERIAL")
+	if err != nil || udid != "UDID" {
+		t.Errorf("want UDID, got %q, %v", udid, err)
+	}
+	if _, err = b.LookupDevice("OTHER"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+
+	if id, err := b.InstallProfile("UDID", []byte("profile")); err != nil || id != "COMMAND" {
+		t.Errorf("want command uuid COMMAND, got %q, %v", id, err)
+	}
+	if id, err := b.InstallEnterpriseApplication("UDID", macospkg.NewManifest([]byte("pkg"), "https://example.com/pkg", macospkg.ManifestHashSHA256)); err != nil || id != "COMMAND" {
+		t.Errorf("want command uuid COMMAND, got %q, %v", id, err)
+	}
+	if _, err = b.InstallProfile("OTHER", []byte("profile")); err == nil {
+		t.Error("want error for unknown device, got nil")
+	}
+
+	b = &MicroMDM{Prefix: srv.URL, Token: "invalid"}
+	if _, err = b.LookupDevice("SERIAL"); err == nil {
+		t.Error("want error for invalid token, got nil")
+	}
+}
+
+func TestNanoMDM(t *testing.T) {
+	var commands []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "nanomdm" || pass != "token" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != "PUT" {
+			t.Errorf("unexpected method: %s", r.Method)
+		}
+
+		if r.URL.Path != "/v1/enqueue/UDID" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": {"OTHER": {"command_error": "unknown enrollment"}}}`))
+			return
+		}
+
+		buf, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("could not read command: %v", err)
+		}
+		cmd := make(map[string]interface{})
+		if err = plist.Unmarshal(buf, &cmd); err != nil {
+			t.Errorf("could not decode command: %v", err)
+		}
+		commands = append(commands, cmd)
+
+		// push errors don't prevent the command from being queued
+		w.Write([]byte(`{"status": {"UDID": {"push_error": "push failed"}}, "command_uuid": "` + cmd["CommandUUID"].(string) + `"}`))
+	}))
+	defer srv.Close()
+
+	devices, err := NewDeviceDirectory("")
+	if err != nil {
+		t.Fatalf("could not create device directory: %v", err)
+	}
+	if err = devices.Set("SERIAL", "UDID"); err != nil {
+		t.Fatalf("could not set device: %v", err)
+	}
+
+	b, err := NewBackend(&BackendConfig{Type: BackendNanoMDM, Prefix: srv.URL, Token: "token", Devices: devices})
+	if err != nil {
+		t.Fatalf("could not create backend: %v", err)
+	}
+
+	if udid, err := b.LookupDevice("SERIAL"); err != nil || udid != "UDID" {
+		t.Errorf("want UDID, got %q, %v", udid, err)
+	}
+
+	profileUUID, err := b.InstallProfile("UDID", []byte("profile"))
+	if err != nil {
+		t.Fatalf("could not install profile: %v", err)
+	}
+	appUUID, err := b.InstallEnterpriseApplication("UDID", macospkg.NewManifest([]byte("pkg"), "https://example.com/pkg", macospkg.ManifestHashSHA256))
+	if err != nil {
+		t.Fatalf("could not install application: %v", err)
+	}
+
+	if len(commands) != 2 {
+		t.Fatalf("want 2 commands, got %d", len(commands))
+	}
+
+	cmd := commands[0]["Command"].(map[string]interface{})
+	if commands[0]["CommandUUID"] != profileUUID || cmd["RequestType"] != "InstallProfile" || string(cmd["Payload"].([]byte)) != "profile" {
+		t.Errorf("unexpected InstallProfile command: %v", commands[0])
+	}
+
+	cmd = commands[1]["Command"].(map[string]interface{})
+	manifest, ok := cmd["Manifest"].(map[string]interface{})
+	if commands[1]["CommandUUID"] != appUUID || cmd["RequestType"] != "InstallEnterpriseApplication" || !ok || manifest["items"] == nil {
+		t.Errorf("unexpected InstallEnterpriseApplication command: %v", commands[1])
+	}
+
+	if _, err = b.InstallProfile("OTHER", []byte("profile")); err == nil {
+		t.Error("want error for unknown enrollment, got nil")
+	}
+
+	b = &NanoMDM{Prefix: srv.URL, Token: "invalid", Devices: devices}
+	if _, err = b.InstallProfile("UDID", []byte("profile")); err == nil {
+		t.Error("want error for invalid token, got nil")
+	}
+
+	if _, err = NewBackend(&BackendConfig{Type: BackendNanoMDM, Prefix: srv.URL, Token: "token"}); err == nil {
+		t.Error("want error without device lookup, got nil")
+	}
+}
+
+func TestNanoMDMDeviceCertificate(t *testing.T) {
+	opts := certtest.Options()
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	device, _, err := cert.GenerateLocalhost(ca, caKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate device certificate: %v", err)
+	}
+
+	// NanoMDM's file storage saves each enrollment's identity certificate in a directory named for the enrollment ID
+	dir := t.TempDir()
+	if err = os.Mkdir(filepath.Join(dir, "UDID"), 0755); err != nil {
+		t.Fatalf("could not create enrollment directory: %v", err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "UDID", "identity_cert.pem"), cert.ChainPEM(device), 0644); err != nil {
+		t.Fatalf("could not write device certificate: %v", err)
+	}
+
+	backend, err := NewBackend(&BackendConfig{Type: BackendNanoMDM, Devices: new(DeviceDirectory), StorageDir: dir})
+	if err != nil {
+		t.Fatalf("could not create backend: %v", err)
+	}
+	b, ok := backend.(DeviceCertificateSource)
+	if !ok {
+		t.Fatal("want nanomdm backend to be a DeviceCertificateSource")
+	}
+
+	if err = b.CheckDeviceCertificates(); err != nil {
+		t.Errorf("could not check device certificates: %v", err)
+	}
+	if c, err := b.DeviceCertificate("UDID"); err != nil || !c.Equal(device) {
+		t.Errorf("want device certificate, got %v, %v", c, err)
+	}
+	if _, err = b.DeviceCertificate("OTHER"); err == nil {
+		t.Error("want error for device without certificate, got nil")
+	}
+	if _, err = b.DeviceCertificate("../UDID"); err == nil {
+		t.Error("want error for invalid udid, got nil")
+	}
+
+	for _, dir := range []string{filepath.Join(dir, "missing"), filepath.Join(dir, "UDID", "identity_cert.pem"), ""} {
+		b = &NanoMDM{Devices: new(DeviceDirectory), StorageDir: dir}
+		if err = b.CheckDeviceCertificates(); err == nil {
+			t.Errorf("want error checking storage directory %q, got nil", dir)
+		}
+	}
+	// b has no storage directory
+	if _, err = b.DeviceCertificate("UDID"); err == nil {
+		t.Error("want error without storage directory, got nil")
+	}
+}
+
+func TestDeviceDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	d, err := NewDeviceDirectory(path)
+	if err != nil {
+		t.Fatalf("could not create device directory: %v", err)
+	}
+
+	msg, err := plist.Marshal(map[string]string{"MessageType": "Authenticate", "UDID": "UDID", "SerialNumber": "SERIAL"})
+	if err != nil {
+		t.Fatalf("could not marshal check-in: %v", err)
+	}
+
+	for _, event := range []*WebhookEvent{
+		{Topic: "mdm.Connect", CheckinEvent: &CheckinEvent{UDID: "OTHER", RawPayload: []byte("invalid")}},
+		{Topic: TopicAuthenticate, CreatedAt: time.Now(), CheckinEvent: &CheckinEvent{UDID: "UDID", RawPayload: msg}},
+	} {
+		if err = d.HandleWebhook(event); err != nil {
+			t.Errorf("could not handle %s event: %v", event.Topic, err)
+		}
+	}
+
+	if err = d.HandleWebhook(&WebhookEvent{Topic: TopicAuthenticate, CheckinEvent: &CheckinEvent{RawPayload: []byte("invalid")}}); err == nil {
+		t.Error("want error for invalid check-in, got nil")
+	}
+
+	// reload from disk
+	if d, err = NewDeviceDirectory(path); err != nil {
+		t.Fatalf("could not load device directory: %v", err)
+	}
+
+	if udid, err := d.LookupDevice("SERIAL"); err != nil || udid != "UDID" {
+		t.Errorf("want UDID, got %q, %v", udid, err)
+	}
+	if _, err = d.LookupDevice("OTHER"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+
+	// devices that enrolled before the webhook was set up can be seeded
+	if err = d.SetDevices(map[string]string{"OTHER": "OTHER-UDID", "SERIAL": "UDID"}); err != nil {
+		t.Fatalf("could not set devices: %v", err)
+	}
+	if err = d.SetDevices(map[string]string{"EMPTY": ""}); err == nil {
+		t.Error("want error for empty UDID, got nil")
+	}
+
+	if d, err = NewDeviceDirectory(path); err != nil {
+		t.Fatalf("could not load device directory: %v", err)
+	}
+	for serial, want := range map[string]string{"SERIAL": "UDID", "OTHER": "OTHER-UDID"} {
+		if udid, err := d.LookupDevice(serial); err != nil || udid != want {
+			t.Errorf("%s: want %s, got %q, %v", serial, want, udid, err)
+		}
+	}
+	if _, err = d.LookupDevice("EMPTY"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+}
+
+// jamfObjectName returns the general>name of a Classic API object
+func jamfObjectName(t *testing.T, buf []byte) string {
+	t.Helper()
+	o := new(struct {
+		Name string `xml:"general>name"`
+	})
+	if err := xml.Unmarshal(buf, o); err != nil {
+		t.Errorf("could not decode object: %v", err)
+	}
+	return o.Name
+}
+
+func TestJamf(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		tokens   int
+		nextID   = 10
+		packages = map[string]string{"1": "Other Package"}
+		uploads  = make(map[string][]byte)
+		policies = map[string][]byte{"2": []byte("<policy><general><name>Other Policy</name></general></policy>")}
+		profiles = make(map[string][]byte)
+		// completed are the IDs of policies that have completed on computer 7
+		completed = make(map[string]bool)
+		// pages is the number of requests for package results after the first page
+		pages int
+	)
+
+	// find writes the Classic API object with name, or 404 Not Found
+	find := func(w http.ResponseWriter, element, name string, objects map[string][]byte) {
+		for id, o := range objects {
+			if jamfObjectName(t, o) == name {
+				fmt.Fprintf(w, "<%s><general><id>%s</id><name>%s</name></general></%s>", element, id, name, element)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}
+
+	// byName returns the ID of the object with name, or an empty string
+	byName := func(objects map[string][]byte, name string) string {
+		for id, o := range objects {
+			if jamfObjectName(t, o) == name {
+				return id
+			}
+		}
+		return ""
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path == "/api/oauth/token" {
+			if r.FormValue("grant_type") != "client_credentials" || r.FormValue("client_id") != "client" || r.FormValue("client_secret") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			tokens++
+			w.Write([]byte(`{"access_token": "access", "token_type": "Bearer", "expires_in": 60}`))
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		id := path.Base(r.URL.Path)
+		switch route := r.Method + " " + strings.TrimSuffix(r.URL.Path, id); route {
+		case "GET /api/v1/":
+			if id != "computers-inventory" && id != "packages" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if id == "computers-inventory" {
+				switch r.URL.Query().Get("filter") {
+				case `hardware.serialNumber=="SERIAL"`, `udid=="UDID"`:
+					w.Write([]byte(`{"totalCount": 1, "results": [{"id": "7", "udid": "UDID"}]}`))
+				default:
+					w.Write([]byte(`{"totalCount": 0, "results": []}`))
+				}
+				return
+			}
+
+			// only prefix filters are supported
+			prefix, err := strconv.Unquote(strings.TrimPrefix(r.URL.Query().Get("filter"), "packageName=="))
+			if err != nil || !strings.HasSuffix(prefix, "*") {
+				t.Errorf("unexpected package filter: %q", r.URL.Query().Get("filter"))
+			}
+			type result struct {
+				ID          string `json:"id"`
+				PackageName string `json:"packageName"`
+			}
+			results := []result{}
+			for id, name := range packages {
+				if strings.HasPrefix(name, strings.TrimSuffix(prefix, "*")) {
+					results = append(results, result{ID: id, PackageName: name})
+				}
+			}
+			sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+
+			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+			size, err := strconv.Atoi(r.URL.Query().Get("page-size"))
+			if err != nil || size < 1 {
+				t.Errorf("unexpected page size: %q", r.URL.Query().Get("page-size"))
+				size = 100
+			}
+			if page > 0 {
+				pages++
+			}
+			total := len(results)
+			if start := page * size; start < len(results) {
+				results = results[start:]
+			} else {
+				results = results[:0]
+			}
+			if len(results) > size {
+				results = results[:size]
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"totalCount": total, "results": results})
+		case "POST /api/v1/":
+			pkg := new(struct {
+				PackageName string `json:"packageName"`
+				FileName    string `json:"fileName"`
+			})
+			if err := json.NewDecoder(r.Body).Decode(pkg); err != nil || filepath.Ext(pkg.FileName) != ".pkg" {
+				t.Errorf("unexpected package: %v, %v", pkg, err)
+			}
+			nextID++
+			id = strconv.Itoa(nextID)
+			packages[id] = pkg.PackageName
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"id": "%s", "href": "/api/v1/packages/%s"}`, id, id)
+		case "DELETE /api/v1/packages/":
+			if _, ok := packages[id]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(packages, id)
+			delete(uploads, id)
+			w.WriteHeader(http.StatusNoContent)
+		case "GET /JSSResource/":
+			if id != "policies" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte("<policies>"))
+			for id, o := range policies {
+				fmt.Fprintf(w, "<policy><id>%s</id><name>%s</name></policy>", id, jamfObjectName(t, o))
+			}
+			w.Write([]byte("</policies>"))
+		case "GET /JSSResource/policies/id/":
+			if _, ok := policies[id]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(policies[id])
+		case "GET /JSSResource/computerhistory/id/7/subset/":
+			w.Write([]byte("<computer_history><policy_logs>"))
+			for id := range completed {
+				fmt.Fprintf(w, "<policy_log><policy_id>%s</policy_id><status>Completed</status></policy_log>", id)
+			}
+			w.Write([]byte("<policy_log><policy_id>2</policy_id><status>Failed</status></policy_log></policy_logs></computer_history>"))
+		case "GET /JSSResource/policies/name/":
+			find(w, "policy", id, policies)
+		case "GET /JSSResource/osxconfigurationprofiles/name/":
+			find(w, "os_x_configuration_profile", id, profiles)
+		case "POST /JSSResource/policies/id/", "POST /JSSResource/osxconfigurationprofiles/id/", "PUT /JSSResource/osxconfigurationprofiles/id/":
+			objects, element := policies, "policy"
+			if strings.Contains(route, "osxconfigurationprofiles") {
+				objects, element = profiles, "os_x_configuration_profile"
+			}
+			if r.Method == "POST" {
+				nextID++
+				id = strconv.Itoa(nextID)
+			} else if _, ok := objects[id]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			objects[id], _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><%s><id>%s</id></%s>`, element, id, element)
+		case "DELETE /JSSResource/policies/id/":
+			if _, ok := policies[id]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(policies, id)
+			w.WriteHeader(http.StatusOK)
+		default:
+			// package uploads end in /upload
+			if r.Method == "POST" && id == "upload" {
+				pkgID := path.Base(path.Dir(r.URL.Path))
+				if _, ok := packages[pkgID]; !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				f, _, err := r.FormFile("file")
+				if err != nil {
+					t.Errorf("could not read upload: %v", err)
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				uploads[pkgID], _ = io.ReadAll(f)
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprintf(w, `{"id": "%s"}`, pkgID)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	if _, err := NewBackend(&BackendConfig{Type: BackendJamf, Prefix: srv.URL, Token: "secret"}); err == nil {
+		t.Error("want error without client ID, got nil")
+	}
+
+	b, err := NewBackend(&BackendConfig{Type: BackendJamf, Prefix: srv.URL, Token: "secret", ClientID: "client"})
+	if err != nil {
+		t.Fatalf("could not create backend: %v", err)
+	}
+
+	if udid, err := b.LookupDevice("SERIAL"); err != nil || udid != "UDID" {
+		t.Errorf("want UDID, got %q, %v", udid, err)
+	}
+	if _, err = b.LookupDevice("OTHER"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+
+	installer, ok := b.(PackageInstaller)
+	if !ok {
+		t.Fatal("want PackageInstaller")
+	}
+
+	// each delivery replaces the previous delivery's package and policy
+	for i := 0; i < 2; i++ {
+		pkg := []byte(fmt.Sprintf("pkg %d", i))
+		// policies aren't MDM commands, so their status can't be tracked
+		commandUUID, err := installer.InstallPackage("UDID", pkg)
+		if err != nil || commandUUID != "" {
+			t.Fatalf("want empty command UUID, got %q, %v", commandUUID, err)
+		}
+
+		mu.Lock()
+		if len(packages) != 2 || len(policies) != 2 || packages["1"] != "Other Package" || policies["2"] == nil {
+			t.Errorf("want other objects and 1 package and policy, got packages %v and %d policies", packages, len(policies))
+		}
+		policy, ok := policies[byName(policies, "ls-relay-cert UDID")]
+		if !ok {
+			t.Fatal("want policy named for UDID, got none")
+		}
+		var pkgID string
+		for id, name := range packages {
+			if strings.HasPrefix(name, "ls-relay-cert UDID ") {
+				pkgID = id
+			}
+		}
+		if !bytes.Equal(uploads[pkgID], pkg) {
+			t.Errorf("want uploaded %q, got %q", pkg, uploads[pkgID])
+		}
+		for _, s := range []string{"<computer><id>7</id></computer>", "<package><id>" + pkgID + "</id><action>Install</action></package>", "<trigger_checkin>true</trigger_checkin>"} {
+			if !bytes.Contains(policy, []byte(s)) {
+				t.Errorf("want policy containing %s, got %s", s, policy)
+			}
+		}
+		mu.Unlock()
+	}
+
+	if _, err = installer.InstallPackage("OTHER", []byte("pkg")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+
+	// cleanup only deletes deliveries whose policy completed or whose package is too old
+	j := b.(*Jamf)
+	countObjects := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(packages), len(policies)
+	}
+	if err = j.Cleanup(time.Now(), time.Hour); err != nil {
+		t.Fatalf("could not clean up: %v", err)
+	}
+	if pkgs, pols := countObjects(); pkgs != 2 || pols != 2 {
+		t.Errorf("want pending delivery kept, got %d packages and %d policies", pkgs, pols)
+	}
+
+	mu.Lock()
+	completed[byName(policies, "ls-relay-cert UDID")] = true
+	mu.Unlock()
+	if err = j.Cleanup(time.Now(), time.Hour); err != nil {
+		t.Fatalf("could not clean up: %v", err)
+	}
+	if pkgs, pols := countObjects(); pkgs != 1 || pols != 1 {
+		t.Errorf("want completed delivery deleted, got %d packages and %d policies", pkgs, pols)
+	}
+
+	if _, err = installer.InstallPackage("UDID", []byte("pkg")); err != nil {
+		t.Fatalf("could not install package: %v", err)
+	}
+	mu.Lock()
+	// packages created by earlier versions don't have a creation time
+	packages["3"] = "ls-relay-cert LEGACY ABCDEF12"
+	// packages span multiple pages of results
+	for i := 0; i < 2*jamfPageSize+5; i++ {
+		packages[fmt.Sprintf("P%04d", i)] = fmt.Sprintf("ls-relay-cert PAGED %08X", i)
+	}
+	mu.Unlock()
+	if err = j.Cleanup(time.Now(), time.Hour); err != nil {
+		t.Fatalf("could not clean up: %v", err)
+	}
+	if pkgs, pols := countObjects(); pkgs != 2 || pols != 2 {
+		t.Errorf("want legacy packages deleted and new delivery kept, got %d packages and %d policies", pkgs, pols)
+	}
+	mu.Lock()
+	if pages == 0 {
+		t.Error("want packages requested by page")
+	}
+	mu.Unlock()
+	if err = j.Cleanup(time.Now().Add(2*time.Hour), time.Hour); err != nil {
+		t.Fatalf("could not clean up: %v", err)
+	}
+	if pkgs, pols := countObjects(); pkgs != 1 || pols != 1 {
+		t.Errorf("want old delivery deleted, got %d packages and %d policies", pkgs, pols)
+	}
+
+	// profiles are signed by MDM and the signature is removed by the backend
+	m, err := New(&Config{
+		SigningIdentity: testIdentity(t),
+		CacheSize:       10,
+		CacheTTL:        time.Minute,
+		Backend:         b,
+		Config:          testConfig(),
+	})
+	if err != nil {
+		t.Fatalf("could not create mdm: %v", err)
+	}
+
+	// the second delivery updates the first delivery's configuration profile
+	var profileID string
+	for i := 0; i < 2; i++ {
+		ca, _, err := cert.GenerateCA(certtest.Options())
+		if err != nil {
+			t.Fatalf("could not generate CA: %v", err)
+		}
+		prof, err := profile.New(m.Config.Config, ca)
+		if err != nil {
+			t.Fatalf("could not generate profile: %v", err)
+		}
+
+		commandUUID, err := m.InstallProfile("UDID", prof)
+		if err != nil || commandUUID != "" {
+			t.Fatalf("want empty command UUID, got %q, %v", commandUUID, err)
+		}
+
+		mu.Lock()
+		id := byName(profiles, "ls-relay-cert UDID")
+		if profileID != "" && id != profileID {
+			t.Errorf("want updated profile %s, got %s", profileID, id)
+		}
+		profileID = id
+
+		if len(profiles) != 1 {
+			t.Errorf("want 1 configuration profile, got %d", len(profiles))
+		}
+		p := new(struct {
+			General struct {
+				Name             string `xml:"name"`
+				RedeployOnUpdate string `xml:"redeploy_on_update"`
+				Level            string `xml:"level"`
+				Payloads         string `xml:"payloads"`
+			} `xml:"general"`
+			Computers []string `xml:"scope>computers>computer>id"`
+		})
+		if err = xml.Unmarshal(profiles[id], p); err != nil || p.General.Name != "ls-relay-cert UDID" || p.General.RedeployOnUpdate != "All" ||
+			p.General.Level != "System" || len(p.Computers) != 1 || p.Computers[0] != "7" {
+			t.Errorf("unexpected configuration profile: %v, %v", p, err)
+		}
+		mu.Unlock()
+
+		parsed, err := profile.Parse([]byte(p.General.Payloads))
+		if err != nil {
+			t.Fatalf("could not parse uploaded profile: %v", err)
+		}
+		if parsed.Signer != nil {
+			t.Error("want unsigned profile")
+		}
+		if root := parsed.Root(); root == nil || !root.Equal(ca) {
+			t.Error("uploaded profile does not contain the CA")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if tokens != 1 {
+		t.Errorf("want 1 token request, got %d", tokens)
+	}
+}
@@ -0,0 +1,17 @@
+#!/bin/bash
+
+# restore the files replaced by a payload whose delivery was rolled back. Nothing is changed unless the payload's localhost.pem is still installed,
+# since the payload may never have been installed, or may have been replaced by a later delivery
+if [ "$(shasum -a 256 /usr/local/etc/localhost.pem 2>/dev/null | cut -d ' ' -f 1)" != "{{sha256 .Localhost}}" ]; then
+    exit 0
+fi
+
+# files that didn't exist before the payload was installed are removed
+for f in ca.pem ca_key.pem localhost.pem localhost_key.pem chain.pem; do
+    if [ -f "/usr/local/etc/.ls-relay-cert.bak/$f" ]; then
+        mv -f "/usr/local/etc/.ls-relay-cert.bak/$f" "/usr/local/etc/$f"
+    else
+        rm -f "/usr/local/etc/$f"
+    fi
+done
+rm -rf /usr/local/etc/.ls-relay-cert.bak
@@ -0,0 +1,103 @@
+package mdm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// DeviceDirectory maps device serial numbers to UDIDs, e.g. for MDM servers without a device inventory.
+// If it was created with a path, devices are persisted to it as JSON
+type DeviceDirectory struct {
+	path    string
+	mu      sync.Mutex
+	devices map[string]string
+}
+
+// NewDeviceDirectory returns a new DeviceDirectory persisted to the JSON file at path, loading any existing devices.
+// If path is empty, devices are only kept in memory
+func NewDeviceDirectory(path string) (*DeviceDirectory, error) {
+	d := &DeviceDirectory{path: path, devices: make(map[string]string)}
+	if path == "" {
+		return d, nil
+	}
+
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read device directory: %w", err)
+	}
+
+	if err = json.Unmarshal(buf, &d.devices); err != nil {
+		return nil, fmt.Errorf("could not parse device directory: %w", err)
+	}
+
+	return d, nil
+}
+
+// LookupDevice implements DeviceLookup
+func (d *DeviceDirectory) LookupDevice(serial string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	udid, ok := d.devices[serial]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return udid, nil
+}
+
+// Set records serial as the serial number of the device with udid
+func (d *DeviceDirectory) Set(serial, udid string) error {
+	return d.SetDevices(map[string]string{serial: udid})
+}
+
+// SetDevices records the devices in the map of serial numbers to UDIDs, e.g. to seed the directory with devices that enrolled before the webhook was set up
+func (d *DeviceDirectory) SetDevices(devices map[string]string) error {
+	for serial, udid := range devices {
+		if serial == "" || udid == "" {
+			return errors.New("empty serial number or UDID")
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	changed := false
+	for serial, udid := range devices {
+		if d.devices[serial] != udid {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	updated := make(map[string]string, len(d.devices)+len(devices))
+	for serial, udid := range d.devices {
+		updated[serial] = udid
+	}
+	for serial, udid := range devices {
+		updated[serial] = udid
+	}
+
+	if d.path != "" {
+		buf, err := json.MarshalIndent(updated, "", "\t")
+		if err != nil {
+			return fmt.Errorf("could not marshal device directory: %w", err)
+		}
+
+		if err = writeFileAtomic(d.path, buf); err != nil {
+			return fmt.Errorf("could not write device directory: %w", err)
+		}
+	}
+
+	d.devices = updated
+
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"time"
 
 	"github.com/ReneKroon/ttlcache/v2"
@@ -15,17 +16,20 @@ const pathSize = 16
 // FileStore implements FileStore completely in memory and uses an LRU cache to limit memory usage
 type FileStore struct {
 	files *ttlcache.Cache
+	// Rand is the source of randomness for generated paths. If nil, crypto/rand.Reader is used
+	Rand io.Reader
 }
 
-// NewFileStore returns a new FileStore with the given cache size (item count) and item ttl
-func NewFileStore(size int, ttl time.Duration) *FileStore {
+// NewFileStore returns a new FileStore with the given cache size (item count) and item ttl, that generates paths with randomness from r.
+// If r is nil, crypto/rand.Reader is used
+func NewFileStore(size int, ttl time.Duration, r io.Reader) *FileStore {
 	c := ttlcache.NewCache()
 	c.SetCacheSizeLimit(size)
 	if err := c.SetTTL(ttl); err != nil {
 		panic(fmt.Errorf("could not set ttl on cache: %w", err))
 	}
 	c.SkipTTLExtensionOnHit(true)
-	return &FileStore{files: c}
+	return &FileStore{files: c, Rand: r}
 }
 
 // Peek returns the file at the given path without removing it
@@ -61,8 +65,13 @@ func (m *FileStore) Get(path string) ([]byte, error) {
 
 // Put stores the data and returns a path with format "<random id>/<name>"
 func (m *FileStore) Put(name string, data []byte) (string, error) {
+	r := m.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+
 	buf := make([]byte, pathSize)
-	if _, err := rand.Read(buf); err != nil {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return "", fmt.Errorf("could not generate id: %w", err)
 	}
 	path := fmt.Sprintf("%s/%s", base64.RawURLEncoding.EncodeToString(buf), name)
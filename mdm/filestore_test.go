@@ -0,0 +1,35 @@
+package mdm
+
+import (
+	"bytes"
+	"errors"
+	mrand "math/rand"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	fs := NewFileStore(10, time.Minute, mrand.New(mrand.NewSource(1)))
+
+	path, err := fs.Put("payload.pkg", []byte("data"))
+	if err != nil {
+		t.Fatalf("could not put file: %v", err)
+	}
+	if want := "Uv38ByGCZU8WP18PmmIdcg/payload.pkg"; path != want {
+		t.Errorf("want path %q, got %q", want, path)
+	}
+
+	for _, get := range []func(string) ([]byte, error){fs.Peek, fs.Get} {
+		data, err := get(path)
+		if err != nil {
+			t.Fatalf("could not get file: %v", err)
+		}
+		if !bytes.Equal(data, []byte("data")) {
+			t.Errorf("want data %q, got %q", "data", data)
+		}
+	}
+
+	if _, err = fs.Get(path); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound after Get, got %v", err)
+	}
+}
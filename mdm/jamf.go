@@ -0,0 +1,613 @@
+package mdm
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/groob/plist"
+	macospkg "github.com/korylprince/go-macos-pkg"
+	"go.mozilla.org/pkcs7"
+)
+
+// Jamf is a Jamf Pro server. Jamf Pro can't send raw MDM commands, so pkgs are uploaded and installed by a policy,
+// and profiles are uploaded as configuration profiles, both scoped to the single computer. Objects are named for the computer's UDID,
+// so each delivery replaces the objects created by the previous one. Pkgs contain private keys, so Cleanup should be called periodically to delete them
+type Jamf struct {
+	// Prefix is the URL of the server, e.g. https://example.jamfcloud.com
+	Prefix string
+	// ClientID is the OAuth API client ID. The client's role requires privileges to read computers and computer history, and create, read, update,
+	// and delete packages, policies, and macOS configuration profiles
+	ClientID string
+	// ClientSecret is the OAuth API client secret
+	ClientSecret string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// errJamfNotFound is returned for 404 Not Found responses
+var errJamfNotFound = errors.New("object not found")
+
+// jamfScope scopes a policy or profile to computers
+type jamfScope struct {
+	Computers []jamfComputer `xml:"computers>computer"`
+}
+
+type jamfComputer struct {
+	ID string `xml:"id"`
+}
+
+// jamfPolicyPackage is a package installed by a policy
+type jamfPolicyPackage struct {
+	ID     string `xml:"id"`
+	Action string `xml:"action"`
+}
+
+// accessToken returns a cached OAuth access token, or requests a new one if it's expired
+func (j *Jamf) accessToken() (string, error) {
+	type response struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.token != "" && time.Now().Before(j.expires) {
+		return j.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {j.ClientID},
+		"client_secret": {j.ClientSecret},
+	}
+
+	res, err := http.PostForm(fmt.Sprintf("%s/api/oauth/token", j.Prefix), form)
+	if err != nil {
+		return "", fmt.Errorf("could not complete request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not get access token: %s", res.Status)
+	}
+
+	resp := new(response)
+	dec := json.NewDecoder(res.Body)
+	if err = dec.Decode(resp); err != nil {
+		return "", fmt.Errorf("could not parse response: %w", err)
+	}
+
+	// renew the token before it expires
+	j.token = resp.AccessToken
+	j.expires = time.Now().Add(time.Duration(resp.ExpiresIn)*time.Second - 10*time.Second)
+
+	return j.token, nil
+}
+
+// request sends an authenticated request with body of the given content type and returns the response body.
+// Jamf Pro API responses are JSON, and Classic API responses are XML. If the response is 404 Not Found, the error wraps errJamfNotFound
+func (j *Jamf) request(method, path, contentType string, body []byte) ([]byte, error) {
+	token, err := j.accessToken()
+	if err != nil {
+		return nil, fmt.Errorf("could not authenticate: %w", err)
+	}
+
+	r, err := http.NewRequest(method, j.Prefix+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if strings.HasPrefix(path, "/api/") {
+		r.Header.Set("Accept", "application/json")
+	}
+
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not complete request: %w", err)
+	}
+	defer res.Body.Close()
+
+	buf, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read response: %w", err)
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", errJamfNotFound, bytes.TrimSpace(buf))
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected response (%s): %s", res.Status, bytes.TrimSpace(buf))
+	}
+
+	return buf, nil
+}
+
+// findComputer returns the ID and UDID of the single computer matching the RSQL field == value filter. If no computer is found, ErrNotFound is returned
+func (j *Jamf) findComputer(field, value string) (id, udid string, err error) {
+	type response struct {
+		TotalCount int `json:"totalCount"`
+		Results    []struct {
+			ID   string `json:"id"`
+			UDID string `json:"udid"`
+		} `json:"results"`
+	}
+
+	q := url.Values{
+		"section":   {"GENERAL"},
+		"page-size": {"2"},
+		"filter":    {fmt.Sprintf("%s==%q", field, value)},
+	}
+
+	buf, err := j.request("GET", "/api/v1/computers-inventory?"+q.Encode(), "", nil)
+	if err != nil {
+		return "", "", fmt.Errorf("could not query computers: %w", err)
+	}
+
+	resp := new(response)
+	if err = json.Unmarshal(buf, resp); err != nil {
+		return "", "", fmt.Errorf("could not parse response: %w", err)
+	}
+
+	if resp.TotalCount != 1 || len(resp.Results) != 1 || resp.Results[0].UDID == "" {
+		return "", "", ErrNotFound
+	}
+
+	return resp.Results[0].ID, resp.Results[0].UDID, nil
+}
+
+// createClassic creates a Classic API object from v at the resource path, e.g. /JSSResource/policies, and returns its ID
+func (j *Jamf) createClassic(resource string, v interface{}) (string, error) {
+	type response struct {
+		ID string `xml:"id"`
+	}
+
+	body, err := xml.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal object: %w", err)
+	}
+
+	buf, err := j.request("POST", resource+"/id/0", "application/xml", body)
+	if err != nil {
+		return "", err
+	}
+
+	resp := new(response)
+	if err = xml.Unmarshal(buf, resp); err != nil {
+		return "", fmt.Errorf("could not parse response: %w", err)
+	}
+
+	return resp.ID, nil
+}
+
+// updateClassic replaces the Classic API object with id at the resource path, e.g. /JSSResource/policies, with v
+func (j *Jamf) updateClassic(resource, id string, v interface{}) error {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("could not marshal object: %w", err)
+	}
+
+	_, err = j.request("PUT", fmt.Sprintf("%s/id/%s", resource, url.PathEscape(id)), "application/xml", body)
+	return err
+}
+
+// findClassic returns the ID of the Classic API object with name at the resource path, e.g. /JSSResource/policies.
+// If no object is found, errJamfNotFound is returned
+func (j *Jamf) findClassic(resource, name string) (string, error) {
+	// objects contain their ID in a general element
+	type response struct {
+		ID string `xml:"general>id"`
+	}
+
+	buf, err := j.request("GET", fmt.Sprintf("%s/name/%s", resource, url.PathEscape(name)), "", nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp := new(response)
+	if err = xml.Unmarshal(buf, resp); err != nil {
+		return "", fmt.Errorf("could not parse response: %w", err)
+	}
+	if resp.ID == "" {
+		return "", errJamfNotFound
+	}
+
+	return resp.ID, nil
+}
+
+// jamfPrefix returns the name of the policy and configuration profile, and the prefix of the names of packages, created for the device with udid
+func jamfPrefix(udid string) string {
+	return "ls-relay-cert " + udid
+}
+
+// jamfTimeFormat is the format of the creation time in package names
+const jamfTimeFormat = "20060102T150405Z"
+
+// jamfName returns a unique name for packages created for the device with udid at now. Package file names must be unique
+func jamfName(udid string, now time.Time) (string, error) {
+	u, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("could not generate uuid: %w", err)
+	}
+	return fmt.Sprintf("%s %s %s", jamfPrefix(udid), now.UTC().Format(jamfTimeFormat), strings.ToUpper(u.String()[:8])), nil
+}
+
+// parseJamfName returns the UDID and creation time of the package with name, created by jamfName.
+// If name doesn't have a creation time, e.g. it was created by an earlier version, the zero time is returned
+func parseJamfName(name string) (udid string, created time.Time, ok bool) {
+	if !strings.HasPrefix(name, jamfPrefix("")) {
+		return "", time.Time{}, false
+	}
+	fields := strings.Fields(strings.TrimPrefix(name, jamfPrefix("")))
+	if len(fields) < 2 {
+		return "", time.Time{}, false
+	}
+	if len(fields) > 2 {
+		created, _ = time.Parse(jamfTimeFormat, fields[1])
+	}
+	return fields[0], created, true
+}
+
+// jamfPageSize is the number of results requested per page from the Jamf Pro API
+const jamfPageSize = 100
+
+// jamfPackage is a package returned by the Jamf Pro API
+type jamfPackage struct {
+	ID          string `json:"id"`
+	PackageName string `json:"packageName"`
+}
+
+// listPackages returns all packages whose name starts with prefix, requesting every page of results
+func (j *Jamf) listPackages(prefix string) ([]jamfPackage, error) {
+	type response struct {
+		TotalCount int           `json:"totalCount"`
+		Results    []jamfPackage `json:"results"`
+	}
+
+	var pkgs []jamfPackage
+	for page := 0; ; page++ {
+		q := url.Values{
+			"page":      {strconv.Itoa(page)},
+			"page-size": {strconv.Itoa(jamfPageSize)},
+			"filter":    {fmt.Sprintf("packageName==%q", prefix+"*")},
+		}
+
+		buf, err := j.request("GET", "/api/v1/packages?"+q.Encode(), "", nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not query packages: %w", err)
+		}
+
+		resp := new(response)
+		if err = json.Unmarshal(buf, resp); err != nil {
+			return nil, fmt.Errorf("could not parse packages: %w", err)
+		}
+
+		pkgs = append(pkgs, resp.Results...)
+		if len(resp.Results) == 0 || len(pkgs) >= resp.TotalCount {
+			return pkgs, nil
+		}
+	}
+}
+
+// deletePackages deletes the policy and packages created by previous deliveries to the device with udid, so they don't accumulate.
+// A policy that hasn't run yet is superseded by the new delivery
+func (j *Jamf) deletePackages(udid string) error {
+	prefix := jamfPrefix(udid) + " "
+
+	// the policy is deleted first, since it references the packages
+	id, err := j.findClassic("/JSSResource/policies", jamfPrefix(udid))
+	if err != nil && !errors.Is(err, errJamfNotFound) {
+		return fmt.Errorf("could not query policy: %w", err)
+	}
+	if err == nil {
+		if _, err = j.request("DELETE", "/JSSResource/policies/id/"+url.PathEscape(id), "", nil); err != nil {
+			return fmt.Errorf("could not delete policy %s: %w", id, err)
+		}
+	}
+
+	pkgs, err := j.listPackages(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pkgs {
+		if !strings.HasPrefix(p.PackageName, prefix) {
+			continue
+		}
+		if _, err = j.request("DELETE", "/api/v1/packages/"+url.PathEscape(p.ID), "", nil); err != nil {
+			return fmt.Errorf("could not delete package %s: %w", p.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// policyCompleted returns true if the policy with id has completed on the computer with computerID
+func (j *Jamf) policyCompleted(id, computerID string) (bool, error) {
+	type response struct {
+		PolicyLogs []struct {
+			PolicyID string `xml:"policy_id"`
+			Status   string `xml:"status"`
+		} `xml:"policy_logs>policy_log"`
+	}
+
+	buf, err := j.request("GET", fmt.Sprintf("/JSSResource/computerhistory/id/%s/subset/PolicyLogs", url.PathEscape(computerID)), "", nil)
+	if err != nil {
+		return false, fmt.Errorf("could not query computer history: %w", err)
+	}
+
+	resp := new(response)
+	if err = xml.Unmarshal(buf, resp); err != nil {
+		return false, fmt.Errorf("could not parse response: %w", err)
+	}
+
+	for _, l := range resp.PolicyLogs {
+		if l.PolicyID == id && l.Status == "Completed" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Cleanup deletes the policy and packages of each delivery whose policy has completed on the computer, or whose package was created more than maxAge before now,
+// so packages containing private keys aren't kept on the server. A delivery whose policy is deleted before it runs must be delivered again
+func (j *Jamf) Cleanup(now time.Time, maxAge time.Duration) error {
+	type policies struct {
+		Policies []struct {
+			ID   string `xml:"id"`
+			Name string `xml:"name"`
+		} `xml:"policy"`
+	}
+
+	type policy struct {
+		Scope jamfScope `xml:"scope"`
+	}
+
+	// udids are the devices whose deliveries are deleted
+	udids := make(map[string]bool)
+
+	buf, err := j.request("GET", "/JSSResource/policies", "", nil)
+	if err != nil {
+		return fmt.Errorf("could not query policies: %w", err)
+	}
+	ps := new(policies)
+	if err = xml.Unmarshal(buf, ps); err != nil {
+		return fmt.Errorf("could not parse policies: %w", err)
+	}
+
+	for _, p := range ps.Policies {
+		udid := strings.TrimPrefix(p.Name, jamfPrefix(""))
+		if udid == p.Name || udid == "" || strings.Contains(udid, " ") {
+			continue
+		}
+
+		buf, err = j.request("GET", "/JSSResource/policies/id/"+url.PathEscape(p.ID), "", nil)
+		if err != nil {
+			return fmt.Errorf("could not query policy %s: %w", p.ID, err)
+		}
+		pol := new(policy)
+		if err = xml.Unmarshal(buf, pol); err != nil {
+			return fmt.Errorf("could not parse policy %s: %w", p.ID, err)
+		}
+
+		for _, c := range pol.Scope.Computers {
+			completed, err := j.policyCompleted(p.ID, c.ID)
+			if err != nil {
+				return fmt.Errorf("could not check policy %s: %w", p.ID, err)
+			}
+			if completed {
+				udids[udid] = true
+			}
+		}
+	}
+
+	pkgs, err := j.listPackages(jamfPrefix(""))
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pkgs {
+		udid, created, ok := parseJamfName(p.PackageName)
+		if ok && now.Sub(created) > maxAge {
+			udids[udid] = true
+		}
+	}
+
+	for udid := range udids {
+		if err = j.deletePackages(udid); err != nil {
+			return fmt.Errorf("could not delete packages for %s: %w", udid, err)
+		}
+	}
+
+	return nil
+}
+
+// LookupDevice implements DeviceLookup
+func (j *Jamf) LookupDevice(serial string) (string, error) {
+	_, udid, err := j.findComputer("hardware.serialNumber", serial)
+	return udid, err
+}
+
+// InstallPackage implements PackageInstaller. The policy and packages created by previous deliveries to the computer are deleted,
+// then the pkg is uploaded as a new package, and a new policy installs it once on the computer at its next check-in.
+// Policies aren't MDM commands and their status can't be tracked, so an empty ID is returned
+func (j *Jamf) InstallPackage(udid string, pkg []byte) (string, error) {
+	type packageRequest struct {
+		PackageName          string `json:"packageName"`
+		FileName             string `json:"fileName"`
+		CategoryID           string `json:"categoryId"`
+		Priority             int    `json:"priority"`
+		FillUserTemplate     bool   `json:"fillUserTemplate"`
+		RebootRequired       bool   `json:"rebootRequired"`
+		OSInstall            bool   `json:"osInstall"`
+		SuppressUpdates      bool   `json:"suppressUpdates"`
+		SuppressFromDock     bool   `json:"suppressFromDock"`
+		SuppressEula         bool   `json:"suppressEula"`
+		SuppressRegistration bool   `json:"suppressRegistration"`
+	}
+
+	type packageResponse struct {
+		ID string `json:"id"`
+	}
+
+	type policy struct {
+		XMLName xml.Name `xml:"policy"`
+		General struct {
+			Name           string `xml:"name"`
+			Enabled        bool   `xml:"enabled"`
+			TriggerCheckin bool   `xml:"trigger_checkin"`
+			Frequency      string `xml:"frequency"`
+		} `xml:"general"`
+		Scope    jamfScope           `xml:"scope"`
+		Packages []jamfPolicyPackage `xml:"package_configuration>packages>package"`
+	}
+
+	computer, _, err := j.findComputer("udid", udid)
+	if err != nil {
+		return "", fmt.Errorf("could not find computer: %w", err)
+	}
+
+	if err = j.deletePackages(udid); err != nil {
+		return "", fmt.Errorf("could not delete previous packages: %w", err)
+	}
+
+	name, err := jamfName(udid, time.Now())
+	if err != nil {
+		return "", err
+	}
+	fileName := strings.ReplaceAll(name, " ", "-") + ".pkg"
+
+	body, err := json.Marshal(&packageRequest{PackageName: name, FileName: fileName, CategoryID: "-1", Priority: 10})
+	if err != nil {
+		return "", fmt.Errorf("could not marshal package: %w", err)
+	}
+
+	buf, err := j.request("POST", "/api/v1/packages", "application/json", body)
+	if err != nil {
+		return "", fmt.Errorf("could not create package: %w", err)
+	}
+
+	resp := new(packageResponse)
+	if err = json.Unmarshal(buf, resp); err != nil {
+		return "", fmt.Errorf("could not parse package response: %w", err)
+	}
+
+	form := new(bytes.Buffer)
+	mw := multipart.NewWriter(form)
+	fw, err := mw.CreateFormFile("file", fileName)
+	if err != nil {
+		return "", fmt.Errorf("could not create form: %w", err)
+	}
+	if _, err = fw.Write(pkg); err != nil {
+		return "", fmt.Errorf("could not write form: %w", err)
+	}
+	if err = mw.Close(); err != nil {
+		return "", fmt.Errorf("could not write form: %w", err)
+	}
+
+	if _, err = j.request("POST", fmt.Sprintf("/api/v1/packages/%s/upload", url.PathEscape(resp.ID)), mw.FormDataContentType(), form.Bytes()); err != nil {
+		return "", fmt.Errorf("could not upload package: %w", err)
+	}
+
+	p := new(policy)
+	p.General.Name = jamfPrefix(udid)
+	p.General.Enabled = true
+	p.General.TriggerCheckin = true
+	p.General.Frequency = "Once per computer"
+	p.Scope.Computers = []jamfComputer{{ID: computer}}
+	p.Packages = []jamfPolicyPackage{{ID: resp.ID, Action: "Install"}}
+
+	if _, err = j.createClassic("/JSSResource/policies", p); err != nil {
+		return "", fmt.Errorf("could not create policy: %w", err)
+	}
+
+	return "", nil
+}
+
+// InstallProfile implements Backend. Jamf Pro signs profiles itself, so the signature is removed and the profile is uploaded as a configuration profile
+// that's installed automatically on the computer. The configuration profile created by a previous delivery to the computer is updated and redeployed
+// if it exists. Configuration profiles aren't MDM commands and their status can't be tracked, so an empty ID is returned
+func (j *Jamf) InstallProfile(udid string, profile []byte) (string, error) {
+	type configurationProfile struct {
+		XMLName xml.Name `xml:"os_x_configuration_profile"`
+		General struct {
+			Name               string `xml:"name"`
+			DistributionMethod string `xml:"distribution_method"`
+			RedeployOnUpdate   string `xml:"redeploy_on_update"`
+			Level              string `xml:"level"`
+			Payloads           string `xml:"payloads"`
+		} `xml:"general"`
+		Scope jamfScope `xml:"scope"`
+	}
+
+	// signed profiles are DER, and pkcs7.Parse can't reject XML quickly
+	if !bytes.HasPrefix(bytes.TrimSpace(profile), []byte("<")) {
+		p7, err := pkcs7.Parse(profile)
+		if err != nil {
+			return "", fmt.Errorf("could not parse signed profile: %w", err)
+		}
+		profile = p7.Content
+	}
+
+	scope := new(struct{ PayloadScope string })
+	if err := plist.Unmarshal(profile, scope); err != nil {
+		return "", fmt.Errorf("could not parse profile: %w", err)
+	}
+	if scope.PayloadScope == "" {
+		scope.PayloadScope = "System"
+	}
+
+	computer, _, err := j.findComputer("udid", udid)
+	if err != nil {
+		return "", fmt.Errorf("could not find computer: %w", err)
+	}
+
+	name := jamfPrefix(udid)
+
+	p := new(configurationProfile)
+	p.General.Name = name
+	p.General.DistributionMethod = "Install Automatically"
+	p.General.RedeployOnUpdate = "All"
+	p.General.Level = scope.PayloadScope
+	p.General.Payloads = string(profile)
+	p.Scope.Computers = []jamfComputer{{ID: computer}}
+
+	id, err := j.findClassic("/JSSResource/osxconfigurationprofiles", name)
+	switch {
+	case err == nil:
+		if err = j.updateClassic("/JSSResource/osxconfigurationprofiles", id, p); err != nil {
+			return "", fmt.Errorf("could not update configuration profile: %w", err)
+		}
+	case errors.Is(err, errJamfNotFound):
+		if _, err = j.createClassic("/JSSResource/osxconfigurationprofiles", p); err != nil {
+			return "", fmt.Errorf("could not create configuration profile: %w", err)
+		}
+	default:
+		return "", fmt.Errorf("could not query configuration profile: %w", err)
+	}
+
+	return "", nil
+}
+
+// InstallEnterpriseApplication implements Backend. Jamf Pro can't install pkgs from a manifest, so an error is always returned. See InstallPackage
+func (j *Jamf) InstallEnterpriseApplication(udid string, manifest *macospkg.Manifest) (string, error) {
+	return "", errors.New("jamf pro can't install enterprise applications from a manifest")
+}
@@ -0,0 +1,208 @@
+package mdm
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Job statuses
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Delivery modes
+const (
+	ModeFull = "full"
+	ModeLeaf = "leaf"
+)
+
+// JobRetention is how long finished jobs are kept
+const JobRetention = 24 * time.Hour
+
+// ErrQueueFull is returned when a job can't be submitted because the queue is full
+var ErrQueueFull = errors.New("job queue is full")
+
+// ErrJobNotFound is returned when a job doesn't exist or has expired
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrJobExists is returned with the existing job when a job is submitted for a device that already has a queued or running job
+var ErrJobExists = errors.New("device already has an active job")
+
+// Job is an asynchronous delivery to a device
+type Job struct {
+	ID           string     `json:"id"`
+	SerialNumber string     `json:"serial_number,omitempty"`
+	Mode         string     `json:"mode"`
+	Status       string     `json:"status"`
+	Error        string     `json:"error,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+	// Delivery is the progress of the job's delivery, if it has started. It's only set by MDM.Job
+	Delivery *Delivery `json:"delivery,omitempty"`
+
+	udid string
+	// delivery is the tracked delivery started by the job
+	delivery *Delivery
+}
+
+// Redacted returns a copy of the job without its serial number, error, and delivery, which can identify the device, e.g. for clients that only know the job ID
+func (j *Job) Redacted() *Job {
+	return &Job{
+		ID:         j.ID,
+		Mode:       j.Mode,
+		Status:     j.Status,
+		CreatedAt:  j.CreatedAt,
+		StartedAt:  j.StartedAt,
+		FinishedAt: j.FinishedAt,
+	}
+}
+
+// Queue runs jobs with a bounded number of workers, and at most one queued or running job for each device. Jobs are only kept in memory
+type Queue struct {
+	run   func(job *Job) error
+	done  func(job *Job)
+	queue chan *Job
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	// active are the IDs of queued or running jobs by serial number
+	active map[string]string
+}
+
+// NewQueue returns a new Queue that holds up to size queued jobs, and starts workers that call run for each job.
+// If done is not nil, it's called with a copy of each job after it finishes
+func NewQueue(workers, size int, run func(job *Job) error, done func(job *Job)) *Queue {
+	q := &Queue{run: run, done: done, queue: make(chan *Job, size), jobs: make(map[string]*Job), active: make(map[string]string)}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// work runs jobs from the queue
+func (q *Queue) work() {
+	for job := range q.queue {
+		started := time.Now()
+		q.mu.Lock()
+		job.Status = JobRunning
+		job.StartedAt = &started
+		q.mu.Unlock()
+
+		err := q.run(job)
+
+		finished := time.Now()
+		q.mu.Lock()
+		job.Status = JobSucceeded
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+		}
+		job.FinishedAt = &finished
+		delete(q.active, job.SerialNumber)
+		j := *job
+		q.mu.Unlock()
+
+		if q.done != nil {
+			q.done(&j)
+		}
+	}
+}
+
+// Submit queues a new job for the device with serial and udid and returns a copy of it. If the device already has a queued or running job,
+// a copy of it is returned with ErrJobExists. If the queue is full, ErrQueueFull is returned
+func (q *Queue) Submit(serial, udid, mode string) (*Job, error) {
+	u, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate job id: %w", err)
+	}
+
+	now := time.Now()
+	job := &Job{ID: u.String(), SerialNumber: serial, Mode: mode, Status: JobQueued, CreatedAt: now, udid: udid}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if id, ok := q.active[serial]; ok {
+		j := *q.jobs[id]
+		return &j, ErrJobExists
+	}
+
+	// remove expired jobs
+	for id, j := range q.jobs {
+		if j.FinishedAt != nil && now.Sub(*j.FinishedAt) > JobRetention {
+			delete(q.jobs, id)
+		}
+	}
+
+	select {
+	case q.queue <- job:
+	default:
+		return nil, ErrQueueFull
+	}
+	q.jobs[job.ID] = job
+	q.active[serial] = job.ID
+
+	j := *job
+	return &j, nil
+}
+
+// Job returns a copy of the job with id. If the job is not found, ErrJobNotFound is returned
+func (q *Queue) Job(id string) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+
+	j := *job
+	return &j, nil
+}
+
+// setDelivery records the tracked delivery started by job
+func (q *Queue) setDelivery(job *Job, d *Delivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.delivery = d
+}
+
+// runJob runs the delivery for job
+func (m *MDM) runJob(job *Job) error {
+	started := func(d *Delivery) { m.jobs.setDelivery(job, d) }
+	switch job.Mode {
+	case ModeFull:
+		return m.deliver(job.SerialNumber, job.udid, started)
+	case ModeLeaf:
+		return m.deliverLeaf(job.SerialNumber, job.udid, started)
+	default:
+		return fmt.Errorf("unknown mode: %q", job.Mode)
+	}
+}
+
+// Submit queues an asynchronous delivery to the device with serial and udid, from SerialToUDID, and returns the job. mode is ModeFull or ModeLeaf.
+// If the device already has a queued or running job, it's returned with ErrJobExists. If the queue is full, ErrQueueFull is returned
+func (m *MDM) Submit(serial, udid, mode string) (*Job, error) {
+	return m.jobs.Submit(serial, udid, mode)
+}
+
+// Job returns the job with id, including the progress of its delivery. If the job is not found, ErrJobNotFound is returned
+func (m *MDM) Job(id string) (*Job, error) {
+	job, err := m.jobs.Job(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if job.delivery != nil {
+		job.Delivery = m.tracker.snapshot(job.delivery)
+	}
+
+	return job, nil
+}
@@ -0,0 +1,114 @@
+package mdm
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/korylprince/ls-relay-cert/internal/testutil/certtest"
+)
+
+func TestQueue(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan string, 2)
+	done := make(chan *Job, 2)
+
+	q := NewQueue(1, 1, func(job *Job) error {
+		started <- job.ID
+		<-release
+		if job.SerialNumber == "FAIL" {
+			return errors.New("could not deliver")
+		}
+		return nil
+	}, func(job *Job) { done <- job })
+
+	first, err := q.Submit("SERIAL", "UDID", ModeFull)
+	if err != nil {
+		t.Fatalf("could not submit job: %v", err)
+	}
+	if first.Status != JobQueued {
+		t.Errorf("want status %s, got %s", JobQueued, first.Status)
+	}
+
+	// wait for the only worker to start the first job so the second fills the queue
+	if id := <-started; id != first.ID {
+		t.Fatalf("want job %s started, got %s", first.ID, id)
+	}
+
+	second, err := q.Submit("FAIL", "UDID2", ModeLeaf)
+	if err != nil {
+		t.Fatalf("could not submit job: %v", err)
+	}
+
+	// a device only has one active job
+	if job, err := q.Submit("SERIAL", "UDID", ModeLeaf); !errors.Is(err, ErrJobExists) || job.ID != first.ID {
+		t.Errorf("want ErrJobExists with job %s, got %+v, %v", first.ID, job, err)
+	}
+
+	if _, err = q.Submit("OTHER", "UDID3", ModeFull); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("want ErrQueueFull, got %v", err)
+	}
+
+	if job, err := q.Job(first.ID); err != nil || job.Status != JobRunning || job.StartedAt == nil {
+		t.Errorf("want running job, got %+v, %v", job, err)
+	}
+	if job, err := q.Job(second.ID); err != nil || job.Status != JobQueued {
+		t.Errorf("want queued job, got %+v, %v", job, err)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case job := <-done:
+			if job.FinishedAt == nil || job.FinishedAt.Before(*job.StartedAt) {
+				t.Errorf("want finished job, got %+v", job)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for jobs")
+		}
+	}
+
+	if job, err := q.Job(first.ID); err != nil || job.Status != JobSucceeded || job.Error != "" {
+		t.Errorf("want succeeded job, got %+v, %v", job, err)
+	}
+	if job, err := q.Job(second.ID); err != nil || job.Status != JobFailed || job.Error != "could not deliver" {
+		t.Errorf("want failed job, got %+v, %v", job, err)
+	}
+
+	if _, err = q.Job("unknown"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("want ErrJobNotFound, got %v", err)
+	}
+
+	// a finished job doesn't block new jobs for the device
+	if _, err = q.Submit("SERIAL", "UDID", ModeFull); err != nil {
+		t.Errorf("could not submit job: %v", err)
+	}
+}
+
+func TestJob(t *testing.T) {
+	done := make(chan *Job, 1)
+	m, _ := testMDM(t, &Config{CertOptions: certtest.Options(), Workers: 1, QueueSize: 1, JobDone: func(job *Job) { done <- job }})
+
+	job, err := m.Submit("SERIAL", "UDID", ModeFull)
+	if err != nil {
+		t.Fatalf("could not submit job: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for job")
+	}
+
+	// a later delivery to the device doesn't replace the job's delivery
+	if err = m.Deliver("SERIAL"); err != nil {
+		t.Fatalf("could not deliver: %v", err)
+	}
+
+	if job, err = m.Job(job.ID); err != nil || job.Status != JobSucceeded {
+		t.Fatalf("want succeeded job, got %+v, %v", job, err)
+	}
+	d := job.Delivery
+	if d == nil || d.UDID != "UDID" || len(d.Commands) != 2 || d.Commands[0].CommandUUID != "PKG-1" || d.Commands[1].CommandUUID != "PROFILE-1" {
+		t.Errorf("want the job's delivery, got %+v", d)
+	}
+}
@@ -1,25 +1,31 @@
 package mdm
 
 import (
-	"bytes"
 	"crypto/rsa"
 	"crypto/x509"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
+	"io"
 	"os"
 	"time"
 
-	"github.com/groob/plist"
 	macospkg "github.com/korylprince/go-macos-pkg"
+	"github.com/korylprince/ls-relay-cert/cert"
 	"github.com/korylprince/ls-relay-cert/profile"
-	"go.mozilla.org/pkcs7"
 	"golang.org/x/crypto/pkcs12"
 )
 
 var ErrNotFound = errors.New("serial not found")
 
+// ErrNoCA is returned when an operation requires a CA but none is configured
+var ErrNoCA = errors.New("no CA configured")
+
+// ErrLeafDeviceCA is returned when a leaf-only delivery is requested with IssueDeviceCA. Device CA keys aren't kept, so a new leaf can't be signed by the device's installed CA
+var ErrLeafDeviceCA = errors.New("leaf-only delivery is not supported with per-device CAs")
+
+// ErrTimeout is returned when a device doesn't acknowledge a command before AckTimeout
+var ErrTimeout = errors.New("timed out waiting for command acknowledgement")
+
 type Config struct {
 	MDMPrefix       string
 	MDMToken        string
@@ -27,167 +33,267 @@ type Config struct {
 	CacheSize       int
 	CacheTTL        time.Duration
 	CachePrefix     string
+	// Rand is the source of randomness for FileStore paths. If nil, crypto/rand.Reader is used. Certificates are generated with CertOptions.Rand
+	Rand io.Reader
+	// CertOptions is used to customize generated certificates. If nil, cert.DefaultOptions is used.
+	// CRLDistributionPoints can only be set if IssueDeviceCA or SharedCA is true, since certificates are only revocable if issued by CA
+	CertOptions *cert.Options
+	// CA is an existing CA key pair and chain. If set, it's used to sign a new per-device CA for each delivery instead of generating a self-signed CA
+	CA *cert.Issuer
+	// IssueDeviceCA, if true, delivers a new per-device CA signed by CA. It's the default if CA is set and neither SharedCA nor DeliverCAKey is true.
+	// The device CA can't issue other CAs and is name constrained to the localhost names, but its key is delivered, so any device can issue certificates for those names trusted by every device
+	IssueDeviceCA bool
+	// DeliverCAKey, if true, delivers CA and its private key to every device instead of a per-device CA.
+	// Any device can then issue certificates trusted by every device, so it should only be used if the agent requires it
+	DeliverCAKey bool
+	// SharedCA, if true, delivers the same root profile for CA to every device along with a localhost key pair signed by CA.
+	// The CA key is never delivered. The profile is generated once by New, but it's sent again with every full delivery, which restores it if it was removed. Use DeliverLeaf to only deliver the localhost key pair
+	SharedCA bool
+	// RegistryFile is the path of the JSON file used to record issued certificates. If empty, records are only kept in memory
+	RegistryFile string
+	// EncryptProfiles, if true, encrypts profiles to the device's MDM identity certificate from Backend before they're signed.
+	// Backend must be a DeviceCertificateSource, e.g. NanoMDM with StorageDir
+	EncryptProfiles bool
+	// Backend is the MDM server commands are sent to. If nil, the MicroMDM server at MDMPrefix is used with MDMToken
+	Backend Backend
+	// AckTimeout, if set, makes deliveries wait up to AckTimeout for each command to be acknowledged before sending the next,
+	// and roll back the delivery's files if a command fails. A profile that isn't acknowledged in time is left queued, since it may still be installed.
+	// The files replaced by a delivery are backed up on the device until it finishes, then removed by another pkg. Deliveries with the Jamf Pro backend can't be rolled back.
+	// Acknowledgements are received with HandleWebhook
+	AckTimeout time.Duration
+	// Workers is the number of asynchronous deliveries run concurrently. If less than 1, 1 is used
+	Workers int
+	// QueueSize is the number of asynchronous deliveries that can be queued before Submit returns ErrQueueFull
+	QueueSize int
+	// JobDone, if set, is called after each asynchronous delivery finishes
+	JobDone func(job *Job)
 	*profile.Config
 }
 
-// MDM is a MicroMDM service
+// MDM delivers certificates to devices through an MDM server
 type MDM struct {
 	*Config
 	cert *x509.Certificate
 	key  *rsa.PrivateKey
 	*FileStore
+	registry *Registry
+	crl      *crlCache
+	backend  Backend
+	// deviceCerts is backend if EncryptProfiles is true
+	deviceCerts DeviceCertificateSource
+	tracker     *Tracker
+	jobs        *Queue
+	// issueDeviceCA is true if IssueDeviceCA is true, or it's the default since a CA is set without another mode
+	issueDeviceCA bool
+	// sharedProfile is the root profile delivered to every device if SharedCA is true
+	sharedProfile *profile.TopLevelProfile
+	// pkg generates and signs pkgs. It's replaced in tests, since pkgs can only be generated with xar
+	pkg func(identifier string, script []byte) ([]byte, error)
 }
 
 func New(config *Config) (*MDM, error) {
-	// read "Apple Developer ID Installer" identity
-	identity, err := os.ReadFile(config.SigningIdentity)
-	if err != nil {
-		return nil, fmt.Errorf("could not read identity: %w", err)
+	if config.SharedCA && config.CA == nil {
+		return nil, fmt.Errorf("SharedCA requires a CA: %w", ErrNoCA)
 	}
-	key, cert, err := pkcs12.Decode(identity, "")
-	if err != nil {
-		return nil, fmt.Errorf("could not decode identity: %w", err)
+	if config.DeliverCAKey && config.CA == nil {
+		return nil, fmt.Errorf("DeliverCAKey requires a CA: %w", ErrNoCA)
+	}
+	if config.IssueDeviceCA && config.CA == nil {
+		return nil, fmt.Errorf("IssueDeviceCA requires a CA: %w", ErrNoCA)
+	}
+	modes := 0
+	for _, mode := range []bool{config.SharedCA, config.IssueDeviceCA, config.DeliverCAKey} {
+		if mode {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return nil, errors.New("SharedCA, IssueDeviceCA, and DeliverCAKey are mutually exclusive")
 	}
 
-	return &MDM{
-		Config:    config,
-		cert:      cert,
-		key:       key.(*rsa.PrivateKey),
-		FileStore: NewFileStore(config.CacheSize, config.CacheTTL),
-	}, nil
-}
+	issueDeviceCA := config.IssueDeviceCA || (config.CA != nil && modes == 0)
 
-// SerialToUDID returns the UDID for the given serial. If the serial is not found, ErrNotFound is returned
-func (m *MDM) SerialToUDID(serial string) (string, error) {
-	type response struct {
-		Devices []struct {
-			UDID string `json:"udid"`
-		} `json:"devices"`
-		Error string `json:"error"`
+	// without a CA, or with DeliverCAKey, devices can issue their own certificates that the CRL can't list
+	if config.CertOptions != nil && len(config.CertOptions.CRLDistributionPoints) > 0 && !issueDeviceCA && !config.SharedCA {
+		return nil, errors.New("CRLDistributionPoints requires IssueDeviceCA or SharedCA")
 	}
 
-	q := map[string]interface{}{
-		"filter_serial": []string{serial},
+	// the CRL is signed by the CA when it's requested, so a CA that can't sign it is rejected here
+	if config.CertOptions != nil && len(config.CertOptions.CRLDistributionPoints) > 0 {
+		if config.CA == nil {
+			return nil, fmt.Errorf("CRLDistributionPoints requires a CA: %w", ErrNoCA)
+		}
+		if config.CA.Cert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+			return nil, errors.New("CRLDistributionPoints requires a CA with the CRL signing key usage")
+		}
 	}
 
-	j, err := json.Marshal(q)
-	if err != nil {
-		return "", fmt.Errorf("could not marshal query: %w", err)
+	// the CA key is only delivered to devices if explicitly enabled, so it must be exportable
+	if config.DeliverCAKey {
+		if _, err := cert.MarshalPrivateKeyPEM(config.CA.Key); err != nil {
+			return nil, fmt.Errorf("CA key can't be delivered: %w", err)
+		}
 	}
 
-	r, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/devices", m.MDMPrefix), bytes.NewBuffer(j))
+	backend := config.Backend
+	if backend == nil {
+		backend = &MicroMDM{Prefix: config.MDMPrefix, Token: config.MDMToken}
+	}
+
+	// profiles are encrypted when they're delivered, so a backend that can't return device certificates is rejected here
+	var deviceCerts DeviceCertificateSource
+	if config.EncryptProfiles {
+		var ok bool
+		if deviceCerts, ok = backend.(DeviceCertificateSource); !ok {
+			return nil, errors.New("EncryptProfiles requires a backend that can return device certificates")
+		}
+		if err := deviceCerts.CheckDeviceCertificates(); err != nil {
+			return nil, fmt.Errorf("EncryptProfiles requires device certificates: %w", err)
+		}
+	}
+
+	// read "Apple Developer ID Installer" identity
+	identity, err := os.ReadFile(config.SigningIdentity)
 	if err != nil {
-		return "", fmt.Errorf("could not create request: %w", err)
+		return nil, fmt.Errorf("could not read identity: %w", err)
+	}
+	key, cert, err := pkcs12.Decode(identity, "")
+	if err != nil {
+		return nil, fmt.Errorf("could not decode identity: %w", err)
 	}
-	r.SetBasicAuth("micromdm", m.MDMToken)
 
-	res, err := http.DefaultClient.Do(r)
+	registry, err := NewRegistry(config.RegistryFile, config.CA)
 	if err != nil {
-		return "", fmt.Errorf("could not complete request: %w", err)
+		return nil, fmt.Errorf("could not load registry: %w", err)
 	}
-	defer res.Body.Close()
 
-	resp := new(response)
-	dec := json.NewDecoder(res.Body)
-	if err = dec.Decode(resp); err != nil {
-		return "", fmt.Errorf("could not parse response: %w", err)
+	var sharedProfile *profile.TopLevelProfile
+	if config.SharedCA {
+		if sharedProfile, err = profile.New(config.Config, config.CA.Root(), config.CA.Intermediates()...); err != nil {
+			return nil, fmt.Errorf("could not generate shared profile: %w", err)
+		}
 	}
 
-	if resp.Error != "" {
-		return "", fmt.Errorf("could not query devices: %s", resp.Error)
+	m := &MDM{
+		Config:        config,
+		cert:          cert,
+		key:           key.(*rsa.PrivateKey),
+		FileStore:     NewFileStore(config.CacheSize, config.CacheTTL, config.Rand),
+		registry:      registry,
+		crl:           new(crlCache),
+		backend:       backend,
+		deviceCerts:   deviceCerts,
+		tracker:       NewTracker(),
+		sharedProfile: sharedProfile,
+		issueDeviceCA: issueDeviceCA,
 	}
 
-	if len(resp.Devices) != 1 || resp.Devices[0].UDID == "" {
-		return "", ErrNotFound
+	m.pkg = m.buildPkg
+
+	workers := config.Workers
+	if workers < 1 {
+		workers = 1
 	}
+	m.jobs = NewQueue(workers, config.QueueSize, m.runJob, config.JobDone)
 
-	return resp.Devices[0].UDID, nil
+	return m, nil
 }
 
-// Command runs the MDM cmd
-func (m *MDM) Command(cmd map[string]interface{}) error {
-	type response struct {
-		Error string `json:"error"`
-	}
+// SerialToUDID returns the UDID for the given serial. If the serial is not found, ErrNotFound is returned
+func (m *MDM) SerialToUDID(serial string) (string, error) {
+	return m.backend.LookupDevice(serial)
+}
 
-	j, err := json.Marshal(cmd)
-	if err != nil {
-		return fmt.Errorf("could not marshal command: %w", err)
-	}
+// InstallProfile runs the InstallProfile command with the given udid and profile, and returns the command UUID.
+// If EncryptProfiles is true, the profile is encrypted to the device
+func (m *MDM) InstallProfile(udid string, prof *profile.TopLevelProfile) (string, error) {
+	return m.installProfile(udid, "", prof)
+}
 
-	r, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/commands", m.MDMPrefix), bytes.NewBuffer(j))
-	if err != nil {
-		return fmt.Errorf("could not create request: %w", err)
+// installProfile runs InstallProfile. If commandUUID is not empty, the backend must be a CommandUUIDSender, and the command is sent with commandUUID
+func (m *MDM) installProfile(udid, commandUUID string, prof *profile.TopLevelProfile) (string, error) {
+	if m.EncryptProfiles {
+		c, err := m.deviceCerts.DeviceCertificate(udid)
+		if err != nil {
+			return "", fmt.Errorf("could not get device certificate: %w", err)
+		}
+		if prof, err = profile.Encrypt(prof, c); err != nil {
+			return "", fmt.Errorf("could not encrypt profile: %w", err)
+		}
 	}
-	r.SetBasicAuth("micromdm", m.MDMToken)
 
-	res, err := http.DefaultClient.Do(r)
+	signed, err := profile.Sign(prof, m.cert, m.key)
 	if err != nil {
-		return fmt.Errorf("could not complete request: %w", err)
+		return "", fmt.Errorf("could not sign profile: %w", err)
 	}
-	defer res.Body.Close()
 
-	resp := new(response)
-	dec := json.NewDecoder(res.Body)
-	if err = dec.Decode(resp); err != nil {
-		return fmt.Errorf("could not parse response: %w", err)
+	id := commandUUID
+	if commandUUID != "" {
+		err = m.backend.(CommandUUIDSender).InstallProfileWithUUID(udid, commandUUID, signed)
+	} else {
+		id, err = m.backend.InstallProfile(udid, signed)
 	}
-
-	if resp.Error != "" {
-		return fmt.Errorf("could not execute command: %s", resp.Error)
+	if err != nil {
+		return "", fmt.Errorf("could not execute InstallProfile command: %w", err)
 	}
 
-	return nil
+	return id, nil
 }
 
-// InstallProfile runs the InstallProfile command with the given udid and profile
-func (m *MDM) InstallProfile(udid string, profile *profile.TopLevelProfile) error {
-	// marshal plist
-	buf, err := plist.Marshal(profile)
-	if err != nil {
-		return fmt.Errorf("could not marshal plist: %w", err)
-	}
+// InstallEnterpriseApplication runs the InstallEnterpriseApplication command with the given udid and manifest, and returns the command UUID
+func (m *MDM) InstallEnterpriseApplication(udid string, manifest *macospkg.Manifest) (string, error) {
+	return m.installEnterpriseApplication(udid, "", manifest)
+}
 
-	// sign plist
-	sd, err := pkcs7.NewSignedData(buf)
+// installEnterpriseApplication runs InstallEnterpriseApplication. If commandUUID is not empty, the backend must be a CommandUUIDSender, and the command is sent with commandUUID
+func (m *MDM) installEnterpriseApplication(udid, commandUUID string, manifest *macospkg.Manifest) (string, error) {
+	var err error
+	id := commandUUID
+	if commandUUID != "" {
+		err = m.backend.(CommandUUIDSender).InstallEnterpriseApplicationWithUUID(udid, commandUUID, manifest)
+	} else {
+		id, err = m.backend.InstallEnterpriseApplication(udid, manifest)
+	}
 	if err != nil {
-		return fmt.Errorf("could not init pkcs7: %w", err)
+		return "", fmt.Errorf("could not execute InstallEnterpriseApplication command: %w", err)
 	}
 
-	if err := sd.AddSigner(m.cert, m.key, pkcs7.SignerInfoConfig{}); err != nil {
-		return fmt.Errorf("could not add pkcs7 signer: %w", err)
-	}
+	return id, nil
+}
 
-	signed, err := sd.Finish()
-	if err != nil {
-		return fmt.Errorf("could not marshal pkcs7: %w", err)
+// send sends a command of requestType with install, records it in the latest delivery to the device with serial, and returns the command UUID.
+// If the backend is a CommandUUIDSender, the command is recorded before it's sent, and install is called with its command UUID.
+// Otherwise install is called with an empty command UUID and returns the backend's
+func (m *MDM) send(serial, requestType string, install func(commandUUID string) (string, error)) (string, error) {
+	if _, ok := m.backend.(CommandUUIDSender); !ok {
+		id, err := install("")
+		if err != nil {
+			return "", err
+		}
+		m.tracker.Add(serial, requestType, id, m.now())
+		return id, nil
 	}
 
-	// execute command
-	cmd := map[string]interface{}{
-		"request_type": "InstallProfile",
-		"udid":         udid,
-		"payload":      signed,
+	commandUUID, err := newCommandUUID()
+	if err != nil {
+		return "", err
 	}
 
-	if err = m.Command(cmd); err != nil {
-		return fmt.Errorf("could not execute InstallProfile command: %w", err)
+	m.tracker.Add(serial, requestType, commandUUID, m.now())
+	if _, err = install(commandUUID); err != nil {
+		m.tracker.Remove(serial, commandUUID)
+		return "", err
 	}
 
-	return nil
+	return commandUUID, nil
 }
 
-// InstallEnterpriseApplication runs the InstallEnterpriseApplication command with the given udid and manifest
-func (m *MDM) InstallEnterpriseApplication(udid string, manifest *macospkg.Manifest) error {
-	cmd := map[string]interface{}{
-		"request_type": "InstallEnterpriseApplication",
-		"udid":         udid,
-		"manifest":     manifest,
-	}
-
-	if err := m.Command(cmd); err != nil {
-		return fmt.Errorf("could not execute InstallEnterpriseApplication command: %w", err)
-	}
+// Delivery returns the status of the latest delivery to the device with serial. If no delivery is found, ErrNotFound is returned
+func (m *MDM) Delivery(serial string) (*Delivery, error) {
+	return m.tracker.Delivery(serial)
+}
 
-	return nil
+// HandleWebhook updates the status of delivered commands from MDM webhook acknowledge events
+func (m *MDM) HandleWebhook(event *WebhookEvent) error {
+	return m.tracker.HandleWebhook(event)
 }
@@ -0,0 +1,709 @@
+package mdm
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mrand "math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/groob/plist"
+	macospkg "github.com/korylprince/go-macos-pkg"
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/internal/testutil/certtest"
+	"github.com/korylprince/ls-relay-cert/profile"
+)
+
+// testIdentity writes a PKCS #12 signing identity to a temporary directory and returns its path
+func testIdentity(t *testing.T) string {
+	t.Helper()
+	opts := certtest.Options()
+	opts.KeyType = cert.KeyTypeRSA2048
+
+	c, key, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate identity: %v", err)
+	}
+
+	buf, err := cert.EncodePKCS12(nil, key, c, nil, "")
+	if err != nil {
+		t.Fatalf("could not encode identity: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "identity.p12")
+	if err = os.WriteFile(path, buf, 0600); err != nil {
+		t.Fatalf("could not write identity: %v", err)
+	}
+
+	return path
+}
+
+// testBackend is a PackageInstaller and DeviceCertificateSource that records the pkgs and profiles sent to the device with serial SERIAL and UDID UDID
+type testBackend struct {
+	mu       sync.Mutex
+	pkgs     [][]byte
+	profiles [][]byte
+	// deviceCerts are the device identity certificates by UDID
+	deviceCerts map[string]*x509.Certificate
+	// acknowledge, if set, is called with each command's ID before it's returned
+	acknowledge func(id string)
+}
+
+func (b *testBackend) LookupDevice(serial string) (string, error) {
+	if serial != "SERIAL" {
+		return "", ErrNotFound
+	}
+	return "UDID", nil
+}
+
+func (b *testBackend) InstallProfile(udid string, profile []byte) (string, error) {
+	b.mu.Lock()
+	b.profiles = append(b.profiles, profile)
+	id := fmt.Sprintf("PROFILE-%d", len(b.profiles))
+	b.mu.Unlock()
+
+	if b.acknowledge != nil {
+		b.acknowledge(id)
+	}
+	return id, nil
+}
+
+func (b *testBackend) InstallEnterpriseApplication(udid string, manifest *macospkg.Manifest) (string, error) {
+	return "", errors.New("not supported")
+}
+
+func (b *testBackend) CheckDeviceCertificates() error {
+	return nil
+}
+
+func (b *testBackend) DeviceCertificate(udid string) (*x509.Certificate, error) {
+	c, ok := b.deviceCerts[udid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return c, nil
+}
+
+func (b *testBackend) InstallPackage(udid string, pkg []byte) (string, error) {
+	b.mu.Lock()
+	b.pkgs = append(b.pkgs, pkg)
+	id := fmt.Sprintf("PKG-%d", len(b.pkgs))
+	b.mu.Unlock()
+
+	if b.acknowledge != nil {
+		b.acknowledge(id)
+	}
+	return id, nil
+}
+
+// testMDM returns an MDM for config that sends commands to a testBackend. Pkgs contain only the postinstall script, since pkgs can only be generated with xar
+func testMDM(t *testing.T, config *Config) (*MDM, *testBackend) {
+	t.Helper()
+	b := new(testBackend)
+	config.SigningIdentity = testIdentity(t)
+	config.CacheSize = 10
+	config.CacheTTL = time.Minute
+	config.Backend = b
+	if config.Config == nil {
+		config.Config = testConfig()
+	}
+
+	m, err := New(config)
+	if err != nil {
+		t.Fatalf("could not create mdm: %v", err)
+	}
+	m.pkg = func(identifier string, script []byte) ([]byte, error) { return script, nil }
+
+	return m, b
+}
+
+func TestNewRand(t *testing.T) {
+	m, _ := testMDM(t, &Config{Rand: mrand.New(mrand.NewSource(1))})
+
+	// the FileStore uses Rand, as in TestFileStore
+	path, err := m.Put("payload.pkg", []byte("data"))
+	if err != nil {
+		t.Fatalf("could not put file: %v", err)
+	}
+	if want := "Uv38ByGCZU8WP18PmmIdcg/payload.pkg"; path != want {
+		t.Errorf("want path %q, got %q", want, path)
+	}
+}
+
+func TestDeliverLeaf(t *testing.T) {
+	opts := certtest.Options()
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	issuer := &cert.Issuer{Cert: ca, Key: caKey}
+
+	// device CA keys aren't kept, so a leaf can't be signed by the installed device CA
+	for _, config := range []*Config{{CertOptions: opts, CA: issuer, IssueDeviceCA: true}, {CertOptions: opts, CA: issuer}} {
+		m, b := testMDM(t, config)
+		if err = m.DeliverLeaf("SERIAL"); !errors.Is(err, ErrLeafDeviceCA) {
+			t.Errorf("want ErrLeafDeviceCA, got %v", err)
+		}
+		if len(b.pkgs) != 0 || len(b.profiles) != 0 {
+			t.Errorf("want nothing delivered, got %d pkgs and %d profiles", len(b.pkgs), len(b.profiles))
+		}
+	}
+
+	m, _ := testMDM(t, &Config{CertOptions: opts})
+	if err = m.DeliverLeaf("SERIAL"); !errors.Is(err, ErrNoCA) {
+		t.Errorf("want ErrNoCA, got %v", err)
+	}
+
+	m, b := testMDM(t, &Config{CertOptions: opts, CA: issuer, SharedCA: true})
+	if err = m.DeliverLeaf("SERIAL"); err != nil {
+		t.Fatalf("could not deliver leaf: %v", err)
+	}
+	if len(b.pkgs) != 1 || len(b.profiles) != 0 {
+		t.Fatalf("want 1 pkg and no profiles, got %d pkgs and %d profiles", len(b.pkgs), len(b.profiles))
+	}
+
+	// the script contains localhost.pem, then chain.pem
+	certs, err := cert.ParseCertificatesPEM(b.pkgs[0])
+	if err != nil {
+		t.Fatalf("could not parse certificates: %v", err)
+	}
+	if len(certs) != 3 {
+		t.Fatalf("want localhost and 2 chain certificates, got %d certificates", len(certs))
+	}
+	if err = certs[0].CheckSignatureFrom(ca); err != nil {
+		t.Errorf("localhost certificate is not signed by the CA: %v", err)
+	}
+	if bytes.Contains(b.pkgs[0], []byte("cat > /usr/local/etc/ca_key.pem")) {
+		t.Error("want leaf-only script without the CA key")
+	}
+	// a CA key pair left by a previous delivery is removed
+	if !bytes.Contains(b.pkgs[0], []byte("rm -f /usr/local/etc/ca.pem /usr/local/etc/ca_key.pem")) {
+		t.Error("want leaf-only script to remove the CA key pair")
+	}
+
+	// the CA key pair is removed by the payload, so it's delivered again with DeliverCAKey
+	m, b = testMDM(t, &Config{CertOptions: opts, CA: issuer, DeliverCAKey: true})
+	if err = m.DeliverLeaf("SERIAL"); err != nil {
+		t.Fatalf("could not deliver leaf: %v", err)
+	}
+	caKeyPEM, err := cert.MarshalPrivateKeyPEM(caKey)
+	if err != nil {
+		t.Fatalf("could not encode CA key: %v", err)
+	}
+	if len(b.pkgs) != 1 || !bytes.Contains(b.pkgs[0], caKeyPEM) {
+		t.Error("want leaf-only script with the CA key")
+	}
+
+	if err = m.DeliverLeaf("OTHER"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+}
+
+func TestDeliverCAKey(t *testing.T) {
+	opts := certtest.Options()
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	issuer := &cert.Issuer{Cert: ca, Key: caKey}
+	caKeyPEM, err := cert.MarshalPrivateKeyPEM(caKey)
+	if err != nil {
+		t.Fatalf("could not encode CA key: %v", err)
+	}
+
+	for _, test := range []struct {
+		name         string
+		deliverCAKey bool
+	}{
+		{"device CA by default", false},
+		{"CA key opt-in", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{CertOptions: opts, CA: issuer, DeliverCAKey: test.deliverCAKey}
+			m, b := testMDM(t, config)
+			if m.issueDeviceCA == test.deliverCAKey {
+				t.Errorf("want device CA %t, got %t", !test.deliverCAKey, m.issueDeviceCA)
+			}
+			// the default mode isn't written to the caller's config, so it can be reused
+			if config.IssueDeviceCA {
+				t.Error("want IssueDeviceCA unchanged")
+			}
+
+			if err := m.Deliver("SERIAL"); err != nil {
+				t.Fatalf("could not deliver: %v", err)
+			}
+			if len(b.pkgs) != 1 {
+				t.Fatalf("want 1 pkg, got %d", len(b.pkgs))
+			}
+
+			if got := bytes.Contains(b.pkgs[0], caKeyPEM); got != test.deliverCAKey {
+				t.Errorf("want CA key delivered %t, got %t", test.deliverCAKey, got)
+			}
+
+			delivered, err := cert.ParseCertificatePEM(b.pkgs[0])
+			if err != nil {
+				t.Fatalf("could not parse delivered CA: %v", err)
+			}
+			if got := delivered.Equal(ca); got != test.deliverCAKey {
+				t.Errorf("want CA delivered %t, got %t", test.deliverCAKey, got)
+			}
+		})
+	}
+
+	if _, err = New(&Config{CA: issuer, DeliverCAKey: true, SharedCA: true}); err == nil {
+		t.Error("want error with DeliverCAKey and SharedCA, got nil")
+	}
+}
+
+func TestNewSharedCA(t *testing.T) {
+	opts := certtest.Options()
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	issuer := &cert.Issuer{Cert: ca, Key: caKey}
+
+	config := &Config{
+		SigningIdentity: testIdentity(t),
+		CacheSize:       10,
+		CacheTTL:        time.Minute,
+		CertOptions:     opts,
+		SharedCA:        true,
+		Config:          testConfig(),
+	}
+
+	if _, err = New(config); !errors.Is(err, ErrNoCA) {
+		t.Errorf("want ErrNoCA without CA, got %v", err)
+	}
+
+	config.CA = issuer
+	config.IssueDeviceCA = true
+	if _, err = New(config); err == nil {
+		t.Error("want error with IssueDeviceCA, got nil")
+	}
+
+	config.IssueDeviceCA = false
+	m, err := New(config)
+	if err != nil {
+		t.Fatalf("could not create mdm: %v", err)
+	}
+
+	if certs := m.sharedProfile.Certificates(); len(certs) != 1 || !bytes.Equal(certs[0].PayloadContent, ca.Raw) {
+		t.Error("shared profile does not contain the CA")
+	}
+
+	payload, err := GenerateLeaf(m.CA, m.CertOptions)
+	if err != nil {
+		t.Fatalf("could not generate leaf: %v", err)
+	}
+	if payload.CA != "" || payload.CAKey != "" {
+		t.Error("want leaf payload without CA key pair")
+	}
+}
+
+func TestDeliverSharedCA(t *testing.T) {
+	opts := certtest.Options()
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+
+	m, b := testMDM(t, &Config{CertOptions: opts, CA: &cert.Issuer{Cert: ca, Key: caKey}, SharedCA: true})
+
+	for i := 0; i < 2; i++ {
+		if err = m.Deliver("SERIAL"); err != nil {
+			t.Fatalf("could not deliver: %v", err)
+		}
+	}
+	if len(b.pkgs) != 2 || len(b.profiles) != 2 {
+		t.Fatalf("want 2 pkgs and 2 profiles, got %d pkgs and %d profiles", len(b.pkgs), len(b.profiles))
+	}
+
+	for idx, script := range b.pkgs {
+		if bytes.Contains(script, []byte("cat > /usr/local/etc/ca_key.pem")) || bytes.Count(script, []byte("PRIVATE KEY-----")) != 2 {
+			t.Errorf("pkg %d: want only the localhost private key, got:\n%s", idx, script)
+		}
+
+		// the script contains localhost.pem, then chain.pem
+		certs, err := cert.ParseCertificatesPEM(script)
+		if err != nil {
+			t.Fatalf("pkg %d: could not parse certificates: %v", idx, err)
+		}
+		if len(certs) != 3 || !certs[0].Equal(certs[1]) || !certs[2].Equal(ca) {
+			t.Fatalf("pkg %d: want localhost and chain to the CA, got %d certificates", idx, len(certs))
+		}
+		if err = certs[0].CheckSignatureFrom(ca); err != nil {
+			t.Errorf("pkg %d: localhost certificate is not signed by the CA: %v", idx, err)
+		}
+	}
+
+	for idx, buf := range b.profiles {
+		prof, err := profile.Parse(buf)
+		if err != nil {
+			t.Fatalf("profile %d: could not parse: %v", idx, err)
+		}
+		if root := prof.Root(); root == nil || !root.Equal(ca) {
+			t.Errorf("profile %d: want shared CA as root", idx)
+		}
+	}
+}
+
+func TestNewRequiresCA(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		config  *Config
+		wantErr bool
+	}{
+		{"self-signed", &Config{}, false},
+		{"IssueDeviceCA", &Config{IssueDeviceCA: true}, true},
+		{"DeliverCAKey", &Config{DeliverCAKey: true}, true},
+		{"SharedCA", &Config{SharedCA: true}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.SigningIdentity = testIdentity(t)
+			test.config.CacheSize = 10
+			test.config.CacheTTL = time.Minute
+			test.config.CertOptions = certtest.Options()
+			test.config.Config = testConfig()
+
+			_, err := New(test.config)
+			if test.wantErr && !errors.Is(err, ErrNoCA) {
+				t.Errorf("want ErrNoCA, got %v", err)
+			} else if !test.wantErr && err != nil {
+				t.Errorf("want no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNewEncryptProfiles(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		backend Backend
+		wantErr bool
+	}{
+		{"default micromdm", nil, true},
+		{"jamf", &Jamf{}, true},
+		{"nanomdm without storage directory", &NanoMDM{}, true},
+		{"nanomdm", &NanoMDM{StorageDir: t.TempDir()}, false},
+		{"device certificate source", new(testBackend), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := New(&Config{
+				SigningIdentity: testIdentity(t),
+				CacheSize:       10,
+				CacheTTL:        time.Minute,
+				CertOptions:     certtest.Options(),
+				Config:          testConfig(),
+				Backend:         test.backend,
+				EncryptProfiles: true,
+			})
+			if test.wantErr && err == nil {
+				t.Error("want error, got nil")
+			} else if !test.wantErr && err != nil {
+				t.Errorf("want no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNewCRL(t *testing.T) {
+	opts := certtest.Options()
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	issuer := &cert.Issuer{Cert: ca, Key: caKey}
+	opts.CRLDistributionPoints = []string{"https://example.com/v1/lsrelay/crl"}
+
+	// a CA without the CRL signing key usage can't sign the CRL
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "No CRL Sign"},
+		NotBefore:             ca.NotBefore,
+		NotAfter:              ca.NotAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(opts.Rand, tmpl, tmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("could not create CA: %v", err)
+	}
+	noCRLSign, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse CA: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		config  *Config
+		wantErr bool
+	}{
+		{"no CA", &Config{}, true},
+		{"IssueDeviceCA without CA", &Config{IssueDeviceCA: true}, true},
+		{"CA without CRLSign", &Config{CA: &cert.Issuer{Cert: noCRLSign, Key: caKey}}, true},
+		{"DeliverCAKey", &Config{CA: issuer, DeliverCAKey: true}, true},
+		{"default IssueDeviceCA", &Config{CA: issuer}, false},
+		{"SharedCA", &Config{CA: issuer, SharedCA: true}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.SigningIdentity = testIdentity(t)
+			test.config.CacheSize = 10
+			test.config.CacheTTL = time.Minute
+			test.config.CertOptions = opts
+			test.config.Config = testConfig()
+
+			_, err := New(test.config)
+			if test.wantErr && err == nil {
+				t.Error("want error, got nil")
+			} else if !test.wantErr && err != nil {
+				t.Errorf("want no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestInstallProfileEncrypted(t *testing.T) {
+	opts := cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeRSA2048
+
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	device, deviceKey, err := cert.GenerateLocalhost(ca, caKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate device certificate: %v", err)
+	}
+
+	m, b := testMDM(t, &Config{EncryptProfiles: true})
+	b.deviceCerts = map[string]*x509.Certificate{"UDID": device}
+
+	prof, err := profile.New(m.Config.Config, ca)
+	if err != nil {
+		t.Fatalf("could not generate profile: %v", err)
+	}
+
+	if _, err = m.InstallProfile("OTHER", prof); err == nil {
+		t.Error("want error for device without certificate, got nil")
+	}
+
+	if _, err = m.InstallProfile("UDID", prof); err != nil {
+		t.Fatalf("could not install profile: %v", err)
+	}
+	if len(b.profiles) != 1 {
+		t.Fatalf("want 1 profile, got %d", len(b.profiles))
+	}
+
+	parsed, err := profile.Parse(b.profiles[0])
+	if err != nil {
+		t.Fatalf("could not parse profile: %v", err)
+	}
+	if !parsed.Signer.Equal(m.cert) {
+		t.Errorf("want signer %s, got %s", m.cert.Subject, parsed.Signer.Subject)
+	}
+	if len(parsed.PayloadContent) != 0 {
+		t.Fatal("want encrypted payloads")
+	}
+
+	if err = parsed.Decrypt(device, deviceKey); err != nil {
+		t.Fatalf("could not decrypt profile: %v", err)
+	}
+	if root := parsed.Root(); root == nil || !root.Equal(ca) {
+		t.Errorf("want root %s, got %v", ca.Subject, root)
+	}
+}
+
+func TestDeliverRollBack(t *testing.T) {
+	m, b := testMDM(t, &Config{CertOptions: certtest.Options(), AckTimeout: 10 * time.Millisecond})
+
+	// the pkg isn't acknowledged, so a pkg that restores the previous files is queued after it
+	if err := m.Deliver("SERIAL"); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("want ErrTimeout, got %v", err)
+	}
+	if len(b.pkgs) != 2 || len(b.profiles) != 0 {
+		t.Fatalf("want 2 pkgs and no profiles, got %d pkgs and %d profiles", len(b.pkgs), len(b.profiles))
+	}
+
+	certs, err := cert.ParseCertificatesPEM(b.pkgs[0])
+	if err != nil {
+		t.Fatalf("could not parse certificates: %v", err)
+	}
+	// the script contains ca.pem, then localhost.pem
+	localhost := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs[1].Raw})
+	if !bytes.Contains(b.pkgs[1], []byte(sha256Hex(string(localhost)))) || !bytes.Contains(b.pkgs[1], []byte(".ls-relay-cert.bak/$f\" \"/usr/local/etc/$f\"")) {
+		t.Errorf("want cleanup script restoring the files replaced by the delivery, got:\n%s", b.pkgs[1])
+	}
+
+	d, err := m.Delivery("SERIAL")
+	if err != nil {
+		t.Fatalf("could not get delivery: %v", err)
+	}
+	if d.Status != StatusRolledBack || len(d.Commands) != 2 || d.Commands[1].CommandUUID != "PKG-2" {
+		t.Errorf("unexpected delivery: %+v", d)
+	}
+
+	// commands are acknowledged before the backend returns, and the profile fails
+	b.acknowledge = func(id string) {
+		status := "Acknowledged"
+		if strings.HasPrefix(id, "PROFILE") {
+			status = "Error"
+		}
+		if err := m.HandleWebhook(&WebhookEvent{AcknowledgeEvent: &AcknowledgeEvent{UDID: "UDID", Status: status, CommandUUID: id, RawPayload: []byte("<dict></dict>")}}); err != nil {
+			t.Errorf("could not handle webhook: %v", err)
+		}
+	}
+	if err = m.Deliver("SERIAL"); err == nil || !strings.Contains(err.Error(), "InstallProfile command PROFILE-1 failed") {
+		t.Fatalf("want profile error, got %v", err)
+	}
+	if len(b.pkgs) != 4 || len(b.profiles) != 1 {
+		t.Fatalf("want 4 pkgs and 1 profile, got %d pkgs and %d profiles", len(b.pkgs), len(b.profiles))
+	}
+	if d, err = m.Delivery("SERIAL"); err != nil || d.Status != StatusRolledBack || len(d.Commands) != 3 || d.Commands[0].Status != StatusAcknowledged {
+		t.Errorf("unexpected delivery: %+v, %v", d, err)
+	}
+
+	// the profile isn't acknowledged, and may still be installed, so the delivery isn't rolled back
+	b.acknowledge = func(id string) {
+		if strings.HasPrefix(id, "PKG") {
+			if err := m.HandleWebhook(&WebhookEvent{AcknowledgeEvent: &AcknowledgeEvent{UDID: "UDID", Status: "Acknowledged", CommandUUID: id}}); err != nil {
+				t.Errorf("could not handle webhook: %v", err)
+			}
+		}
+	}
+	if err = m.Deliver("SERIAL"); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("want ErrTimeout, got %v", err)
+	}
+	// the backup is removed after the profile is installed
+	if len(b.pkgs) != 6 || len(b.profiles) != 2 {
+		t.Fatalf("want 6 pkgs and 2 profiles, got %d pkgs and %d profiles", len(b.pkgs), len(b.profiles))
+	}
+	if !bytes.Contains(b.pkgs[5], []byte("rm -rf /usr/local/etc/.ls-relay-cert.bak")) {
+		t.Errorf("want script removing the backup, got:\n%s", b.pkgs[5])
+	}
+	if d, err = m.Delivery("SERIAL"); err != nil || d.Status != StatusError || len(d.Commands) != 3 {
+		t.Errorf("unexpected delivery: %+v, %v", d, err)
+	}
+
+	// all commands are acknowledged, so the backup is removed
+	b.acknowledge = func(id string) {
+		if err := m.HandleWebhook(&WebhookEvent{AcknowledgeEvent: &AcknowledgeEvent{UDID: "UDID", Status: "Acknowledged", CommandUUID: id}}); err != nil {
+			t.Errorf("could not handle webhook: %v", err)
+		}
+	}
+	if err = m.Deliver("SERIAL"); err != nil {
+		t.Fatalf("could not deliver: %v", err)
+	}
+	if len(b.pkgs) != 8 || len(b.profiles) != 3 {
+		t.Fatalf("want 8 pkgs and 3 profiles, got %d pkgs and %d profiles", len(b.pkgs), len(b.profiles))
+	}
+	if !bytes.Contains(b.pkgs[6], []byte("install -d -m 700 /usr/local/etc/.ls-relay-cert.bak")) || !bytes.Contains(b.pkgs[7], []byte("rm -rf /usr/local/etc/.ls-relay-cert.bak")) {
+		t.Errorf("want payload with a backup, then script removing it, got:\n%s\n%s", b.pkgs[6], b.pkgs[7])
+	}
+	if d, err = m.Delivery("SERIAL"); err != nil || d.Status != StatusAcknowledged || len(d.Commands) != 3 {
+		t.Errorf("unexpected delivery: %+v, %v", d, err)
+	}
+}
+
+func TestDeliverWithoutBackup(t *testing.T) {
+	// without AckTimeout, a delivery can't be rolled back, so no backup is made
+	m, b := testMDM(t, &Config{CertOptions: certtest.Options()})
+	if err := m.Deliver("SERIAL"); err != nil {
+		t.Fatalf("could not deliver: %v", err)
+	}
+	if len(b.pkgs) != 1 || len(b.profiles) != 1 {
+		t.Fatalf("want 1 pkg and 1 profile, got %d pkgs and %d profiles", len(b.pkgs), len(b.profiles))
+	}
+	if bytes.Contains(b.pkgs[0], []byte("install -d -m 700 /usr/local/etc/.ls-relay-cert.bak")) {
+		t.Errorf("want payload without a backup, got:\n%s", b.pkgs[0])
+	}
+}
+
+func TestDeliverCommandUUIDSender(t *testing.T) {
+	var (
+		m        *MDM
+		mu       sync.Mutex
+		requests []string
+		// fail is the request type whose command fails to enqueue
+		fail string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("could not read request: %v", err)
+		}
+		cmd := new(struct {
+			CommandUUID string
+			Command     struct{ RequestType string }
+		})
+		if err = plist.Unmarshal(buf, cmd); err != nil {
+			t.Errorf("could not decode command: %v", err)
+		}
+
+		mu.Lock()
+		requests = append(requests, cmd.Command.RequestType)
+		mu.Unlock()
+
+		if cmd.Command.RequestType == fail {
+			w.Write([]byte(`{"command_error": "failed"}`))
+			return
+		}
+
+		// the command is acknowledged before the enqueue request returns
+		if err = m.HandleWebhook(&WebhookEvent{AcknowledgeEvent: &AcknowledgeEvent{UDID: "UDID", Status: "Acknowledged", CommandUUID: cmd.CommandUUID}}); err != nil {
+			t.Errorf("could not handle webhook: %v", err)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	devices, err := NewDeviceDirectory("")
+	if err != nil {
+		t.Fatalf("could not create device directory: %v", err)
+	}
+	if err = devices.Set("SERIAL", "UDID"); err != nil {
+		t.Fatalf("could not set device: %v", err)
+	}
+
+	m, _ = testMDM(t, &Config{CertOptions: certtest.Options(), AckTimeout: time.Second, CachePrefix: "https://example.com"})
+	m.backend = &NanoMDM{Prefix: srv.URL, Token: "token", Devices: devices}
+
+	// commands are tracked before they're sent, so acknowledgments aren't kept for unknown commands
+	if err = m.Deliver("SERIAL"); err != nil {
+		t.Fatalf("could not deliver: %v", err)
+	}
+	d, err := m.Delivery("SERIAL")
+	if err != nil || d.Status != StatusAcknowledged || len(d.Commands) != 3 {
+		t.Errorf("unexpected delivery: %+v, %v", d, err)
+	}
+	if m.tracker.unmatchedOrder.Len() != 0 {
+		t.Errorf("want no unmatched acknowledgments, got %d", m.tracker.unmatchedOrder.Len())
+	}
+
+	// a command that couldn't be enqueued isn't recorded
+	fail = RequestTypeInstallProfile
+	if err = m.Deliver("SERIAL"); err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Fatalf("want enqueue error, got %v", err)
+	}
+	if d, err = m.Delivery("SERIAL"); err != nil || d.Status != StatusRolledBack || len(d.Commands) != 2 || d.Commands[1].RequestType != RequestTypeInstallEnterpriseApplication {
+		t.Errorf("unexpected delivery: %+v, %v", d, err)
+	}
+	if len(requests) != 6 {
+		t.Errorf("want 6 requests, got %d: %v", len(requests), requests)
+	}
+}
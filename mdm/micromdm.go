@@ -0,0 +1,122 @@
+package mdm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	macospkg "github.com/korylprince/go-macos-pkg"
+)
+
+// MicroMDM is a MicroMDM server
+type MicroMDM struct {
+	// Prefix is the URL of the server, e.g. https://micromdm.example.com
+	Prefix string
+	// Token is the API key
+	Token string
+}
+
+// LookupDevice implements DeviceLookup
+func (m *MicroMDM) LookupDevice(serial string) (string, error) {
+	type response struct {
+		Devices []struct {
+			UDID string `json:"udid"`
+		} `json:"devices"`
+		Error string `json:"error"`
+	}
+
+	q := map[string]interface{}{
+		"filter_serial": []string{serial},
+	}
+
+	j, err := json.Marshal(q)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal query: %w", err)
+	}
+
+	r, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/devices", m.Prefix), bytes.NewBuffer(j))
+	if err != nil {
+		return "", fmt.Errorf("could not create request: %w", err)
+	}
+	r.SetBasicAuth("micromdm", m.Token)
+
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return "", fmt.Errorf("could not complete request: %w", err)
+	}
+	defer res.Body.Close()
+
+	resp := new(response)
+	dec := json.NewDecoder(res.Body)
+	if err = dec.Decode(resp); err != nil {
+		return "", fmt.Errorf("could not parse response: %w", err)
+	}
+
+	if resp.Error != "" {
+		return "", fmt.Errorf("could not query devices: %s", resp.Error)
+	}
+
+	if len(resp.Devices) != 1 || resp.Devices[0].UDID == "" {
+		return "", ErrNotFound
+	}
+
+	return resp.Devices[0].UDID, nil
+}
+
+// Command runs the MDM cmd and returns the command UUID
+func (m *MicroMDM) Command(cmd map[string]interface{}) (string, error) {
+	type response struct {
+		Payload struct {
+			CommandUUID string `json:"command_uuid"`
+		} `json:"payload"`
+		Error string `json:"error"`
+	}
+
+	j, err := json.Marshal(cmd)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal command: %w", err)
+	}
+
+	r, err := http.NewRequest("POST", fmt.Sprintf("%s/v1/commands", m.Prefix), bytes.NewBuffer(j))
+	if err != nil {
+		return "", fmt.Errorf("could not create request: %w", err)
+	}
+	r.SetBasicAuth("micromdm", m.Token)
+
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return "", fmt.Errorf("could not complete request: %w", err)
+	}
+	defer res.Body.Close()
+
+	resp := new(response)
+	dec := json.NewDecoder(res.Body)
+	if err = dec.Decode(resp); err != nil {
+		return "", fmt.Errorf("could not parse response: %w", err)
+	}
+
+	if resp.Error != "" {
+		return "", fmt.Errorf("could not execute command: %s", resp.Error)
+	}
+
+	return resp.Payload.CommandUUID, nil
+}
+
+// InstallProfile implements Backend
+func (m *MicroMDM) InstallProfile(udid string, profile []byte) (string, error) {
+	return m.Command(map[string]interface{}{
+		"request_type": "InstallProfile",
+		"udid":         udid,
+		"payload":      profile,
+	})
+}
+
+// InstallEnterpriseApplication implements Backend
+func (m *MicroMDM) InstallEnterpriseApplication(udid string, manifest *macospkg.Manifest) (string, error) {
+	return m.Command(map[string]interface{}{
+		"request_type": "InstallEnterpriseApplication",
+		"udid":         udid,
+		"manifest":     manifest,
+	})
+}
@@ -0,0 +1,177 @@
+package mdm
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/groob/plist"
+	macospkg "github.com/korylprince/go-macos-pkg"
+	"github.com/korylprince/ls-relay-cert/cert"
+)
+
+// NanoMDM is a NanoMDM server. NanoMDM doesn't keep a device inventory, so Devices is used to look up devices
+type NanoMDM struct {
+	// Prefix is the URL of the server, e.g. https://nanomdm.example.com
+	Prefix string
+	// Token is the API key
+	Token string
+	// Devices looks up devices by serial number, e.g. a DeviceDirectory populated by NanoMDM's webhook
+	Devices DeviceLookup
+	// StorageDir is the path of NanoMDM's file storage (the -storage-dsn of -storage file), used to read device identity certificates.
+	// The file storage saves each enrollment's identity certificate as <StorageDir>/<enrollment ID>/identity_cert.pem, and a device's enrollment ID is its UDID.
+	// NanoMDM's other storage backends don't save certificates as files, so device certificates aren't available with them, and StorageDir must be on the same host
+	StorageDir string
+}
+
+// nanoCommand is a raw MDM command
+type nanoCommand struct {
+	Command     interface{}
+	CommandUUID string
+}
+
+type installProfileCommand struct {
+	RequestType string
+	Payload     []byte
+}
+
+type installEnterpriseApplicationCommand struct {
+	RequestType string
+	Manifest    *macospkg.Manifest
+}
+
+// LookupDevice implements DeviceLookup
+func (m *NanoMDM) LookupDevice(serial string) (string, error) {
+	return m.Devices.LookupDevice(serial)
+}
+
+// newCommandUUID returns a random command UUID
+func newCommandUUID() (string, error) {
+	u, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("could not generate command uuid: %w", err)
+	}
+	return strings.ToUpper(u.String()), nil
+}
+
+// Enqueue enqueues the MDM command for the device with udid and returns the command UUID. command is a struct value marshaled as the command's Command dictionary.
+// Errors sending the push notification are ignored, since the device will receive the command on its next check-in
+func (m *NanoMDM) Enqueue(udid string, command interface{}) (string, error) {
+	commandUUID, err := newCommandUUID()
+	if err != nil {
+		return "", err
+	}
+
+	if err = m.EnqueueWithUUID(udid, commandUUID, command); err != nil {
+		return "", err
+	}
+
+	return commandUUID, nil
+}
+
+// EnqueueWithUUID is Enqueue with commandUUID as the command UUID
+func (m *NanoMDM) EnqueueWithUUID(udid, commandUUID string, command interface{}) error {
+	type response struct {
+		Status map[string]*struct {
+			CommandError string `json:"command_error"`
+		} `json:"status"`
+		CommandError string `json:"command_error"`
+	}
+
+	buf, err := plist.Marshal(&nanoCommand{Command: command, CommandUUID: commandUUID})
+	if err != nil {
+		return fmt.Errorf("could not marshal command: %w", err)
+	}
+
+	r, err := http.NewRequest("PUT", fmt.Sprintf("%s/v1/enqueue/%s", m.Prefix, url.PathEscape(udid)), bytes.NewBuffer(buf))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	r.SetBasicAuth("nanomdm", m.Token)
+
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return fmt.Errorf("could not complete request: %w", err)
+	}
+	defer res.Body.Close()
+
+	resp := new(response)
+	dec := json.NewDecoder(res.Body)
+	if err = dec.Decode(resp); err != nil {
+		return fmt.Errorf("could not parse response (%s): %w", res.Status, err)
+	}
+
+	if resp.CommandError != "" {
+		return fmt.Errorf("could not execute command: %s", resp.CommandError)
+	}
+	if status := resp.Status[udid]; status != nil && status.CommandError != "" {
+		return fmt.Errorf("could not execute command: %s", status.CommandError)
+	}
+
+	return nil
+}
+
+// InstallProfile implements Backend
+func (m *NanoMDM) InstallProfile(udid string, profile []byte) (string, error) {
+	return m.Enqueue(udid, installProfileCommand{RequestType: "InstallProfile", Payload: profile})
+}
+
+// InstallEnterpriseApplication implements Backend
+func (m *NanoMDM) InstallEnterpriseApplication(udid string, manifest *macospkg.Manifest) (string, error) {
+	return m.Enqueue(udid, installEnterpriseApplicationCommand{RequestType: "InstallEnterpriseApplication", Manifest: manifest})
+}
+
+// InstallProfileWithUUID implements CommandUUIDSender
+func (m *NanoMDM) InstallProfileWithUUID(udid, commandUUID string, profile []byte) error {
+	return m.EnqueueWithUUID(udid, commandUUID, installProfileCommand{RequestType: "InstallProfile", Payload: profile})
+}
+
+// InstallEnterpriseApplicationWithUUID implements CommandUUIDSender
+func (m *NanoMDM) InstallEnterpriseApplicationWithUUID(udid, commandUUID string, manifest *macospkg.Manifest) error {
+	return m.EnqueueWithUUID(udid, commandUUID, installEnterpriseApplicationCommand{RequestType: "InstallEnterpriseApplication", Manifest: manifest})
+}
+
+// CheckDeviceCertificates implements DeviceCertificateSource. StorageDir must be set to an existing directory
+func (m *NanoMDM) CheckDeviceCertificates() error {
+	if m.StorageDir == "" {
+		return errors.New("device certificates require the nanomdm storage directory")
+	}
+	info, err := os.Stat(m.StorageDir)
+	if err != nil {
+		return fmt.Errorf("could not read nanomdm storage directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("nanomdm storage directory is not a directory: %s", m.StorageDir)
+	}
+	return nil
+}
+
+// DeviceCertificate implements DeviceCertificateSource. The certificate is read from the identity_cert.pem NanoMDM's file storage saves for each enrollment
+func (m *NanoMDM) DeviceCertificate(udid string) (*x509.Certificate, error) {
+	if m.StorageDir == "" {
+		return nil, errors.New("device certificates require the nanomdm storage directory")
+	}
+	if udid == "" || filepath.Base(udid) != udid {
+		return nil, fmt.Errorf("invalid udid: %q", udid)
+	}
+
+	buf, err := os.ReadFile(filepath.Join(m.StorageDir, udid, "identity_cert.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read device certificate: %w", err)
+	}
+
+	c, err := cert.ParseCertificatePEM(buf)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse device certificate: %w", err)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,64 @@
+package mdm
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/korylprince/ls-relay-cert/cert"
+)
+
+// ONCCertificate is a certificate in an Open Network Configuration
+type ONCCertificate struct {
+	// GUID uniquely identifies the certificate. Importing a certificate with the same GUID replaces it
+	GUID string `json:"GUID"`
+	// Type is "Authority" for CA certificates
+	Type string `json:"Type"`
+	// X509 is the base64 encoded DER certificate
+	X509 string `json:"X509"`
+	// TrustBits is set to ["Web"] to trust the certificate for TLS server authentication
+	TrustBits []string `json:"TrustBits,omitempty"`
+}
+
+// ONCConfiguration is an Open Network Configuration, as imported by Google Admin for ChromeOS devices
+type ONCConfiguration struct {
+	Type                  string            `json:"Type"`
+	Certificates          []*ONCCertificate `json:"Certificates"`
+	NetworkConfigurations []interface{}     `json:"NetworkConfigurations"`
+}
+
+// ONC returns an Open Network Configuration (.onc) containing the root of payload's chain as a trusted Authority certificate,
+// and any intermediate CAs as untrusted Authority certificates. GUIDs are derived from the certificates, so reimporting the same CA replaces it
+func ONC(payload *Payload) ([]byte, error) {
+	// chain is ordered from the localhost certificate to the root
+	chain, err := cert.ParseCertificatesPEM([]byte(payload.Chain))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse chain: %w", err)
+	}
+	if len(chain) < 2 {
+		return nil, errors.New("chain does not contain a CA")
+	}
+
+	config := &ONCConfiguration{Type: "UnencryptedConfiguration", NetworkConfigurations: []interface{}{}}
+	for idx := len(chain) - 1; idx > 0; idx-- {
+		c := &ONCCertificate{
+			GUID: "{" + strings.ToUpper(uuid.NewSHA1(uuid.NameSpaceOID, chain[idx].Raw).String()) + "}",
+			Type: "Authority",
+			X509: base64.StdEncoding.EncodeToString(chain[idx].Raw),
+		}
+		if idx == len(chain)-1 {
+			c.TrustBits = []string{"Web"}
+		}
+		config.Certificates = append(config.Certificates, c)
+	}
+
+	buf, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal ONC: %w", err)
+	}
+
+	return buf, nil
+}
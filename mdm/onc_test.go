@@ -0,0 +1,32 @@
+package mdm
+
+import (
+	"testing"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/internal/testutil"
+	"github.com/korylprince/ls-relay-cert/internal/testutil/certtest"
+)
+
+func TestONCGolden(t *testing.T) {
+	opts := certtest.Options()
+	root, rootKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate root: %v", err)
+	}
+
+	_, payload, err := GeneratePKIFromSubCA(&cert.Issuer{Cert: root, Key: rootKey}, opts, testConfig())
+	if err != nil {
+		t.Fatalf("could not generate pki: %v", err)
+	}
+
+	buf, err := ONC(payload)
+	if err != nil {
+		t.Fatalf("could not generate ONC: %v", err)
+	}
+	testutil.Golden(t, "onc.golden", buf)
+
+	if _, err = ONC(&Payload{Chain: payload.Localhost}); err == nil {
+		t.Error("want error for chain without CA, got nil")
+	}
+}
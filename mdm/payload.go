@@ -2,9 +2,12 @@ package mdm
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/x509"
 	_ "embed"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"text/template"
 
@@ -17,79 +20,441 @@ import (
 var payloadScript string
 var tmplPostinstall = template.Must(template.New("payload.sh").Parse(payloadScript))
 
-// GeneratePKI generates and returns a certificate root profile and PEM encoded CA and localhost key pairs with the given CA validity in years
-func GeneratePKI(years int, config *profile.Config) (*profile.TopLevelProfile, *Payload, error) {
-	c, ck, err := cert.GenerateCA(years)
+//go:embed cleanup.sh
+var cleanupScript string
+var tmplCleanup = template.Must(template.New("cleanup.sh").Funcs(template.FuncMap{"sha256": sha256Hex}).Parse(cleanupScript))
+
+//go:embed removebackup.sh
+var removeBackupScript string
+var tmplRemoveBackup = template.Must(template.New("removebackup.sh").Funcs(template.FuncMap{"sha256": sha256Hex}).Parse(removeBackupScript))
+
+// sha256Hex returns the hex encoded SHA-256 hash of s, as printed by shasum -a 256
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// pkg identifiers
+const (
+	pkgIdentifier             = "com.github.korylprince.macos-device-attestation"
+	cleanupPkgIdentifier      = "com.github.korylprince.ls-relay-cert.cleanup"
+	removeBackupPkgIdentifier = "com.github.korylprince.ls-relay-cert.remove-backup"
+)
+
+// GeneratePKI generates and returns a certificate root profile and PEM encoded CA and localhost key pairs with the given certificate options
+func GeneratePKI(opts *cert.Options, config *profile.Config) (*profile.TopLevelProfile, *Payload, error) {
+	c, ck, err := cert.GenerateCA(opts)
 	if err != nil {
 		return nil, nil, fmt.Errorf("could not generate CA key pair: %w", err)
 	}
 
-	lh, lhk, err := cert.GenerateLocalhost(c, ck)
+	prof, payload, err := GeneratePKIFromCA(&cert.Issuer{Cert: c, Key: ck}, withoutCRL(opts), config)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload.Issued = append(payload.Issued, c)
+
+	return prof, payload, nil
+}
+
+// GeneratePKIFromSubCA generates a new device CA key pair signed by issuer, and returns a certificate root profile and PEM encoded CA and localhost key pairs with the given certificate options.
+// The profile contains the issuer's root and intermediates, and the new CA as an intermediate.
+// The device CA can't issue other CAs and is name constrained to the localhost names (see cert.GenerateDeviceCA), but its key can still issue certificates for those names that are trusted by every device that trusts the issuer
+func GeneratePKIFromSubCA(issuer *cert.Issuer, opts *cert.Options, config *profile.Config) (*profile.TopLevelProfile, *Payload, error) {
+	c, ck, err := cert.GenerateDeviceCA(issuer.Cert, issuer.Key, opts)
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not generate localhost key pair: %w", err)
+		return nil, nil, fmt.Errorf("could not generate CA key pair: %w", err)
 	}
 
-	profile, err := profile.New(config, c)
+	prof, payload, err := GeneratePKIFromCA(issuer.SubIssuer(c, ck), withoutCRL(opts), config)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload.Issued = append(payload.Issued, c)
+
+	return prof, payload, nil
+}
+
+// withoutCRL returns a copy of opts without CRL distribution points, for certificates that aren't issued by a CA that publishes a CRL
+func withoutCRL(opts *cert.Options) *cert.Options {
+	if opts == nil {
+		return nil
+	}
+	o := *opts
+	o.CRLDistributionPoints = nil
+	return &o
+}
+
+// GeneratePKIFromCA returns a certificate root profile for the given issuer's chain, and PEM encoded CA and newly generated localhost key pairs with the given certificate options.
+// The payload contains the issuer's private key, so any device it's installed on can issue certificates trusted by every device that trusts the issuer
+func GeneratePKIFromCA(issuer *cert.Issuer, opts *cert.Options, config *profile.Config) (*profile.TopLevelProfile, *Payload, error) {
+	payload, err := GenerateLeaf(issuer, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = payload.addCA(issuer); err != nil {
+		return nil, nil, err
+	}
+
+	profile, err := profile.New(config, issuer.Root(), issuer.Intermediates()...)
 	if err != nil {
 		return nil, nil, fmt.Errorf("could not generate profile: %w", err)
 	}
 
-	return profile, &Payload{
-		CA:           string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})),
-		CAKey:        string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(ck)})),
+	return profile, payload, nil
+}
+
+// GenerateLeaf generates and returns a PEM encoded localhost key pair with the given certificate options, signed by the given issuer.
+// The localhost certificate uses the CA's Organization. The returned Payload only contains the localhost key pair and chain
+func GenerateLeaf(issuer *cert.Issuer, opts *cert.Options) (*Payload, error) {
+	leafOpts := cert.DefaultOptions()
+	if opts != nil {
+		o := *opts
+		leafOpts = &o
+	}
+	leafOpts.Subject = issuer.Cert.Subject
+
+	lh, lhk, err := cert.GenerateLocalhost(issuer.Cert, issuer.Key, leafOpts)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate localhost key pair: %w", err)
+	}
+
+	lhkPEM, err := cert.MarshalPrivateKeyPEM(lhk)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode localhost key: %w", err)
+	}
+
+	return &Payload{
 		Localhost:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: lh.Raw})),
-		LocalhostKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(lhk)})),
+		LocalhostKey: string(lhkPEM),
+		Chain:        string(cert.ChainPEM(append([]*x509.Certificate{lh, issuer.Cert}, issuer.Chain...)...)),
+		Issued:       []*x509.Certificate{lh},
 	}, nil
 }
 
-// Payload is the script payload containing CA and localhost key pairs
+// Payload is the script payload containing CA and localhost key pairs. If CA is empty, only the localhost key pair and chain are installed, and any installed CA key pair is removed
 type Payload struct {
 	CA           string
 	CAKey        string
 	Localhost    string
 	LocalhostKey string
+	// Chain is the full certificate chain from the localhost certificate to the root
+	Chain string
+	// Issued are the certificates newly issued for the payload
+	Issued []*x509.Certificate
+	// Backup, if true, makes the postinstall script back up the files it replaces, so the delivery can be rolled back
+	Backup bool
+}
+
+// addCA adds issuer's PEM encoded certificate and private key to p
+func (p *Payload) addCA(issuer *cert.Issuer) error {
+	ckPEM, err := cert.MarshalPrivateKeyPEM(issuer.Key)
+	if err != nil {
+		return fmt.Errorf("could not encode CA key: %w", err)
+	}
+
+	p.CA = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuer.Cert.Raw}))
+	p.CAKey = string(ckPEM)
+	return nil
+}
+
+// postinstall returns the rendered postinstall script that installs payload
+func postinstall(payload *Payload) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := tmplPostinstall.Execute(buf, payload); err != nil {
+		return nil, fmt.Errorf("could not generate postinstall script: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// cleanup returns the rendered postinstall script that restores the files replaced by payload
+func cleanup(payload *Payload) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := tmplCleanup.Execute(buf, payload); err != nil {
+		return nil, fmt.Errorf("could not generate cleanup script: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// removeBackup returns the rendered postinstall script that removes the backup made by payload
+func removeBackup(payload *Payload) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := tmplRemoveBackup.Execute(buf, payload); err != nil {
+		return nil, fmt.Errorf("could not generate remove backup script: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// deliverPayload installs a pkg containing payload on the device with udid, records it in the latest delivery to the device with serial, and returns the command UUID
+func (m *MDM) deliverPayload(serial, udid string, payload *Payload) (string, error) {
+	script, err := postinstall(payload)
+	if err != nil {
+		return "", err
+	}
+	return m.deliverScript(serial, udid, pkgIdentifier, script)
+}
+
+// buildPkg generates and signs a pkg with identifier and the postinstall script
+func (m *MDM) buildPkg(identifier string, script []byte) ([]byte, error) {
+	pkg, err := macospkg.GeneratePkg(identifier, "1.0.0", script)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate payload pkg: %w", err)
+	}
+
+	signedPkg, err := macospkg.SignPkg(pkg, m.cert, m.key)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign payload pkg: %w", err)
+	}
+
+	return signedPkg, nil
+}
+
+// deliverScript generates, signs, and stores a pkg with identifier and the postinstall script, installs it on the device with udid,
+// records it in the latest delivery to the device with serial, and returns the command UUID.
+// If the backend is a PackageInstaller, the pkg is passed to it instead of stored, and the command UUID may be empty
+func (m *MDM) deliverScript(serial, udid, identifier string, script []byte) (string, error) {
+	signedPkg, err := m.pkg(identifier, script)
+	if err != nil {
+		return "", err
+	}
+
+	if installer, ok := m.backend.(PackageInstaller); ok {
+		id, err := installer.InstallPackage(udid, signedPkg)
+		if err != nil {
+			return "", fmt.Errorf("could not install payload: %w", err)
+		}
+		m.tracker.Add(serial, RequestTypeInstallEnterpriseApplication, id, m.now())
+		return id, nil
+	}
+
+	fsPath, err := m.Put("payload.pkg", signedPkg)
+	if err != nil {
+		return "", fmt.Errorf("could not store payload pkg: %w", err)
+	}
+
+	manifest := macospkg.NewManifest(signedPkg, fmt.Sprintf("%s/%s", m.CachePrefix, fsPath), macospkg.ManifestHashSHA256)
+
+	return m.send(serial, RequestTypeInstallEnterpriseApplication, func(commandUUID string) (string, error) {
+		id, err := m.installEnterpriseApplication(udid, commandUUID, manifest)
+		if err != nil {
+			return "", fmt.Errorf("could not install payload: %w", err)
+		}
+		return id, nil
+	})
 }
 
-// Deliver generates the necessary profile and certificates and delivers them to the device with serial
+// Deliver generates the necessary profile and certificates and delivers them to the device with serial.
+// If a CA is configured, it's used to sign a new per-device CA, or delivered itself if DeliverCAKey is true.
+// If SharedCA is true, the shared profile and a new localhost key pair are delivered
 func (m *MDM) Deliver(serial string) error {
 	udid, err := m.SerialToUDID(serial)
 	if err != nil {
 		return fmt.Errorf("could not get UDID: %w", err)
 	}
 
-	profile, payload, err := GeneratePKI(10, m.Config.Config)
+	return m.deliver(serial, udid, nil)
+}
+
+// deliver runs Deliver for the device with serial and udid. If started is not nil, it's called with the tracked delivery once it's started
+func (m *MDM) deliver(serial, udid string, started func(*Delivery)) error {
+	var (
+		profile *profile.TopLevelProfile
+		payload *Payload
+		err     error
+	)
+	switch {
+	case m.CA != nil && m.SharedCA:
+		profile = m.sharedProfile
+		payload, err = GenerateLeaf(m.CA, m.CertOptions)
+	case m.CA != nil && m.DeliverCAKey:
+		profile, payload, err = GeneratePKIFromCA(m.CA, m.CertOptions, m.Config.Config)
+	case m.CA != nil:
+		profile, payload, err = GeneratePKIFromSubCA(m.CA, m.CertOptions, m.Config.Config)
+	default:
+		profile, payload, err = GeneratePKI(m.CertOptions, m.Config.Config)
+	}
 	if err != nil {
 		return fmt.Errorf("could not generate pki: %w", err)
 	}
+	payload.Backup = m.canRollBack()
 
-	postinstall := new(bytes.Buffer)
-	if err := tmplPostinstall.Execute(postinstall, payload); err != nil {
-		return fmt.Errorf("could not generate postinstall script: %w", err)
+	if err = m.registry.Add(serial, m.now(), m.CA, payload.Issued...); err != nil {
+		return fmt.Errorf("could not record certificates: %w", err)
 	}
 
-	pkg, err := macospkg.GeneratePkg("com.github.korylprince.macos-device-attestation", "1.0.0", postinstall.Bytes())
+	d := m.tracker.Start(serial, udid, m.now())
+	if started != nil {
+		started(d)
+	}
+
+	id, err := m.deliverPayload(serial, udid, payload)
 	if err != nil {
-		return fmt.Errorf("could not generate payload pkg: %w", err)
+		m.tracker.Fail(serial, err)
+		return err
 	}
 
-	signedPkg, err := macospkg.SignPkg(pkg, m.cert, m.key)
+	if err = m.wait(id); err != nil {
+		return m.rollBack(serial, udid, payload, fmt.Errorf("could not install payload: %w", err))
+	}
+
+	id, err = m.send(serial, RequestTypeInstallProfile, func(commandUUID string) (string, error) {
+		return m.installProfile(udid, commandUUID, profile)
+	})
 	if err != nil {
-		return fmt.Errorf("could not sign payload pkg: %w", err)
+		return m.rollBack(serial, udid, payload, fmt.Errorf("could not install profile: %w", err))
 	}
 
-	fsPath, err := m.Put("payload.pkg", signedPkg)
+	if err = m.wait(id); err != nil {
+		err = fmt.Errorf("could not install profile: %w", err)
+		// the profile may still be installed after the timeout, replacing the device's previous profile, so the payload is kept
+		if errors.Is(err, ErrTimeout) {
+			if rerr := m.removeBackup(serial, udid, payload); rerr != nil {
+				err = fmt.Errorf("%w (%v)", err, rerr)
+			}
+			m.tracker.Fail(serial, err)
+			return err
+		}
+		return m.rollBack(serial, udid, payload, err)
+	}
+
+	if err = m.removeBackup(serial, udid, payload); err != nil {
+		m.tracker.Fail(serial, err)
+		return err
+	}
+
+	return nil
+}
+
+// canRollBack returns true if a failed delivery can be rolled back. Command failures are only reported if AckTimeout is set.
+// Jamf Pro policies can't be tracked, and installing another pkg deletes the delivery's pending policy
+func (m *MDM) canRollBack() bool {
+	_, jamf := m.backend.(*Jamf)
+	return m.AckTimeout != 0 && !jamf
+}
+
+// removeBackup installs a pkg that removes the backup made by payload on the device with udid, if it made one.
+// The pkg is queued after the delivery's commands, so it runs after the profile is installed
+func (m *MDM) removeBackup(serial, udid string, payload *Payload) error {
+	if !payload.Backup {
+		return nil
+	}
+
+	script, err := removeBackup(payload)
 	if err != nil {
-		return fmt.Errorf("could not store payload pkg: %w", err)
+		return err
 	}
 
-	manifest := macospkg.NewManifest(signedPkg, fmt.Sprintf("%s/%s", m.CachePrefix, fsPath), macospkg.ManifestHashSHA256)
+	if _, err = m.deliverScript(serial, udid, removeBackupPkgIdentifier, script); err != nil {
+		return fmt.Errorf("could not remove backup: %w", err)
+	}
+
+	return nil
+}
+
+// wait waits for the command to be acknowledged if AckTimeout is set. An error is returned if the command fails or isn't acknowledged before AckTimeout.
+// Commands without a command UUID can't be waited for
+func (m *MDM) wait(commandUUID string) error {
+	if m.AckTimeout == 0 || commandUUID == "" {
+		return nil
+	}
+
+	status, err := m.tracker.Wait(commandUUID, m.AckTimeout)
+	if err != nil {
+		return err
+	}
+
+	return status.Err()
+}
+
+// rollBack installs a pkg that restores the files replaced by payload on the device with udid, and returns err.
+// The device's profile isn't changed, since the delivery's profile was never installed. The pkg is queued after the delivery's pkg,
+// so it runs even if a timed out pkg is eventually installed, and it only changes files if payload's files are still installed
+func (m *MDM) rollBack(serial, udid string, payload *Payload, err error) error {
+	// without a backup, the replaced files can't be restored
+	if !payload.Backup {
+		m.tracker.Fail(serial, err)
+		return err
+	}
+
+	script, rerr := cleanup(payload)
+	if rerr == nil {
+		_, rerr = m.deliverScript(serial, udid, cleanupPkgIdentifier, script)
+	}
+	if rerr != nil {
+		err = fmt.Errorf("%w (could not remove payload: %v)", err, rerr)
+		m.tracker.Fail(serial, err)
+		return err
+	}
+
+	m.tracker.RollBack(serial, err)
+	return err
+}
 
-	if err = m.InstallEnterpriseApplication(udid, manifest); err != nil {
-		return fmt.Errorf("could not install payload: %w", err)
+// CanDeliverLeaf returns nil if DeliverLeaf is supported by the configuration, which requires a CA with SharedCA or DeliverCAKey.
+// Neither default configuration supports it: if no CA is configured, ErrNoCA is returned, and if IssueDeviceCA is true, ErrLeafDeviceCA is returned,
+// since the device's CA key isn't kept. A full delivery is needed instead
+func (m *MDM) CanDeliverLeaf() error {
+	if m.CA == nil {
+		return ErrNoCA
+	}
+	if m.issueDeviceCA {
+		return ErrLeafDeviceCA
+	}
+	return nil
+}
+
+// DeliverLeaf generates a new localhost key pair signed by CA and delivers only it to the device with serial. The installed root profile is not modified.
+// If CanDeliverLeaf returns an error, it's returned
+func (m *MDM) DeliverLeaf(serial string) error {
+	if err := m.CanDeliverLeaf(); err != nil {
+		return err
+	}
+
+	udid, err := m.SerialToUDID(serial)
+	if err != nil {
+		return fmt.Errorf("could not get UDID: %w", err)
+	}
+
+	return m.deliverLeaf(serial, udid, nil)
+}
+
+// deliverLeaf runs DeliverLeaf for the device with serial and udid. If started is not nil, it's called with the tracked delivery once it's started
+func (m *MDM) deliverLeaf(serial, udid string, started func(*Delivery)) error {
+	if err := m.CanDeliverLeaf(); err != nil {
+		return err
+	}
+
+	payload, err := GenerateLeaf(m.CA, m.CertOptions)
+	if err != nil {
+		return fmt.Errorf("could not generate leaf: %w", err)
+	}
+	// the payload removes any installed CA key pair, so the delivered CA key is installed again
+	if m.DeliverCAKey {
+		if err = payload.addCA(m.CA); err != nil {
+			return err
+		}
+	}
+
+	if err = m.registry.Add(serial, m.now(), m.CA, payload.Issued...); err != nil {
+		return fmt.Errorf("could not record certificates: %w", err)
+	}
+
+	d := m.tracker.Start(serial, udid, m.now())
+	if started != nil {
+		started(d)
+	}
+
+	id, err := m.deliverPayload(serial, udid, payload)
+	if err != nil {
+		m.tracker.Fail(serial, err)
+		return err
 	}
 
-	if err = m.InstallProfile(udid, profile); err != nil {
-		return fmt.Errorf("could not install profile: %w", err)
+	if err = m.wait(id); err != nil {
+		err = fmt.Errorf("could not install payload: %w", err)
+		m.tracker.Fail(serial, err)
+		return err
 	}
 
 	return nil
@@ -0,0 +1,72 @@
+<#
+.SYNOPSIS
+Installs the Lightspeed Relay Smart Agent certificates
+.PARAMETER Path
+The directory the certificate and key files are written to
+#>
+#Requires -RunAsAdministrator
+param(
+    [string]$Path = "$env:ProgramData\ls-relay-cert"
+)
+
+$ErrorActionPreference = "Stop"
+
+New-Item -ItemType Directory -Path $Path -Force | Out-Null
+
+# lock down the directory before writing any files, since new files inherit its ACL. Only SYSTEM and Administrators can access
+# the directory and its files, and Users can only list it
+$admins = New-Object System.Security.Principal.SecurityIdentifier("S-1-5-32-544")
+$users = New-Object System.Security.Principal.SecurityIdentifier("S-1-5-32-545")
+$acl = New-Object System.Security.AccessControl.DirectorySecurity
+$acl.SetOwner($admins)
+$acl.SetAccessRuleProtection($true, $false)
+foreach ($sid in "S-1-5-18", "S-1-5-32-544") {
+    $id = New-Object System.Security.Principal.SecurityIdentifier($sid)
+    $acl.AddAccessRule((New-Object System.Security.AccessControl.FileSystemAccessRule($id, "FullControl", "ContainerInherit, ObjectInherit", "None", "Allow")))
+}
+$acl.AddAccessRule((New-Object System.Security.AccessControl.FileSystemAccessRule($users, "ReadAndExecute", "Allow")))
+Set-Acl -Path $Path -AclObject $acl
+
+# replace the file with a new one, which only SYSTEM and Administrators can open until it's written.
+# Unless restricted, Users are then allowed to read it
+function Write-File([string]$Name, [string]$Content, [switch]$Restricted) {
+    $file = Join-Path $Path $Name
+    Remove-Item -Path $file -Force -ErrorAction SilentlyContinue
+    New-Item -ItemType File -Path $file | Out-Null
+    [System.IO.File]::WriteAllText($file, $Content)
+    if (-not $Restricted) {
+        $fileAcl = Get-Acl -Path $file
+        $fileAcl.AddAccessRule((New-Object System.Security.AccessControl.FileSystemAccessRule($users, "Read", "Allow")))
+        Set-Acl -Path $file -AclObject $fileAcl
+    }
+}
+
+# trust the root certificate for all users
+$root = [System.Security.Cryptography.X509Certificates.X509Certificate2]::new([Convert]::FromBase64String("{{.Root}}"))
+$store = New-Object System.Security.Cryptography.X509Certificates.X509Store("Root", "LocalMachine")
+$store.Open("ReadWrite")
+$store.Add($root)
+$store.Close()
+{{- if .CA}}
+
+Write-File "ca.pem" @'
+{{.CA -}}
+'@
+
+Write-File "ca_key.pem" -Restricted @'
+{{.CAKey -}}
+'@
+{{- end}}
+
+Write-File "localhost.pem" @'
+{{.Localhost -}}
+'@
+
+Write-File "localhost_key.pem" -Restricted @'
+{{.LocalhostKey -}}
+'@
+
+# chain.pem contains the full chain from localhost.pem to the root
+Write-File "chain.pem" @'
+{{.Chain -}}
+'@
@@ -2,14 +2,33 @@
 
 mkdir -p /usr/local/etc
 
-# use rm/install to create a new file with locked off permissions so a timing attack can't get a read handle
-rm -f /usr/local/etc/ca.pem /usr/local/etc/ca_key.pem /usr/local/etc/localhost.pem /usr/local/etc/localhost_key.pem
+# remove any backup left by a previous delivery
+rm -rf /usr/local/etc/.ls-relay-cert.bak
+{{- if .Backup}}
+
+# back up the files this payload replaces, so they can be restored if the delivery is rolled back. The backup is removed once the delivery succeeds
+install -d -m 700 /usr/local/etc/.ls-relay-cert.bak
+for f in ca.pem ca_key.pem localhost.pem localhost_key.pem chain.pem; do
+    if [ -f "/usr/local/etc/$f" ]; then
+        cp -p "/usr/local/etc/$f" "/usr/local/etc/.ls-relay-cert.bak/$f"
+    fi
+done
+{{- end}}
+
+# use rm/install to create a new file with locked off permissions so a timing attack can't get a read handle.
+# The CA files are always removed, so a CA key pair from a previous delivery isn't left behind by a payload without one
+rm -f /usr/local/etc/ca.pem /usr/local/etc/ca_key.pem
+{{- if .CA}}
 install -m 644 /dev/null /usr/local/etc/ca.pem
 install -m 600 /dev/null /usr/local/etc/ca_key.pem
+{{- end}}
+rm -f /usr/local/etc/localhost.pem /usr/local/etc/localhost_key.pem /usr/local/etc/chain.pem
 install -m 644 /dev/null /usr/local/etc/localhost.pem
 install -m 600 /dev/null /usr/local/etc/localhost_key.pem
+install -m 644 /dev/null /usr/local/etc/chain.pem
 
 # cat/heredoc doesn't leak process arguments
+{{- if .CA}}
 cat > /usr/local/etc/ca.pem << EOM
 {{.CA -}}
 EOM
@@ -17,6 +36,7 @@ EOM
 cat > /usr/local/etc/ca_key.pem << EOM
 {{.CAKey -}}
 EOM
+{{- end}}
 
 cat > /usr/local/etc/localhost.pem << EOM
 {{.Localhost -}}
@@ -25,3 +45,8 @@ EOM
 cat > /usr/local/etc/localhost_key.pem << EOM
 {{.LocalhostKey -}}
 EOM
+
+# chain.pem contains the full chain from localhost.pem to the root
+cat > /usr/local/etc/chain.pem << EOM
+{{.Chain -}}
+EOM
@@ -0,0 +1,110 @@
+package mdm
+
+import (
+	mrand "math/rand"
+	"testing"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/internal/testutil"
+	"github.com/korylprince/ls-relay-cert/internal/testutil/certtest"
+	"github.com/korylprince/ls-relay-cert/profile"
+)
+
+func testConfig() *profile.Config {
+	return &profile.Config{
+		PayloadVersion:      1,
+		PayloadIdentifier:   "com.github.korylprince.ls-relay-cert",
+		PayloadUUID:         "00000000-0000-0000-0000-000000000000",
+		PayloadOrganization: "Lightspeed Systems",
+		Rand:                mrand.New(mrand.NewSource(2)),
+	}
+}
+
+func TestPostinstallGolden(t *testing.T) {
+	opts := certtest.Options()
+	_, payload, err := GeneratePKI(opts, testConfig())
+	if err != nil {
+		t.Fatalf("could not generate pki: %v", err)
+	}
+	payload.Backup = true
+
+	script, err := postinstall(payload)
+	if err != nil {
+		t.Fatalf("could not render postinstall: %v", err)
+	}
+	testutil.Golden(t, "postinstall.golden", script)
+
+	ca, err := cert.ParseCertificatePEM([]byte(payload.CA))
+	if err != nil {
+		t.Fatalf("could not parse CA: %v", err)
+	}
+	caKey, err := cert.ParsePrivateKeyPEM([]byte(payload.CAKey))
+	if err != nil {
+		t.Fatalf("could not parse CA key: %v", err)
+	}
+
+	leaf, err := GenerateLeaf(&cert.Issuer{Cert: ca, Key: caKey}, opts)
+	if err != nil {
+		t.Fatalf("could not generate leaf: %v", err)
+	}
+
+	script, err = postinstall(leaf)
+	if err != nil {
+		t.Fatalf("could not render postinstall: %v", err)
+	}
+	testutil.Golden(t, "postinstall_leaf.golden", script)
+}
+
+func TestCleanupGolden(t *testing.T) {
+	_, payload, err := GeneratePKI(certtest.Options(), testConfig())
+	if err != nil {
+		t.Fatalf("could not generate pki: %v", err)
+	}
+
+	script, err := cleanup(payload)
+	if err != nil {
+		t.Fatalf("could not render cleanup: %v", err)
+	}
+	testutil.Golden(t, "cleanup.golden", script)
+
+	leaf := &Payload{Localhost: payload.Localhost, LocalhostKey: payload.LocalhostKey, Chain: payload.Chain}
+	script, err = cleanup(leaf)
+	if err != nil {
+		t.Fatalf("could not render cleanup: %v", err)
+	}
+	testutil.Golden(t, "cleanup_leaf.golden", script)
+}
+
+func TestRemoveBackupGolden(t *testing.T) {
+	_, payload, err := GeneratePKI(certtest.Options(), testConfig())
+	if err != nil {
+		t.Fatalf("could not generate pki: %v", err)
+	}
+
+	script, err := removeBackup(payload)
+	if err != nil {
+		t.Fatalf("could not render remove backup: %v", err)
+	}
+	testutil.Golden(t, "removebackup.golden", script)
+}
+
+func TestWindowsInstallScriptGolden(t *testing.T) {
+	opts := certtest.Options()
+	_, payload, err := GeneratePKI(opts, testConfig())
+	if err != nil {
+		t.Fatalf("could not generate pki: %v", err)
+	}
+
+	script, err := WindowsInstallScript(payload)
+	if err != nil {
+		t.Fatalf("could not render install script: %v", err)
+	}
+	testutil.Golden(t, "install.ps1.golden", script)
+
+	leaf := &Payload{Localhost: payload.Localhost, LocalhostKey: payload.LocalhostKey, Chain: payload.Chain}
+	script, err = WindowsInstallScript(leaf)
+	if err != nil {
+		t.Fatalf("could not render install script: %v", err)
+	}
+	testutil.Golden(t, "install_leaf.ps1.golden", script)
+}
@@ -0,0 +1,232 @@
+package mdm
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+)
+
+// Record is a certificate issued to a device. Only what's needed to list the certificate in the CRL is kept
+type Record struct {
+	// Device is the serial number of the device the certificate was delivered to
+	Device string `json:"device"`
+	// Serial is the hex encoded certificate serial number
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"not_after"`
+	// Revocable is true if the certificate was issued by the configured CA, so it's listed in the CRL once it's revoked
+	Revocable bool       `json:"revocable"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// SerialNumber parses and returns the certificate serial number
+func (r *Record) SerialNumber() (*big.Int, error) {
+	n, ok := new(big.Int).SetString(r.Serial, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid serial: %q", r.Serial)
+	}
+	return n, nil
+}
+
+// Registry records the certificates issued to devices until they expire or are superseded. If it was created with a path, records are persisted to it as JSON
+type Registry struct {
+	path    string
+	mu      sync.Mutex
+	records []*Record
+}
+
+// legacyRecord is a Record written by earlier versions, which also kept the DER encoded certificate
+type legacyRecord struct {
+	Record
+	Raw []byte `json:"raw"`
+}
+
+// NewRegistry returns a new Registry persisted to the JSON file at path, loading any existing records.
+// Records written by earlier versions are revocable if their certificate is signed by ca, which may be nil. If path is empty, records are only kept in memory
+func NewRegistry(path string, ca *cert.Issuer) (*Registry, error) {
+	r := &Registry{path: path}
+	if path == "" {
+		return r, nil
+	}
+
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read registry: %w", err)
+	}
+
+	var records []*legacyRecord
+	if err = json.Unmarshal(buf, &records); err != nil {
+		return nil, fmt.Errorf("could not parse registry: %w", err)
+	}
+
+	for _, rec := range records {
+		if len(rec.Raw) > 0 && ca != nil {
+			c, err := x509.ParseCertificate(rec.Raw)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse recorded certificate %s: %w", rec.Serial, err)
+			}
+			rec.Revocable = c.CheckSignatureFrom(ca.Cert) == nil
+		}
+		r.records = append(r.records, &rec.Record)
+	}
+
+	return r, nil
+}
+
+// save writes records to the registry file, then replaces the registry's records with them, so they're unchanged if the write fails. mu must be held
+func (r *Registry) save(records []*Record) error {
+	if r.path != "" {
+		buf, err := json.MarshalIndent(records, "", "\t")
+		if err != nil {
+			return fmt.Errorf("could not marshal registry: %w", err)
+		}
+
+		if err = writeFileAtomic(r.path, buf); err != nil {
+			return fmt.Errorf("could not write registry: %w", err)
+		}
+	}
+
+	r.records = records
+	return nil
+}
+
+// prune returns a new slice of the records that haven't expired at now. Expired certificates aren't trusted, so they don't need to be kept or listed in the CRL
+func prune(records []*Record, now time.Time) []*Record {
+	pruned := make([]*Record, 0, len(records))
+	for _, rec := range records {
+		if !now.After(rec.NotAfter) {
+			pruned = append(pruned, rec)
+		}
+	}
+	return pruned
+}
+
+// supersede returns a new slice of records without device's unrevoked records from before its latest delivery.
+// The latest delivery's records are kept, since a delivery that's rolled back restores them. Revoked records are kept until they expire, since they're listed in the CRL
+func supersede(records []*Record, device string) []*Record {
+	var latest time.Time
+	for _, rec := range records {
+		if rec.Device == device && rec.IssuedAt.After(latest) {
+			latest = rec.IssuedAt
+		}
+	}
+
+	superseded := make([]*Record, 0, len(records))
+	for _, rec := range records {
+		if rec.Device != device || rec.RevokedAt != nil || !rec.IssuedAt.Before(latest) {
+			superseded = append(superseded, rec)
+		}
+	}
+	return superseded
+}
+
+// writeFileAtomic writes buf to a temporary file and renames it to path, so path is never partially written
+func writeFileAtomic(path string, buf []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Add records the certificates as issued to device at now, and removes records of expired and superseded certificates.
+// Certificates signed by ca are revocable. ca may be nil
+func (r *Registry) Add(device string, now time.Time, ca *cert.Issuer, certs ...*x509.Certificate) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	records := supersede(prune(r.records, now), device)
+	for _, c := range certs {
+		records = append(records, &Record{
+			Device:    device,
+			Serial:    fmt.Sprintf("%X", c.SerialNumber),
+			NotAfter:  c.NotAfter,
+			Revocable: ca != nil && c.CheckSignatureFrom(ca.Cert) == nil,
+			IssuedAt:  now,
+		})
+	}
+
+	return r.save(records)
+}
+
+// Records returns the certificates issued to device, or all certificates if device is empty
+func (r *Registry) Records(device string) []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var records []Record
+	for _, rec := range r.records {
+		if device == "" || rec.Device == device {
+			records = append(records, *rec)
+		}
+	}
+	return records
+}
+
+// Revoke marks all certificates issued to device as revoked at now and returns them, and removes records of expired certificates.
+// Certificates that are already revoked keep their original revocation time. If no unexpired certificates were issued to device, ErrNotFound is returned
+func (r *Registry) Revoke(device string, now time.Time) ([]Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var revoked []Record
+	records := prune(r.records, now)
+	for idx, rec := range records {
+		if rec.Device != device {
+			continue
+		}
+		// records are copied, so the registry isn't changed if the save fails
+		if rec.RevokedAt == nil {
+			c := *rec
+			t := now
+			c.RevokedAt = &t
+			records[idx] = &c
+		}
+		revoked = append(revoked, *records[idx])
+	}
+
+	if len(revoked) == 0 {
+		return nil, ErrNotFound
+	}
+
+	if err := r.save(records); err != nil {
+		return nil, err
+	}
+
+	return revoked, nil
+}
+
+// Revoked returns all revoked certificates
+func (r *Registry) Revoked() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var records []Record
+	for _, rec := range r.records {
+		if rec.RevokedAt != nil {
+			records = append(records, *rec)
+		}
+	}
+	return records
+}
@@ -0,0 +1,340 @@
+package mdm
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/internal/testutil/certtest"
+)
+
+func TestRegistry(t *testing.T) {
+	opts := certtest.Options()
+	ca, _, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "registry.json")
+	reg, err := NewRegistry(path, nil)
+	if err != nil {
+		t.Fatalf("could not create registry: %v", err)
+	}
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err = reg.Add("C02ABC", now, nil, ca); err != nil {
+		t.Fatalf("could not add certificate: %v", err)
+	}
+
+	if _, err = reg.Revoke("C02XYZ", now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound for unknown device, got %v", err)
+	}
+
+	revoked, err := reg.Revoke("C02ABC", now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("could not revoke: %v", err)
+	}
+	if len(revoked) != 1 || revoked[0].Serial != fmt.Sprintf("%X", ca.SerialNumber) || !revoked[0].RevokedAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("unexpected revoked records: %+v", revoked)
+	}
+
+	// reload from disk
+	reg, err = NewRegistry(path, nil)
+	if err != nil {
+		t.Fatalf("could not load registry: %v", err)
+	}
+
+	records := reg.Revoked()
+	if len(records) != 1 {
+		t.Fatalf("want 1 revoked record, got %d", len(records))
+	}
+	serial, err := records[0].SerialNumber()
+	if err != nil {
+		t.Fatalf("could not parse recorded serial: %v", err)
+	}
+	if serial.Cmp(ca.SerialNumber) != 0 || !records[0].NotAfter.Equal(ca.NotAfter) {
+		t.Errorf("recorded certificate does not match: %+v", records[0])
+	}
+	if records[0].Revocable {
+		t.Error("want certificate added without a CA not revocable")
+	}
+}
+
+func TestRegistryLegacy(t *testing.T) {
+	opts := certtest.Options()
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	lh, _, err := cert.GenerateLocalhost(ca, caKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate localhost: %v", err)
+	}
+
+	// earlier versions kept the DER encoded certificate instead of whether it's revocable
+	revokedAt := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	buf, err := json.Marshal([]map[string]interface{}{{
+		"device":     "C02ABC",
+		"serial":     fmt.Sprintf("%X", lh.SerialNumber),
+		"not_after":  lh.NotAfter,
+		"issued_at":  revokedAt,
+		"revoked_at": revokedAt,
+		"raw":        lh.Raw,
+	}})
+	if err != nil {
+		t.Fatalf("could not marshal registry: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "registry.json")
+	if err = os.WriteFile(path, buf, 0600); err != nil {
+		t.Fatalf("could not write registry: %v", err)
+	}
+
+	reg, err := NewRegistry(path, &cert.Issuer{Cert: ca, Key: caKey})
+	if err != nil {
+		t.Fatalf("could not load registry: %v", err)
+	}
+	if revoked := reg.Revoked(); len(revoked) != 1 || !revoked[0].Revocable {
+		t.Fatalf("want 1 revocable record, got %+v", revoked)
+	}
+
+	if err = reg.Add("C02XYZ", revokedAt, nil); err != nil {
+		t.Fatalf("could not save registry: %v", err)
+	}
+	if buf, err = os.ReadFile(path); err != nil {
+		t.Fatalf("could not read registry: %v", err)
+	}
+	if bytes.Contains(buf, []byte(`"raw"`)) {
+		t.Errorf("want certificates removed from saved registry, got:\n%s", buf)
+	}
+}
+
+func TestRegistrySupersede(t *testing.T) {
+	opts := certtest.Options()
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	issuer := &cert.Issuer{Cert: ca, Key: caKey}
+
+	var leaves []*x509.Certificate
+	for i := 0; i < 4; i++ {
+		lh, _, err := cert.GenerateLocalhost(ca, caKey, opts)
+		if err != nil {
+			t.Fatalf("could not generate localhost: %v", err)
+		}
+		leaves = append(leaves, lh)
+	}
+
+	reg, err := NewRegistry("", nil)
+	if err != nil {
+		t.Fatalf("could not create registry: %v", err)
+	}
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err = reg.Add("C02ABC", now, issuer, leaves[0]); err != nil {
+		t.Fatalf("could not add certificate: %v", err)
+	}
+	if _, err = reg.Revoke("C02ABC", now); err != nil {
+		t.Fatalf("could not revoke: %v", err)
+	}
+	for i, lh := range leaves[1:] {
+		if err = reg.Add("C02ABC", now.Add(time.Duration(i+1)*time.Hour), issuer, lh); err != nil {
+			t.Fatalf("could not add certificate: %v", err)
+		}
+	}
+	if err = reg.Add("C02XYZ", now, issuer, leaves[0]); err != nil {
+		t.Fatalf("could not add certificate: %v", err)
+	}
+
+	// the revoked record and the two latest deliveries are kept
+	var serials []string
+	for _, rec := range reg.Records("C02ABC") {
+		serials = append(serials, rec.Serial)
+		if !rec.Revocable {
+			t.Errorf("want record %s revocable", rec.Serial)
+		}
+	}
+	want := []string{fmt.Sprintf("%X", leaves[0].SerialNumber), fmt.Sprintf("%X", leaves[2].SerialNumber), fmt.Sprintf("%X", leaves[3].SerialNumber)}
+	if !reflect.DeepEqual(serials, want) {
+		t.Errorf("want records %v, got %v", want, serials)
+	}
+	if records := reg.Records("C02XYZ"); len(records) != 1 {
+		t.Errorf("want other device's record kept, got %d records", len(records))
+	}
+}
+
+func TestRegistryPrune(t *testing.T) {
+	opts := certtest.Options()
+	ca, _, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	opts.CAYears = 20
+	later, _, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+
+	reg, err := NewRegistry(filepath.Join(t.TempDir(), "registry.json"), nil)
+	if err != nil {
+		t.Fatalf("could not create registry: %v", err)
+	}
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err = reg.Add("C02ABC", now, nil, ca, later); err != nil {
+		t.Fatalf("could not add certificates: %v", err)
+	}
+
+	// records of expired certificates are removed
+	expired := ca.NotAfter.Add(time.Hour)
+	if err = reg.Add("C02XYZ", expired, nil); err != nil {
+		t.Fatalf("could not add certificates: %v", err)
+	}
+	if records := reg.Records(""); len(records) != 1 || records[0].Serial != fmt.Sprintf("%X", later.SerialNumber) {
+		t.Errorf("want only unexpired record, got %+v", records)
+	}
+
+	if _, err = reg.Revoke("C02ABC", later.NotAfter.Add(time.Hour)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound for expired certificates, got %v", err)
+	}
+}
+
+func TestRegistrySaveError(t *testing.T) {
+	ca, _, err := cert.GenerateCA(certtest.Options())
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "registry")
+	if err = os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("could not create directory: %v", err)
+	}
+	reg, err := NewRegistry(filepath.Join(dir, "registry.json"), nil)
+	if err != nil {
+		t.Fatalf("could not create registry: %v", err)
+	}
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err = reg.Add("C02ABC", now, nil, ca); err != nil {
+		t.Fatalf("could not add certificate: %v", err)
+	}
+
+	// the registry file can't be written, so the registry isn't changed
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatalf("could not remove directory: %v", err)
+	}
+
+	if _, err = reg.Revoke("C02ABC", now); err == nil {
+		t.Fatal("want error revoking, got nil")
+	}
+	if revoked := reg.Revoked(); len(revoked) != 0 {
+		t.Errorf("want no revoked records after failed save, got %d", len(revoked))
+	}
+
+	if err = reg.Add("C02XYZ", now, nil, ca); err == nil {
+		t.Fatal("want error adding, got nil")
+	}
+	if records := reg.Records(""); len(records) != 1 {
+		t.Errorf("want 1 record after failed save, got %d", len(records))
+	}
+}
+
+func TestCRL(t *testing.T) {
+	opts := certtest.Options()
+	opts.CRLDistributionPoints = []string{"http://example.com/v1/lsrelay/crl"}
+
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	issuer := &cert.Issuer{Cert: ca, Key: caKey}
+
+	reg, err := NewRegistry("", nil)
+	if err != nil {
+		t.Fatalf("could not create registry: %v", err)
+	}
+	m := &MDM{Config: &Config{CA: issuer, IssueDeviceCA: true, CertOptions: opts}, registry: reg, crl: new(crlCache), issueDeviceCA: true}
+
+	// per-device CA signed by the configured CA
+	_, subPayload, err := GeneratePKIFromSubCA(issuer, opts, testConfig())
+	if err != nil {
+		t.Fatalf("could not generate pki: %v", err)
+	}
+	if len(subPayload.Issued) != 2 {
+		t.Fatalf("want 2 issued certificates, got %d", len(subPayload.Issued))
+	}
+	subCA, lh := subPayload.Issued[1], subPayload.Issued[0]
+	if len(subCA.CRLDistributionPoints) != 1 || len(lh.CRLDistributionPoints) != 0 {
+		t.Errorf("want CRL distribution point only on the device CA, got %v and %v", subCA.CRLDistributionPoints, lh.CRLDistributionPoints)
+	}
+
+	// self-signed per-device CA, which can't be published
+	_, payload, err := GeneratePKI(opts, testConfig())
+	if err != nil {
+		t.Fatalf("could not generate pki: %v", err)
+	}
+
+	if err = reg.Add("C02ABC", m.now(), issuer, subPayload.Issued...); err != nil {
+		t.Fatalf("could not add certificates: %v", err)
+	}
+	if err = reg.Add("C02XYZ", m.now(), issuer, payload.Issued...); err != nil {
+		t.Fatalf("could not add certificates: %v", err)
+	}
+
+	var number *big.Int
+	crl := func() []*x509.Certificate {
+		t.Helper()
+		der, err := m.CRL()
+		if err != nil {
+			t.Fatalf("could not generate CRL: %v", err)
+		}
+		list, err := x509.ParseCRL(der)
+		if err != nil {
+			t.Fatalf("could not parse CRL: %v", err)
+		}
+		if err = ca.CheckCRLSignature(list); err != nil {
+			t.Errorf("could not verify CRL signature: %v", err)
+		}
+		// the clock is fixed, so the number must still increase between CRLs issued at the same time
+		rl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			t.Fatalf("could not parse revocation list: %v", err)
+		}
+		if number != nil && rl.Number.Cmp(number) <= 0 {
+			t.Errorf("want CRL number greater than %s, got %s", number, rl.Number)
+		}
+		number = rl.Number
+		var revoked []*x509.Certificate
+		for _, r := range list.TBSCertList.RevokedCertificates {
+			for _, c := range append(subPayload.Issued, payload.Issued...) {
+				if c.SerialNumber.Cmp(r.SerialNumber) == 0 {
+					revoked = append(revoked, c)
+				}
+			}
+		}
+		return revoked
+	}
+
+	if revoked := crl(); len(revoked) != 0 {
+		t.Errorf("want empty CRL, got %d revoked", len(revoked))
+	}
+
+	for _, serial := range []string{"C02ABC", "C02XYZ"} {
+		if _, err = m.Revoke(serial); err != nil {
+			t.Fatalf("could not revoke %s: %v", serial, err)
+		}
+	}
+
+	if revoked := crl(); len(revoked) != 1 || !revoked[0].Equal(subCA) {
+		t.Errorf("want only device CA revoked, got %d revoked", len(revoked))
+	}
+}
@@ -0,0 +1,102 @@
+package mdm
+
+import (
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+)
+
+// crlRefresh is how long a generated CRL is cached
+const crlRefresh = time.Hour
+
+// crlCache caches the generated CRL until crlRefresh has passed or a certificate is revoked
+type crlCache struct {
+	mu      sync.Mutex
+	crl     []byte
+	refresh time.Time
+	// number is the number of the last generated CRL
+	number *big.Int
+}
+
+// nextNumber returns the number for a CRL generated at now, and records it. It's the issue time in Unix nanoseconds,
+// or one more than the last number if that's not greater, so numbers always increase while the server is running, and across restarts unless the clock goes back. mu must be held
+func (c *crlCache) nextNumber(now time.Time) *big.Int {
+	n := big.NewInt(now.UnixNano())
+	if c.number != nil && n.Cmp(c.number) <= 0 {
+		n.Add(c.number, big.NewInt(1))
+	}
+	c.number = n
+	return new(big.Int).Set(n)
+}
+
+// now returns the current time from CertOptions, or time.Now
+func (m *MDM) now() time.Time {
+	if m.CertOptions != nil && m.CertOptions.Now != nil {
+		return m.CertOptions.Now()
+	}
+	return time.Now()
+}
+
+// Records returns the certificates issued to the device with serial, or all devices if serial is empty
+func (m *MDM) Records(serial string) []Record {
+	return m.registry.Records(serial)
+}
+
+// Revoke revokes all certificates issued to the device with serial and returns them. Only certificates issued by the configured CA,
+// which are per-device CAs if IssueDeviceCA is true or localhost certificates if SharedCA is true, are published in the CRL.
+// Revocation has no effect in other modes, since devices hold a CA key and can issue their own certificates.
+// If no certificates were issued to the device, ErrNotFound is returned
+func (m *MDM) Revoke(serial string) ([]Record, error) {
+	records, err := m.registry.Revoke(serial, m.now())
+	if err != nil {
+		return nil, err
+	}
+
+	m.crl.mu.Lock()
+	m.crl.crl = nil
+	m.crl.mu.Unlock()
+
+	return records, nil
+}
+
+// CRL returns the DER encoded CRL signed by the configured CA, listing the revoked certificates it issued that haven't expired.
+// If no CA is configured, ErrNoCA is returned
+func (m *MDM) CRL() ([]byte, error) {
+	if m.CA == nil {
+		return nil, ErrNoCA
+	}
+
+	m.crl.mu.Lock()
+	defer m.crl.mu.Unlock()
+
+	now := m.now()
+	if m.crl.crl != nil && now.Before(m.crl.refresh) {
+		return m.crl.crl, nil
+	}
+
+	var revoked []pkix.RevokedCertificate
+	for _, rec := range m.registry.Revoked() {
+		if now.After(rec.NotAfter) || !rec.Revocable {
+			continue
+		}
+		serial, err := rec.SerialNumber()
+		if err != nil {
+			return nil, fmt.Errorf("could not parse recorded certificate: %w", err)
+		}
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: *rec.RevokedAt})
+	}
+
+	crl, err := cert.GenerateCRL(m.CA, m.crl.nextNumber(now), revoked, m.CertOptions)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate CRL: %w", err)
+	}
+
+	m.crl.crl = crl
+	m.crl.refresh = now.Add(crlRefresh)
+
+	return crl, nil
+}
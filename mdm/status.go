@@ -0,0 +1,410 @@
+package mdm
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/groob/plist"
+)
+
+// Command statuses
+const (
+	StatusQueued       = "queued"
+	StatusAcknowledged = "acknowledged"
+	StatusError        = "error"
+	// StatusRolledBack is the status of a delivery that failed and had compensating commands sent
+	StatusRolledBack = "rolled_back"
+	// StatusUnsupported is the status of a command sent by a backend that can't report its status, e.g. a Jamf Pro policy
+	StatusUnsupported = "unsupported"
+)
+
+// Request types of commands sent to devices
+const (
+	RequestTypeInstallProfile               = "InstallProfile"
+	RequestTypeInstallEnterpriseApplication = "InstallEnterpriseApplication"
+)
+
+// ErrorChainItem is an error reported by a device for a failed command
+type ErrorChainItem struct {
+	ErrorCode            int    `json:"error_code"`
+	ErrorDomain          string `json:"error_domain"`
+	LocalizedDescription string `json:"localized_description"`
+	USEnglishDescription string `json:"us_english_description,omitempty"`
+}
+
+// CommandStatus is the status of a command sent to a device
+type CommandStatus struct {
+	CommandUUID string           `json:"command_uuid"`
+	RequestType string           `json:"request_type"`
+	Status      string           `json:"status"`
+	ErrorChain  []ErrorChainItem `json:"error_chain,omitempty"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+}
+
+// Err returns an error describing the command's ErrorChain if it failed, or nil
+func (c *CommandStatus) Err() error {
+	if c.Status != StatusError {
+		return nil
+	}
+
+	msgs := []string{fmt.Sprintf("%s command %s failed", c.RequestType, c.CommandUUID)}
+	for _, e := range c.ErrorChain {
+		msgs = append(msgs, fmt.Sprintf("%s (%s %d)", e.LocalizedDescription, e.ErrorDomain, e.ErrorCode))
+	}
+	return errors.New(strings.Join(msgs, ": "))
+}
+
+// Delivery is the status of a delivery to a device and the commands it sent
+type Delivery struct {
+	SerialNumber string           `json:"serial_number"`
+	UDID         string           `json:"udid"`
+	CreatedAt    time.Time        `json:"created_at"`
+	Commands     []*CommandStatus `json:"commands"`
+	// Status is StatusRolledBack if the delivery failed and compensating commands were sent, StatusError if the delivery or any command failed,
+	// StatusAcknowledged if all commands were acknowledged, StatusUnsupported if the other commands' statuses can't be reported, or StatusQueued
+	Status string `json:"status"`
+	// Error is the error that stopped the delivery
+	Error string `json:"error,omitempty"`
+
+	rolledBack bool
+}
+
+// trackedCommand is a command sent by a tracked delivery
+type trackedCommand struct {
+	serial string
+	status *CommandStatus
+	// done is closed when the command is acknowledged or fails
+	done chan struct{}
+}
+
+// unmatchedTTL is how long acknowledgments of unknown commands are kept, since a command can be acknowledged before Add records it
+const unmatchedTTL = time.Minute
+
+// maxUnmatched is the maximum number of acknowledgments of unknown commands that are kept
+const maxUnmatched = 1000
+
+// acknowledgment is the parsed status from an acknowledge event
+type acknowledgment struct {
+	udid        string
+	commandUUID string
+	status      string
+	errorChain  []ErrorChainItem
+	createdAt   time.Time
+}
+
+// parseAcknowledgment returns the acknowledgment from event's AcknowledgeEvent
+func parseAcknowledgment(event *WebhookEvent) (*acknowledgment, error) {
+	ack := event.AcknowledgeEvent
+	a := &acknowledgment{udid: ack.UDID, commandUUID: ack.CommandUUID, status: ack.Status, createdAt: event.CreatedAt}
+
+	if ack.Status == "Error" || ack.Status == "CommandFormatError" {
+		msg := new(struct {
+			ErrorChain []ErrorChainItem
+		})
+		if err := plist.Unmarshal(ack.RawPayload, msg); err != nil {
+			return nil, fmt.Errorf("could not parse response message: %w", err)
+		}
+		a.errorChain = msg.ErrorChain
+	}
+
+	return a, nil
+}
+
+// unmatchedAck is an acknowledgment of a command that isn't tracked yet
+type unmatchedAck struct {
+	ack      *acknowledgment
+	received time.Time
+}
+
+// Tracker records the latest delivery to each device and the commands it sent, and updates command statuses from webhook acknowledge events.
+// Statuses are only updated by MicroMDM or NanoMDM webhooks. Commands without a command UUID, e.g. sent by Jamf Pro, are StatusUnsupported.
+// Deliveries are only kept in memory
+type Tracker struct {
+	mu         sync.Mutex
+	deliveries map[string]*Delivery
+	commands   map[string]*trackedCommand
+	// unmatched are the elements of unmatchedOrder by command UUID
+	unmatched map[string]*list.Element
+	// unmatchedOrder are the acknowledgments of unknown commands, as *unmatchedAck, in the order they were received
+	unmatchedOrder *list.List
+}
+
+// NewTracker returns a new Tracker
+func NewTracker() *Tracker {
+	return &Tracker{
+		deliveries:     make(map[string]*Delivery),
+		commands:       make(map[string]*trackedCommand),
+		unmatched:      make(map[string]*list.Element),
+		unmatchedOrder: list.New(),
+	}
+}
+
+// Start records a new delivery to the device with serial and udid, replacing the device's previous delivery, and returns it.
+// The returned delivery must only be read with snapshot
+func (t *Tracker) Start(serial, udid string, now time.Time) *Delivery {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if d, ok := t.deliveries[serial]; ok {
+		for _, c := range d.Commands {
+			delete(t.commands, c.CommandUUID)
+		}
+	}
+
+	d := &Delivery{SerialNumber: serial, UDID: udid, CreatedAt: now}
+	t.deliveries[serial] = d
+	return d
+}
+
+// Add records a queued command sent by the latest delivery to the device with serial.
+// If the command was already acknowledged, the acknowledge event received by HandleWebhook is applied.
+// If commandUUID is empty, the backend can't report the command's status, so it's recorded as StatusUnsupported and isn't tracked
+func (t *Tracker) Add(serial, requestType, commandUUID string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d, ok := t.deliveries[serial]
+	if !ok {
+		return
+	}
+
+	if commandUUID == "" {
+		d.Commands = append(d.Commands, &CommandStatus{RequestType: requestType, Status: StatusUnsupported, UpdatedAt: now})
+		return
+	}
+
+	status := &CommandStatus{CommandUUID: commandUUID, RequestType: requestType, Status: StatusQueued, UpdatedAt: now}
+	d.Commands = append(d.Commands, status)
+	tc := &trackedCommand{serial: serial, status: status, done: make(chan struct{})}
+	t.commands[commandUUID] = tc
+
+	if e, ok := t.unmatched[commandUUID]; ok {
+		t.removeUnmatched(e)
+		// an acknowledgment from another device leaves the command queued
+		t.apply(tc, e.Value.(*unmatchedAck).ack)
+	}
+}
+
+// Remove removes the command with commandUUID from the latest delivery to the device with serial, e.g. if it was added before it was sent and sending it failed
+func (t *Tracker) Remove(serial, commandUUID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.commands, commandUUID)
+
+	d, ok := t.deliveries[serial]
+	if !ok {
+		return
+	}
+	for idx, c := range d.Commands {
+		if c.CommandUUID == commandUUID {
+			d.Commands = append(d.Commands[:idx:idx], d.Commands[idx+1:]...)
+			return
+		}
+	}
+}
+
+// Fail records the error that stopped the latest delivery to the device with serial
+func (t *Tracker) Fail(serial string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if d, ok := t.deliveries[serial]; ok {
+		d.Error = err.Error()
+	}
+}
+
+// RollBack records the error that caused the latest delivery to the device with serial to be rolled back
+func (t *Tracker) RollBack(serial string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if d, ok := t.deliveries[serial]; ok {
+		d.Error = err.Error()
+		d.rolledBack = true
+	}
+}
+
+// Wait waits up to timeout for the command with commandUUID to be acknowledged or fail, and returns a copy of its status.
+// If the timeout expires, ErrTimeout is returned
+func (t *Tracker) Wait(commandUUID string, timeout time.Duration) (*CommandStatus, error) {
+	t.mu.Lock()
+	tc, ok := t.commands[commandUUID]
+	t.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("command %s is not tracked", commandUUID)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-tc.done:
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := *tc.status
+	return &status, nil
+}
+
+// Delivery returns a copy of the latest delivery to the device with serial. If no delivery is found, ErrNotFound is returned
+func (t *Tracker) Delivery(serial string) (*Delivery, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d, ok := t.deliveries[serial]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return d.copy(), nil
+}
+
+// snapshot returns a copy of the delivery returned by Start
+func (t *Tracker) snapshot(d *Delivery) *Delivery {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return d.copy()
+}
+
+// copy returns a copy of d with its status. The Tracker's lock must be held
+func (d *Delivery) copy() *Delivery {
+	delivery := *d
+	delivery.Commands = make([]*CommandStatus, len(d.Commands))
+	for idx, c := range d.Commands {
+		cmd := *c
+		delivery.Commands[idx] = &cmd
+	}
+	delivery.Status = d.status()
+
+	return &delivery
+}
+
+// status returns the overall status of the delivery
+func (d *Delivery) status() string {
+	if d.rolledBack {
+		return StatusRolledBack
+	}
+	if d.Error != "" {
+		return StatusError
+	}
+
+	acknowledged, unsupported := len(d.Commands) > 0, false
+	for _, c := range d.Commands {
+		switch c.Status {
+		case StatusError:
+			return StatusError
+		case StatusUnsupported:
+			unsupported = true
+		case StatusAcknowledged:
+		default:
+			acknowledged = false
+		}
+	}
+
+	switch {
+	case acknowledged && unsupported:
+		return StatusUnsupported
+	case acknowledged:
+		return StatusAcknowledged
+	}
+	return StatusQueued
+}
+
+// HandleWebhook updates the status of tracked commands from acknowledge events. NotNow responses leave the command queued. Other events are ignored.
+// Acknowledgments of unknown commands are kept for unmatchedTTL, up to maxUnmatched, so a command acknowledged before Add records it is still updated.
+// Backends that are CommandUUIDSenders have their commands added before they're sent, so their acknowledgments don't need to be kept
+func (t *Tracker) HandleWebhook(event *WebhookEvent) error {
+	if event.AcknowledgeEvent == nil || event.AcknowledgeEvent.CommandUUID == "" {
+		return nil
+	}
+
+	ack, err := parseAcknowledgment(event)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tc, ok := t.commands[event.AcknowledgeEvent.CommandUUID]
+	if !ok {
+		// an invalid acknowledgment of an unknown command is ignored
+		if err == nil {
+			t.addUnmatched(ack, time.Now())
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return t.apply(tc, ack)
+}
+
+// addUnmatched keeps the acknowledgment of an unknown command, and removes the oldest acknowledgments older than unmatchedTTL or over maxUnmatched. t.mu must be held
+func (t *Tracker) addUnmatched(ack *acknowledgment, now time.Time) {
+	for e := t.unmatchedOrder.Front(); e != nil; e = t.unmatchedOrder.Front() {
+		if now.Sub(e.Value.(*unmatchedAck).received) <= unmatchedTTL && t.unmatchedOrder.Len() < maxUnmatched {
+			break
+		}
+		t.removeUnmatched(e)
+	}
+
+	// a NotNow response doesn't change the command's status
+	if ack.status == "NotNow" {
+		return
+	}
+
+	if e, ok := t.unmatched[ack.commandUUID]; ok {
+		t.removeUnmatched(e)
+	}
+	t.unmatched[ack.commandUUID] = t.unmatchedOrder.PushBack(&unmatchedAck{ack: ack, received: now})
+}
+
+// removeUnmatched removes the element e of unmatchedOrder. t.mu must be held
+func (t *Tracker) removeUnmatched(e *list.Element) {
+	t.unmatchedOrder.Remove(e)
+	delete(t.unmatched, e.Value.(*unmatchedAck).ack.commandUUID)
+}
+
+// apply updates the status of tc from the acknowledgment. t.mu must be held
+func (t *Tracker) apply(tc *trackedCommand, ack *acknowledgment) error {
+	if t.deliveries[tc.serial].UDID != ack.udid {
+		return fmt.Errorf("command %s was not sent to %s", ack.commandUUID, ack.udid)
+	}
+	cmd := tc.status
+
+	now := ack.createdAt
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	switch ack.status {
+	case "Acknowledged":
+		cmd.Status = StatusAcknowledged
+		cmd.ErrorChain = nil
+	case "Error", "CommandFormatError":
+		cmd.Status = StatusError
+		cmd.ErrorChain = ack.errorChain
+	case "NotNow":
+		// the device will retry the command later
+		cmd.UpdatedAt = now
+		return nil
+	default:
+		return nil
+	}
+	cmd.UpdatedAt = now
+
+	select {
+	case <-tc.done:
+	default:
+		close(tc.done)
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package mdm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/groob/plist"
+)
+
+func TestTracker(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tr := NewTracker()
+
+	if _, err := tr.Delivery("SERIAL"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+
+	tr.Start("SERIAL", "UDID", now)
+	tr.Add("SERIAL", RequestTypeInstallEnterpriseApplication, "PKG", now)
+	tr.Add("SERIAL", RequestTypeInstallProfile, "PROFILE", now)
+
+	ack := func(udid, status, uuid string, raw []byte) error {
+		return tr.HandleWebhook(&WebhookEvent{
+			Topic:            TopicConnect,
+			CreatedAt:        now.Add(time.Minute),
+			AcknowledgeEvent: &AcknowledgeEvent{UDID: udid, Status: status, CommandUUID: uuid, RawPayload: raw},
+		})
+	}
+
+	status := func(want string) *Delivery {
+		t.Helper()
+		d, err := tr.Delivery("SERIAL")
+		if err != nil {
+			t.Fatalf("could not get delivery: %v", err)
+		}
+		if d.Status != want {
+			t.Errorf("want status %s, got %s", want, d.Status)
+		}
+		return d
+	}
+
+	if err := ack("UDID", "NotNow", "PKG", nil); err != nil {
+		t.Errorf("could not handle NotNow: %v", err)
+	}
+	if err := ack("UDID", "Acknowledged", "OTHER", nil); err != nil {
+		t.Errorf("want unknown command ignored, got %v", err)
+	}
+	if err := ack("OTHER", "Acknowledged", "PKG", nil); err == nil {
+		t.Error("want error for mismatched UDID, got nil")
+	}
+	status(StatusQueued)
+
+	if err := ack("UDID", "Acknowledged", "PKG", nil); err != nil {
+		t.Errorf("could not handle Acknowledged: %v", err)
+	}
+	status(StatusQueued)
+
+	if err := ack("UDID", "Acknowledged", "PROFILE", nil); err != nil {
+		t.Errorf("could not handle Acknowledged: %v", err)
+	}
+	d := status(StatusAcknowledged)
+	if !d.Commands[1].UpdatedAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("want updated time from event, got %s", d.Commands[1].UpdatedAt)
+	}
+
+	// returned deliveries are copies
+	d.Commands[0].Status = StatusError
+	status(StatusAcknowledged)
+
+	// a new delivery replaces the previous one
+	tr.Start("SERIAL", "UDID", now)
+	tr.Add("SERIAL", RequestTypeInstallEnterpriseApplication, "PKG2", now)
+	if err := ack("UDID", "Error", "PKG", []byte("invalid")); err != nil {
+		t.Errorf("want previous command ignored, got %v", err)
+	}
+
+	raw, err := plist.Marshal(map[string]interface{}{
+		"Status":      "Error",
+		"CommandUUID": "PKG2",
+		"ErrorChain": []map[string]interface{}{
+			{"ErrorCode": 12008, "ErrorDomain": "MCInstallationErrorDomain", "LocalizedDescription": "The package could not be installed."},
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not marshal response: %v", err)
+	}
+	// Wait returns once the command fails
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		if err := ack("UDID", "Error", "PKG2", raw); err != nil {
+			t.Errorf("could not handle Error: %v", err)
+		}
+	}()
+	cmd, err := tr.Wait("PKG2", time.Minute)
+	if err != nil {
+		t.Fatalf("could not wait for command: %v", err)
+	}
+	if err = cmd.Err(); err == nil || !strings.Contains(err.Error(), "The package could not be installed. (MCInstallationErrorDomain 12008)") {
+		t.Errorf("want command error, got %v", err)
+	}
+
+	d = status(StatusError)
+	if len(d.Commands) != 1 || len(d.Commands[0].ErrorChain) != 1 || d.Commands[0].ErrorChain[0].ErrorCode != 12008 {
+		t.Errorf("unexpected commands: %+v", d.Commands)
+	}
+
+	tr.Start("SERIAL", "UDID", now)
+	tr.Fail("SERIAL", errors.New("could not install payload"))
+	if d = status(StatusError); d.Error != "could not install payload" {
+		t.Errorf("want delivery error, got %q", d.Error)
+	}
+
+	tr.Start("SERIAL", "UDID", now)
+	tr.Add("SERIAL", RequestTypeInstallProfile, "PROFILE2", now)
+	if _, err = tr.Wait("PROFILE2", 10*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Errorf("want ErrTimeout, got %v", err)
+	}
+	if _, err = tr.Wait("PKG2", time.Minute); err == nil {
+		t.Error("want error for untracked command, got nil")
+	}
+
+	tr.Add("SERIAL", RequestTypeInstallEnterpriseApplication, "CLEANUP", now)
+	tr.RollBack("SERIAL", ErrTimeout)
+	if d = status(StatusRolledBack); len(d.Commands) != 2 || d.Error != ErrTimeout.Error() {
+		t.Errorf("unexpected rolled back delivery: %+v", d)
+	}
+
+	// a command acknowledged before it's added is updated when it's added
+	tr.Start("SERIAL", "UDID", now)
+	if err = ack("UDID", "Acknowledged", "EARLY", nil); err != nil {
+		t.Errorf("could not handle Acknowledged: %v", err)
+	}
+	if err = ack("OTHER", "Acknowledged", "MISMATCHED", nil); err != nil {
+		t.Errorf("want unknown command ignored, got %v", err)
+	}
+	tr.Add("SERIAL", RequestTypeInstallEnterpriseApplication, "EARLY", now)
+	tr.Add("SERIAL", RequestTypeInstallProfile, "MISMATCHED", now)
+	if cmd, err = tr.Wait("EARLY", time.Minute); err != nil || cmd.Status != StatusAcknowledged {
+		t.Errorf("want acknowledged command, got %+v, %v", cmd, err)
+	}
+	if d = status(StatusQueued); d.Commands[1].Status != StatusQueued {
+		t.Errorf("want command acknowledged by another device queued, got %s", d.Commands[1].Status)
+	}
+	if _, ok := tr.unmatched["EARLY"]; ok {
+		t.Error("want matched event removed")
+	}
+
+	// commands without a command UUID can't be tracked
+	tr.Start("SERIAL", "UDID", now)
+	tr.Add("SERIAL", RequestTypeInstallEnterpriseApplication, "", now)
+	tr.Add("SERIAL", RequestTypeInstallProfile, "", now)
+	if d = status(StatusUnsupported); len(d.Commands) != 2 || d.Commands[0].Status != StatusUnsupported {
+		t.Errorf("unexpected unsupported delivery: %+v", d)
+	}
+	if _, ok := tr.commands[""]; ok {
+		t.Error("want unsupported command untracked")
+	}
+	tr.Start("SERIAL", "UDID", now)
+	tr.Add("SERIAL", RequestTypeInstallEnterpriseApplication, "", now)
+	tr.Add("SERIAL", RequestTypeInstallProfile, "PROFILE3", now)
+	status(StatusQueued)
+
+	// old acknowledgments of unknown commands are removed. Acknowledgments are removed in the order they're received, so a new Tracker is used
+	tr = NewTracker()
+	tr.addUnmatched(&acknowledgment{udid: "UDID", commandUUID: "OLD", status: "Acknowledged"}, time.Now().Add(-2*unmatchedTTL))
+	if err = ack("UDID", "Acknowledged", "NEW", nil); err != nil {
+		t.Errorf("could not handle Acknowledged: %v", err)
+	}
+	if _, ok := tr.unmatched["OLD"]; ok {
+		t.Error("want old acknowledgment removed")
+	}
+	if _, ok := tr.unmatched["NEW"]; !ok {
+		t.Error("want new acknowledgment kept")
+	}
+
+	// invalid acknowledgments of unknown commands are ignored
+	if err = ack("UDID", "Error", "INVALID", []byte("invalid")); err != nil {
+		t.Errorf("want invalid acknowledgment ignored, got %v", err)
+	}
+	if _, ok := tr.unmatched["INVALID"]; ok {
+		t.Error("want invalid acknowledgment not kept")
+	}
+
+	// the oldest acknowledgments are removed over maxUnmatched
+	for i := 0; i < maxUnmatched; i++ {
+		if err = ack("UDID", "Acknowledged", fmt.Sprintf("CMD%d", i), nil); err != nil {
+			t.Errorf("could not handle Acknowledged: %v", err)
+		}
+	}
+	if len(tr.unmatched) != maxUnmatched || tr.unmatchedOrder.Len() != maxUnmatched {
+		t.Errorf("want %d acknowledgments, got %d, %d", maxUnmatched, len(tr.unmatched), tr.unmatchedOrder.Len())
+	}
+	if _, ok := tr.unmatched["NEW"]; ok {
+		t.Error("want oldest acknowledgment removed")
+	}
+	if _, ok := tr.unmatched["CMD0"]; !ok {
+		t.Error("want newer acknowledgment kept")
+	}
+
+	// a command that couldn't be sent is removed
+	tr.Start("SERIAL", "UDID", now)
+	tr.Add("SERIAL", RequestTypeInstallEnterpriseApplication, "PKG3", now)
+	tr.Add("SERIAL", RequestTypeInstallProfile, "PROFILE4", now)
+	tr.Remove("SERIAL", "PKG3")
+	if d = status(StatusQueued); len(d.Commands) != 1 || d.Commands[0].CommandUUID != "PROFILE4" {
+		t.Errorf("unexpected commands: %+v", d.Commands)
+	}
+	if _, ok := tr.commands["PKG3"]; ok {
+		t.Error("want removed command untracked")
+	}
+}
@@ -0,0 +1,61 @@
+package mdm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/groob/plist"
+)
+
+// Webhook topics
+const (
+	TopicAuthenticate = "mdm.Authenticate"
+	TopicConnect      = "mdm.Connect"
+)
+
+// CheckinEvent is a device check-in sent by an MDM webhook
+type CheckinEvent struct {
+	UDID string `json:"udid"`
+	// RawPayload is the check-in message plist
+	RawPayload []byte `json:"raw_payload"`
+}
+
+// AcknowledgeEvent is a device's response to a command sent by an MDM webhook
+type AcknowledgeEvent struct {
+	UDID        string `json:"udid"`
+	Status      string `json:"status"`
+	CommandUUID string `json:"command_uuid"`
+	// RawPayload is the response message plist
+	RawPayload []byte `json:"raw_payload"`
+}
+
+// WebhookEvent is an event sent by MicroMDM's or NanoMDM's webhook
+type WebhookEvent struct {
+	Topic            string            `json:"topic"`
+	EventID          string            `json:"event_id"`
+	CreatedAt        time.Time         `json:"created_at"`
+	CheckinEvent     *CheckinEvent     `json:"checkin_event,omitempty"`
+	AcknowledgeEvent *AcknowledgeEvent `json:"acknowledge_event,omitempty"`
+}
+
+// HandleWebhook records the serial number and UDID of devices from Authenticate check-in events. Other events are ignored
+func (d *DeviceDirectory) HandleWebhook(event *WebhookEvent) error {
+	if event.Topic != TopicAuthenticate || event.CheckinEvent == nil {
+		return nil
+	}
+
+	msg := new(struct {
+		UDID         string
+		SerialNumber string
+	})
+	if err := plist.Unmarshal(event.CheckinEvent.RawPayload, msg); err != nil {
+		return fmt.Errorf("could not parse check-in message: %w", err)
+	}
+
+	if msg.SerialNumber == "" || msg.UDID == "" {
+		return errors.New("check-in message missing serial number or UDID")
+	}
+
+	return d.Set(msg.SerialNumber, msg.UDID)
+}
@@ -0,0 +1,40 @@
+package mdm
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"text/template"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+)
+
+//go:embed payload.ps1
+var windowsScript string
+var tmplWindows = template.Must(template.New("payload.ps1").Parse(windowsScript))
+
+// WindowsInstallScript returns a PowerShell script that installs payload on Windows. The root of payload's chain is imported into LocalMachine\Root,
+// and the PEM files are written with ACLs that only allow SYSTEM and Administrators access
+func WindowsInstallScript(payload *Payload) ([]byte, error) {
+	// chain is ordered from the localhost certificate to the root
+	chain, err := cert.ParseCertificatesPEM([]byte(payload.Chain))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse chain: %w", err)
+	}
+	if len(chain) < 2 {
+		return nil, errors.New("chain does not contain a CA")
+	}
+
+	data := struct {
+		*Payload
+		Root string
+	}{Payload: payload, Root: base64.StdEncoding.EncodeToString(chain[len(chain)-1].Raw)}
+
+	buf := new(bytes.Buffer)
+	if err := tmplWindows.Execute(buf, data); err != nil {
+		return nil, fmt.Errorf("could not generate install script: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,38 @@
+package profile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+)
+
+// Check adds checks to r, e.g. a report from cert.Verify, that prof contains r.Root as its root certificate, and r.CA as an intermediate if it was issued by the root.
+// If r.Root is nil, no checks are added. prof's certificates must be parsed, e.g. by Parse
+func Check(r *cert.Report, prof *TopLevelProfile) {
+	if r.Root == nil {
+		return
+	}
+
+	switch c := prof.Root(); {
+	case c == nil:
+		r.AddCheck("profile root certificate matches CA", errors.New("no root certificate payload found"))
+	case bytes.Equal(c.Raw, r.Root.Raw):
+		r.AddCheck("profile root certificate matches CA", nil)
+	default:
+		r.AddCheck("profile root certificate matches CA", fmt.Errorf("profile contains %s (%s)", c.Subject, cert.Fingerprint(c)))
+	}
+
+	// a sub-CA must be delivered with the profile, since devices only trust the root
+	if r.CA == nil || r.CA.Equal(r.Root) {
+		return
+	}
+	for _, c := range prof.Certificates() {
+		if c.PayloadType != PayloadTypeRoot && c.Certificate != nil && c.Certificate.Equal(r.CA) {
+			r.AddCheck("profile intermediate certificates include ca.pem", nil)
+			return
+		}
+	}
+	r.AddCheck("profile intermediate certificates include ca.pem", fmt.Errorf("profile doesn't contain %s (%s)", r.CA.Subject, cert.Fingerprint(r.CA)))
+}
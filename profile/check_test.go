@@ -0,0 +1,90 @@
+package profile_test
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/groob/plist"
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/profile"
+)
+
+func TestCheck(t *testing.T) {
+	opts := cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeECDSAP256
+
+	root, rootKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	sub, _, err := cert.GenerateSubCA(root, rootKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate sub-CA: %v", err)
+	}
+	other, _, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		root, ca      *x509.Certificate
+		profileRoot   *x509.Certificate
+		intermediates []*x509.Certificate
+		// results are the checks and whether they should pass
+		results map[string]bool
+	}{
+		{
+			name: "root CA", root: root, ca: root, profileRoot: root,
+			results: map[string]bool{"profile root certificate matches CA": true},
+		},
+		{
+			name: "mismatched root", root: root, ca: root, profileRoot: other,
+			results: map[string]bool{"profile root certificate matches CA": false},
+		},
+		{
+			name: "sub-CA", root: root, ca: sub, profileRoot: root, intermediates: []*x509.Certificate{sub},
+			results: map[string]bool{"profile root certificate matches CA": true, "profile intermediate certificates include ca.pem": true},
+		},
+		{
+			name: "sub-CA without intermediate", root: root, ca: sub, profileRoot: root,
+			results: map[string]bool{"profile root certificate matches CA": true, "profile intermediate certificates include ca.pem": false},
+		},
+		{
+			name: "sub-CA as root", root: root, ca: sub, profileRoot: sub,
+			results: map[string]bool{"profile root certificate matches CA": false, "profile intermediate certificates include ca.pem": false},
+		},
+		{
+			name: "no root in report", ca: sub, profileRoot: root,
+			results: map[string]bool{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prof, err := profile.New(&profile.Config{PayloadIdentifier: "com.example", PayloadUUID: "UUID"}, test.profileRoot, test.intermediates...)
+			if err != nil {
+				t.Fatalf("could not generate profile: %v", err)
+			}
+			buf, err := plist.Marshal(prof)
+			if err != nil {
+				t.Fatalf("could not marshal profile: %v", err)
+			}
+			if prof, err = profile.Parse(buf); err != nil {
+				t.Fatalf("could not parse profile: %v", err)
+			}
+
+			r := &cert.Report{Root: test.root, CA: test.ca}
+			profile.Check(r, prof)
+
+			if len(r.Checks) != len(test.results) {
+				t.Errorf("want %d checks, got %d", len(test.results), len(r.Checks))
+			}
+			for _, c := range r.Checks {
+				if ok, exists := test.results[c.Name]; !exists || ok != c.OK {
+					t.Errorf("check %q: want ok %t, got %t: %s", c.Name, ok, c.OK, c.Message)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package profile
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/groob/plist"
+	"go.mozilla.org/pkcs7"
+)
+
+// contentInfo, envelopedData, recipientInfo, issuerAndSerial, and encryptedContentInfo are the PKCS #7 EnvelopedData structures (RFC 2315)
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []recipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type recipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  issuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type issuerAndSerial struct {
+	IssuerName   asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+// envelope returns content encrypted with AES-256-CBC to recipient as a PKCS #7 EnvelopedData.
+// pkcs7.Encrypt isn't used since its algorithm is package level state, and its default is DES-CBC
+func envelope(content []byte, recipient *x509.Certificate) ([]byte, error) {
+	pub, ok := recipient.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("recipient must have an RSA public key")
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("could not generate key: %w", err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, fmt.Errorf("could not generate iv: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %w", err)
+	}
+
+	// PKCS #7 padding always adds at least one byte
+	padLen := aes.BlockSize - len(content)%aes.BlockSize
+	padded := make([]byte, len(content)+padLen)
+	copy(padded, content)
+	for i := len(content); i < len(padded); i++ {
+		padded[i] = byte(padLen)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt key: %w", err)
+	}
+
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal iv: %w", err)
+	}
+
+	inner, err := asn1.Marshal(envelopedData{
+		RecipientInfos: []recipientInfo{{
+			IssuerAndSerialNumber:  issuerAndSerial{IssuerName: asn1.RawValue{FullBytes: recipient.RawIssuer}, SerialNumber: recipient.SerialNumber},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: pkcs7.OIDEncryptionAlgorithmRSA},
+			EncryptedKey:           encryptedKey,
+		}},
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                pkcs7.OIDData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: pkcs7.OIDEncryptionAlgorithmAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+			EncryptedContent:           padded,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal enveloped data: %w", err)
+	}
+
+	return asn1.Marshal(contentInfo{ContentType: pkcs7.OIDEnvelopedData, Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner}})
+}
+
+// Encrypt returns a copy of the profile with its PayloadContent encrypted to recipient, e.g. a device's MDM identity certificate, as EncryptedPayloadContent.
+// The top level keys are left unencrypted, and the payloads are encrypted with AES-256-CBC. recipient must have an RSA public key
+func Encrypt(prof *TopLevelProfile, recipient *x509.Certificate) (*TopLevelProfile, error) {
+	if len(prof.EncryptedPayloadContent) > 0 {
+		return nil, errors.New("profile is already encrypted")
+	}
+
+	content, err := marshalPayloads(prof.PayloadContent)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := plist.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal payloads: %w", err)
+	}
+
+	encrypted, err := envelope(buf, recipient)
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt payloads: %w", err)
+	}
+
+	p := *prof
+	p.PayloadContent = nil
+	p.EncryptedPayloadContent = encrypted
+
+	return &p, nil
+}
+
+// Decrypt decrypts EncryptedPayloadContent with the recipient's key pair into PayloadContent, and clears EncryptedPayloadContent.
+// Certificate payloads are parsed as with Parse
+func (p *TopLevelProfile) Decrypt(recipient *x509.Certificate, key crypto.PrivateKey) error {
+	if len(p.EncryptedPayloadContent) == 0 {
+		return errors.New("profile is not encrypted")
+	}
+
+	p7, err := pkcs7.Parse(p.EncryptedPayloadContent)
+	if err != nil {
+		return fmt.Errorf("could not parse pkcs7: %w", err)
+	}
+
+	buf, err := p7.Decrypt(recipient, key)
+	if err != nil {
+		return fmt.Errorf("could not decrypt payloads: %w", err)
+	}
+
+	var decoders []*payloadDecoder
+	if err = plist.Unmarshal(buf, &decoders); err != nil {
+		return fmt.Errorf("could not unmarshal payloads: %w", err)
+	}
+
+	payloads := make([]Payload, len(decoders))
+	for idx, d := range decoders {
+		payloads[idx] = d.Payload
+	}
+
+	if err = parseCertificates(payloads); err != nil {
+		return err
+	}
+
+	p.PayloadContent = payloads
+	p.EncryptedPayloadContent = nil
+
+	return nil
+}
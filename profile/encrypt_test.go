@@ -0,0 +1,130 @@
+package profile_test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/groob/plist"
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/profile"
+	"go.mozilla.org/pkcs7"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	opts := cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeRSA2048
+
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	device, deviceKey, err := cert.GenerateLocalhost(ca, caKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate device certificate: %v", err)
+	}
+
+	prof, err := profile.New(&profile.Config{PayloadIdentifier: "com.example", PayloadUUID: "UUID", RemovalPassword: "secret"}, ca)
+	if err != nil {
+		t.Fatalf("could not generate profile: %v", err)
+	}
+
+	encrypted, err := profile.Encrypt(prof, device)
+	if err != nil {
+		t.Fatalf("could not encrypt profile: %v", err)
+	}
+	if len(prof.PayloadContent) != 2 || len(prof.EncryptedPayloadContent) != 0 {
+		t.Error("original profile was modified")
+	}
+	// DER encoded AES-256-CBC OID, 2.16.840.1.101.3.4.1.42
+	if !bytes.Contains(encrypted.EncryptedPayloadContent, []byte{0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x01, 0x2A}) {
+		t.Error("want payloads encrypted with AES-256-CBC")
+	}
+
+	signed, err := profile.Sign(encrypted, device, deviceKey)
+	if err != nil {
+		t.Fatalf("could not sign profile: %v", err)
+	}
+
+	buf, err := plist.Marshal(encrypted)
+	if err != nil {
+		t.Fatalf("could not marshal profile: %v", err)
+	}
+	if bytes.Contains(buf, []byte("secret")) || bytes.Contains(buf, []byte("<key>PayloadContent</key>")) {
+		t.Errorf("encrypted profile contains plaintext payloads:\n%s", buf)
+	}
+
+	parsed, err := profile.Parse(signed)
+	if err != nil {
+		t.Fatalf("could not parse profile: %v", err)
+	}
+	if len(parsed.PayloadContent) != 0 || len(parsed.EncryptedPayloadContent) == 0 {
+		t.Fatalf("want only encrypted payloads, got %d payloads", len(parsed.PayloadContent))
+	}
+
+	other, otherKey, err := cert.GenerateLocalhost(ca, caKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate other certificate: %v", err)
+	}
+	if err = parsed.Decrypt(other, otherKey); err == nil {
+		t.Error("want error decrypting with other certificate, got nil")
+	}
+
+	if err = parsed.Decrypt(device, deviceKey); err != nil {
+		t.Fatalf("could not decrypt profile: %v", err)
+	}
+
+	if root := parsed.Root(); root == nil || !root.Equal(ca) {
+		t.Errorf("want root %s, got %v", ca.Subject, root)
+	}
+	if r, ok := parsed.PayloadContent[1].(*profile.RemovalPasswordPayload); !ok || r.RemovalPassword != "secret" {
+		t.Errorf("unexpected removal password payload: %#v", parsed.PayloadContent[1])
+	}
+}
+
+func TestEncryptConcurrent(t *testing.T) {
+	opts := cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeRSA2048
+
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	device, deviceKey, err := cert.GenerateLocalhost(ca, caKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate device certificate: %v", err)
+	}
+
+	prof, err := profile.New(&profile.Config{PayloadIdentifier: "com.example", PayloadUUID: "UUID"}, ca)
+	if err != nil {
+		t.Fatalf("could not generate profile: %v", err)
+	}
+
+	// only Encrypt runs concurrently, since pkcs7.Parse isn't safe for concurrent use
+	encrypted := make([]*profile.TopLevelProfile, 8)
+	var wg sync.WaitGroup
+	for i := range encrypted {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if encrypted[i], err = profile.Encrypt(prof, device); err != nil {
+				t.Errorf("could not encrypt profile: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, e := range encrypted {
+		if e == nil {
+			continue
+		}
+		p7, err := pkcs7.Parse(e.EncryptedPayloadContent)
+		if err != nil {
+			t.Fatalf("could not parse pkcs7: %v", err)
+		}
+		if _, err = p7.Decrypt(device, deviceKey); err != nil {
+			t.Errorf("could not decrypt pkcs7: %v", err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package profile
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/groob/plist"
+	"go.mozilla.org/pkcs7"
+)
+
+// Parse parses a signed or unsigned profile, e.g. a .mobileconfig file. If the profile is signed, its signature is verified and the signer is set on the profile.
+// Use Verify to also check the signer's chain. The content of certificate payloads is parsed into Certificate. Encrypted payloads are left as is; see Decrypt
+func Parse(data []byte) (*TopLevelProfile, error) {
+	var signer *x509.Certificate
+	if !isPlist(data) {
+		p7, err := pkcs7.Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse pkcs7: %w", err)
+		}
+		if signer, err = verify(p7, nil); err != nil {
+			return nil, err
+		}
+		data = p7.Content
+	}
+
+	prof := new(TopLevelProfile)
+	if err := plist.Unmarshal(data, prof); err != nil {
+		return nil, fmt.Errorf("could not unmarshal profile: %w", err)
+	}
+	prof.Signer = signer
+
+	if err := parseCertificates(prof.PayloadContent); err != nil {
+		return nil, err
+	}
+
+	return prof, nil
+}
+
+// parseCertificates parses the content of the certificate payloads into Certificate
+func parseCertificates(payloads []Payload) error {
+	for _, payload := range payloads {
+		c, ok := payload.(*CertificatePayload)
+		if !ok {
+			continue
+		}
+		var err error
+		if c.Certificate, err = parseCertificate(c); err != nil {
+			return fmt.Errorf("could not parse payload %s: %w", c.PayloadIdentifier, err)
+		}
+	}
+	return nil
+}
+
+// isPlist returns true if data is an XML or binary plist instead of a signed profile
+func isPlist(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return bytes.HasPrefix(data, []byte("<")) || bytes.HasPrefix(data, []byte("bplist"))
+}
+
+// parseCertificate parses the DER or PEM encoded certificate in the payload
+func parseCertificate(p *CertificatePayload) (*x509.Certificate, error) {
+	if p.PayloadType != PayloadTypePEM {
+		return x509.ParseCertificate(p.PayloadContent)
+	}
+
+	block, _ := pem.Decode(p.PayloadContent)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,108 @@
+package profile_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/groob/plist"
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/profile"
+)
+
+func TestParse(t *testing.T) {
+	opts := cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeECDSAP256
+
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+	signer, signerKey, err := cert.GenerateLocalhost(ca, caKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate signer: %v", err)
+	}
+
+	config := &profile.Config{PayloadIdentifier: "com.example", PayloadUUID: "UUID", FirefoxEnterpriseRoots: true}
+	pemCert, err := profile.NewCertificatePayload(config, profile.PayloadTypePEM, "PEM Certificate", "pem-certificate", cert.ChainPEM(signer))
+	if err != nil {
+		t.Fatalf("could not create certificate payload: %v", err)
+	}
+	config.Payloads = []profile.Payload{pemCert}
+
+	prof, err := profile.New(config, ca)
+	if err != nil {
+		t.Fatalf("could not generate profile: %v", err)
+	}
+
+	unsigned, err := plist.Marshal(prof)
+	if err != nil {
+		t.Fatalf("could not marshal profile: %v", err)
+	}
+
+	signed, err := profile.Sign(prof, signer, signerKey)
+	if err != nil {
+		t.Fatalf("could not sign profile: %v", err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		data   []byte
+		signed bool
+	}{
+		{"unsigned", unsigned, false},
+		{"signed", signed, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := profile.Parse(test.data)
+			if err != nil {
+				t.Fatalf("could not parse profile: %v", err)
+			}
+
+			if test.signed && (parsed.Signer == nil || !parsed.Signer.Equal(signer)) {
+				t.Errorf("want signer %s, got %v", signer.Subject, parsed.Signer)
+			}
+			if !test.signed && parsed.Signer != nil {
+				t.Errorf("want no signer, got %s", parsed.Signer.Subject)
+			}
+
+			if root := parsed.Root(); root == nil || !root.Equal(ca) {
+				t.Errorf("want root %s, got %v", ca.Subject, root)
+			}
+
+			certs := parsed.Certificates()
+			if len(certs) != 2 || certs[1].Certificate == nil || !certs[1].Certificate.Equal(signer) {
+				t.Errorf("unexpected certificate payloads: %#v", certs)
+			}
+
+			// parsed profiles marshal identically, so they can be diffed against newly generated profiles
+			buf, err := plist.Marshal(parsed)
+			if err != nil {
+				t.Fatalf("could not marshal parsed profile: %v", err)
+			}
+			if !bytes.Equal(buf, unsigned) {
+				t.Errorf("parsed profile does not round trip:\n--- got ---\n%s\n--- want ---\n%s", buf, unsigned)
+			}
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		tampered := bytes.Replace(signed, []byte("com.example"), []byte("com.exampla"), 1)
+		if bytes.Equal(tampered, signed) {
+			t.Fatal("could not tamper with signed profile")
+		}
+		if _, err := profile.Parse(tampered); err == nil {
+			t.Error("want error parsing tampered profile, got nil")
+		}
+	})
+
+	t.Run("invalid certificate", func(t *testing.T) {
+		prof.Certificates()[0].PayloadContent = []byte("invalid")
+		buf, err := plist.Marshal(prof)
+		if err != nil {
+			t.Fatalf("could not marshal profile: %v", err)
+		}
+		if _, err := profile.Parse(buf); err == nil {
+			t.Error("want error parsing invalid certificate payload, got nil")
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package profile
+
+import (
+	"crypto/x509"
+	"fmt"
+)
+
+// Payload types
+const (
+	PayloadTypeRoot            = "com.apple.security.root"
+	PayloadTypePKCS1           = "com.apple.security.pkcs1"
+	PayloadTypePEM             = "com.apple.security.pem"
+	PayloadTypeRemovalPassword = "com.apple.profileRemovalPassword"
+	PayloadTypeFirefox         = "org.mozilla.firefox"
+)
+
+// Payload is a payload contained in a TopLevelProfile. Implementations embed PayloadCommon
+type Payload interface {
+	// Common returns the keys common to all payloads
+	Common() *PayloadCommon
+}
+
+// PayloadCommon contains the keys common to all payloads
+type PayloadCommon struct {
+	// PayloadType is the payload type, specified on each payload domain's reference page.
+	PayloadType string
+
+	// PayloadVersion is the version of this specific payload.
+	PayloadVersion int
+
+	// PayloadIdentifier is the reverse-DNS-style identifier for the payload. This identifier is usually the same as the TopLevel value, with an additional component appended.
+	PayloadIdentifier string
+
+	// PayloadUUID is the globally unique identifier for the payload. The actual content is unimportant, but must be globally unique. In macOS, use uuidgen to generate UUIDs.
+	PayloadUUID string
+
+	// PayloadDisplayName is the human-readable name for the profile payload. The name is displayed on the Detail screen and doesn't have to be unique.
+	PayloadDisplayName string
+
+	// PayloadDescription is the human-readable description of this payload. This description is shown on the Detail screen.
+	PayloadDescription string `plist:",omitempty"`
+
+	// PayloadOrganization is the human-readable string containing the name of the organization that provided the profile. This value doesn't need to match the organization payload value in the enclosing dictionary.
+	PayloadOrganization string
+}
+
+// Common returns p
+func (p *PayloadCommon) Common() *PayloadCommon {
+	return p
+}
+
+// NewPayloadCommon returns PayloadCommon with the given type, display name, and identifier suffix,
+// and the version, organization, and identifier prefix from config. A new UUID is generated with config.Rand
+func NewPayloadCommon(config *Config, typ, displayName, suffix string) (PayloadCommon, error) {
+	u, err := newUUID(config.Rand)
+	if err != nil {
+		return PayloadCommon{}, err
+	}
+
+	return PayloadCommon{
+		PayloadType:         typ,
+		PayloadVersion:      config.PayloadVersion,
+		PayloadIdentifier:   config.PayloadIdentifier + "." + suffix,
+		PayloadUUID:         u,
+		PayloadDisplayName:  displayName,
+		PayloadOrganization: config.PayloadOrganization,
+	}, nil
+}
+
+// CertificatePayload is a certificate payload. Its PayloadType is PayloadTypeRoot or PayloadTypePKCS1 for DER encoded certificates,
+// or PayloadTypePEM for PEM encoded certificates
+type CertificatePayload struct {
+	PayloadCommon
+
+	// PayloadCertificateFileName is the optional file name of the certificate
+	PayloadCertificateFileName string `plist:",omitempty"`
+
+	// PayloadContent is the binary representation of the payload encoded in base64
+	PayloadContent []byte
+
+	// Certificate is the parsed PayloadContent. It's only set by Parse
+	Certificate *x509.Certificate `plist:"-"`
+}
+
+// CertificateRootProfile is a certificate payload.
+//
+// Deprecated: use CertificatePayload
+type CertificateRootProfile = CertificatePayload
+
+// NewCertificatePayload returns a certificate payload of the given type with content. See NewPayloadCommon
+func NewCertificatePayload(config *Config, typ, displayName, suffix string, content []byte) (*CertificatePayload, error) {
+	common, err := NewPayloadCommon(config, typ, displayName, suffix)
+	if err != nil {
+		return nil, err
+	}
+	return &CertificatePayload{PayloadCommon: common, PayloadContent: content}, nil
+}
+
+// RemovalPasswordPayload is a payload that requires a password to remove the profile
+type RemovalPasswordPayload struct {
+	PayloadCommon
+
+	// RemovalPassword is the password required to remove the profile
+	RemovalPassword string
+}
+
+// NewRemovalPasswordPayload returns a removal password payload with the given password
+func NewRemovalPasswordPayload(config *Config, password string) (*RemovalPasswordPayload, error) {
+	common, err := NewPayloadCommon(config, PayloadTypeRemovalPassword, "Removal Password", "removal-password")
+	if err != nil {
+		return nil, err
+	}
+	return &RemovalPasswordPayload{PayloadCommon: common, RemovalPassword: password}, nil
+}
+
+// PreferencesPayload is a custom settings payload. Its PayloadType is the preference domain, e.g. "com.example.app",
+// and Settings are marshaled as keys of the payload. It's also used when parsing payloads of unknown types
+type PreferencesPayload struct {
+	PayloadCommon
+	Settings map[string]interface{}
+}
+
+// NewPreferencesPayload returns a custom settings payload for the preference domain with settings
+func NewPreferencesPayload(config *Config, domain, displayName string, settings map[string]interface{}) (*PreferencesPayload, error) {
+	common, err := NewPayloadCommon(config, domain, displayName, domain)
+	if err != nil {
+		return nil, err
+	}
+	return &PreferencesPayload{PayloadCommon: common, Settings: settings}, nil
+}
+
+// MarshalPlist implements plist.Marshaler
+func (p *PreferencesPayload) MarshalPlist() (interface{}, error) {
+	m := map[string]interface{}{
+		"PayloadType":         p.PayloadType,
+		"PayloadVersion":      p.PayloadVersion,
+		"PayloadIdentifier":   p.PayloadIdentifier,
+		"PayloadUUID":         p.PayloadUUID,
+		"PayloadDisplayName":  p.PayloadDisplayName,
+		"PayloadOrganization": p.PayloadOrganization,
+	}
+	if p.PayloadDescription != "" {
+		m["PayloadDescription"] = p.PayloadDescription
+	}
+
+	for k, v := range p.Settings {
+		if _, ok := m[k]; ok {
+			return nil, fmt.Errorf("setting %q conflicts with payload key", k)
+		}
+		m[k] = v
+	}
+
+	return m, nil
+}
+
+// UnmarshalPlist implements plist.Unmarshaler
+func (p *PreferencesPayload) UnmarshalPlist(f func(interface{}) error) error {
+	if err := f(&p.PayloadCommon); err != nil {
+		return err
+	}
+
+	settings := make(map[string]interface{})
+	if err := f(&settings); err != nil {
+		return err
+	}
+
+	for _, k := range []string{"PayloadType", "PayloadVersion", "PayloadIdentifier", "PayloadUUID", "PayloadDisplayName", "PayloadDescription", "PayloadOrganization"} {
+		delete(settings, k)
+	}
+	p.Settings = settings
+
+	return nil
+}
+
+// payloadDecoder decodes a payload into the type matching its PayloadType
+type payloadDecoder struct {
+	Payload
+}
+
+// UnmarshalPlist implements plist.Unmarshaler
+func (d *payloadDecoder) UnmarshalPlist(f func(interface{}) error) error {
+	common := new(PayloadCommon)
+	if err := f(common); err != nil {
+		return err
+	}
+
+	switch common.PayloadType {
+	case PayloadTypeRoot, PayloadTypePKCS1, PayloadTypePEM:
+		d.Payload = new(CertificatePayload)
+	case PayloadTypeRemovalPassword:
+		d.Payload = new(RemovalPasswordPayload)
+	default:
+		d.Payload = new(PreferencesPayload)
+	}
+
+	return f(d.Payload)
+}
+
+// NewFirefoxPayload returns a Firefox enterprise policy payload. If importEnterpriseRoots is true, Firefox trusts roots in the system keychain,
+// including roots installed by profiles. install contains paths of additional certificates for Firefox to install
+func NewFirefoxPayload(config *Config, importEnterpriseRoots bool, install []string) (*PreferencesPayload, error) {
+	certs := map[string]interface{}{"ImportEnterpriseRoots": importEnterpriseRoots}
+	if len(install) > 0 {
+		certs["Install"] = install
+	}
+
+	common, err := NewPayloadCommon(config, PayloadTypeFirefox, "Firefox Certificates", "firefox")
+	if err != nil {
+		return nil, err
+	}
+
+	return &PreferencesPayload{PayloadCommon: common, Settings: map[string]interface{}{
+		"EnterprisePoliciesEnabled": true,
+		"Certificates":              certs,
+	}}, nil
+}
@@ -1,11 +1,16 @@
 package profile
 
 import (
+	"crypto/rand"
 	"crypto/x509"
 	"fmt"
+	"io"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/groob/plist"
 )
 
 // Config is used to specify defaults for the generated profile
@@ -17,6 +22,47 @@ type Config struct {
 	// PayloadUUID is used as the top level UUID
 	PayloadUUID         string
 	PayloadOrganization string
+	// PayloadDisplayName is the top level display name. If empty, DefaultDisplayName is used
+	PayloadDisplayName string
+	// PayloadDescription is the top level description. If empty, DefaultDescription is used
+	PayloadDescription string
+	// PayloadScope is "System" or "User". If empty, "System" is used
+	PayloadScope string
+	// PayloadRemovalDisallowed, if true, prevents the user from removing the profile
+	PayloadRemovalDisallowed bool
+	// RemovalPassword, if set, adds a RemovalPasswordPayload with the password
+	RemovalPassword string
+	// FirefoxEnterpriseRoots, if true, adds a Firefox policy payload so Firefox trusts the root installed by the profile. See NewFirefoxPayload
+	FirefoxEnterpriseRoots bool
+	// FirefoxCertificates, if set, adds a Firefox policy payload that installs the certificates at the given paths. See NewFirefoxPayload
+	FirefoxCertificates []string
+	// ExpireWithCA, if true, sets PayloadExpirationDate and RemovalDate to the earliest NotAfter of the profile's certificates, so expired roots are removed from devices
+	ExpireWithCA bool
+	// DurationUntilRemoval, if set, is the time after installation that the profile is removed. If ExpireWithCA is also set, whichever is earlier is used
+	DurationUntilRemoval time.Duration
+	// Payloads are added to every profile after the certificate payloads, as is
+	Payloads []Payload
+	// Rand is the source of randomness for inner payload UUIDs. If nil, crypto/rand.Reader is used
+	Rand io.Reader
+}
+
+// Defaults for Config
+const (
+	DefaultDisplayName = "Lightspeed Relay Smart Agent"
+	DefaultDescription = "Root Certificate for Lightspeed Relay Smart Agent"
+	DefaultScope       = "System"
+)
+
+// newUUID returns a new random uppercase UUID using r
+func newUUID(r io.Reader) (string, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+	u, err := uuid.NewRandomFromReader(r)
+	if err != nil {
+		return "", fmt.Errorf("could not generate uuid: %w", err)
+	}
+	return strings.ToUpper(u.String()), nil
 }
 
 type TopLevelProfile struct {
@@ -47,60 +93,176 @@ type TopLevelProfile struct {
 	// PayloadRemovalDisallowed, if present and set to true, the user cannot delete the profile (unless the profile has a removal password and the user provides it).
 	PayloadRemovalDisallowed bool
 
-	// PayloadContent contains one or more CertificateRootProfiles
-	PayloadContent []*CertificateRootProfile
+	// PayloadExpirationDate is the date on which the profile is considered to have expired and can be updated over the air.
+	PayloadExpirationDate *time.Time `plist:",omitempty"`
+
+	// RemovalDate is the date on which the profile is automatically removed.
+	RemovalDate *time.Time `plist:",omitempty"`
+
+	// DurationUntilRemoval is the number of seconds until the profile is automatically removed. If RemovalDate is also present, whichever yields the earliest date is used.
+	DurationUntilRemoval float64 `plist:",omitempty"`
+
+	// PayloadContent contains the profile's payloads
+	PayloadContent []Payload
+
+	// EncryptedPayloadContent is the CMS encrypted PayloadContent of an encrypted profile. See Encrypt
+	EncryptedPayloadContent []byte `plist:",omitempty"`
+
+	// Signer is the certificate that signed the profile. It's only set by Parse
+	Signer *x509.Certificate `plist:"-"`
 }
 
-type CertificateRootProfile struct {
-	// PayloadType is the payload type, specified on each payload domain's reference page.
-	PayloadType string
+// topLevelProfile is TopLevelProfile without its plist methods
+type topLevelProfile TopLevelProfile
 
-	// PayloadVersion is the version of this specific payload.
-	PayloadVersion int
+// MarshalPlist implements plist.Marshaler
+func (p *TopLevelProfile) MarshalPlist() (interface{}, error) {
+	type profile struct {
+		*topLevelProfile
+		PayloadContent []interface{} `plist:",omitempty"`
+	}
 
-	// PayloadIdentifier is the reverse-DNS-style identifier for the payload. This identifier is usually the same as the TopLevel value, with an additional component appended.
-	PayloadIdentifier string
+	content, err := marshalPayloads(p.PayloadContent)
+	if err != nil {
+		return nil, err
+	}
 
-	// PayloadUUID is the globally unique identifier for the payload. The actual content is unimportant, but must be globally unique. In macOS, use uuidgen to generate UUIDs.
-	PayloadUUID string
+	return &profile{topLevelProfile: (*topLevelProfile)(p), PayloadContent: content}, nil
+}
 
-	// PayloadDisplayName is the human-readable name for the profile payload. The name is displayed on the Detail screen and doesn't have to be unique.
-	PayloadDisplayName string
+// marshalPayloads returns the payloads as concrete values, since the encoder only supports concrete values in interface slices
+func marshalPayloads(payloads []Payload) ([]interface{}, error) {
+	content := make([]interface{}, len(payloads))
+	for idx, payload := range payloads {
+		if m, ok := payload.(plist.Marshaler); ok {
+			v, err := m.MarshalPlist()
+			if err != nil {
+				return nil, fmt.Errorf("could not marshal payload %d: %w", idx, err)
+			}
+			content[idx] = v
+			continue
+		}
+		content[idx] = reflect.Indirect(reflect.ValueOf(payload)).Interface()
+	}
+	return content, nil
+}
 
-	// PayloadOrganization is the human-readable string containing the name of the organization that provided the profile. This value doesn't need to match the organization payload value in the enclosing dictionary.
-	PayloadOrganization string
+// UnmarshalPlist implements plist.Unmarshaler. Payloads are decoded into CertificatePayload, RemovalPasswordPayload,
+// or PreferencesPayload for other types
+func (p *TopLevelProfile) UnmarshalPlist(f func(interface{}) error) error {
+	type profile struct {
+		*topLevelProfile
+		PayloadContent []*payloadDecoder
+	}
+
+	prof := &profile{topLevelProfile: (*topLevelProfile)(p)}
+	if err := f(prof); err != nil {
+		return err
+	}
+
+	p.PayloadContent = make([]Payload, len(prof.PayloadContent))
+	for idx, d := range prof.PayloadContent {
+		p.PayloadContent[idx] = d.Payload
+	}
 
-	// PayloadContent is the binary representation of the payload encoded in base64
-	PayloadContent []byte
+	return nil
 }
 
-// New returns a profile for the given ca certificate
-func New(config *Config, ca *x509.Certificate) (*TopLevelProfile, error) {
-	u, err := uuid.NewRandom()
-	if err != nil {
-		return nil, fmt.Errorf("could not generate uuid: %w", err)
+// Certificates returns the profile's certificate payloads
+func (p *TopLevelProfile) Certificates() []*CertificatePayload {
+	var certs []*CertificatePayload
+	for _, payload := range p.PayloadContent {
+		if c, ok := payload.(*CertificatePayload); ok {
+			certs = append(certs, c)
+		}
 	}
+	return certs
+}
 
+// Root returns the parsed certificate of the profile's first root certificate payload, or nil if there isn't one. Certificates are only parsed by Parse
+func (p *TopLevelProfile) Root() *x509.Certificate {
+	for _, c := range p.Certificates() {
+		if c.PayloadType == PayloadTypeRoot {
+			return c.Certificate
+		}
+	}
+	return nil
+}
+
+// New returns a profile for the given root ca certificate and optional intermediate certificates, followed by the payloads from config
+func New(config *Config, ca *x509.Certificate, intermediates ...*x509.Certificate) (*TopLevelProfile, error) {
 	p := &TopLevelProfile{
 		PayloadType:              "Configuration",
 		PayloadVersion:           1,
 		PayloadIdentifier:        config.PayloadIdentifier,
 		PayloadUUID:              config.PayloadUUID,
-		PayloadDisplayName:       "Lightspeed Relay Smart Agent",
-		PayloadDescription:       "Root Certificate for Lightspeed Relay Smart Agent",
+		PayloadDisplayName:       config.PayloadDisplayName,
+		PayloadDescription:       config.PayloadDescription,
 		PayloadOrganization:      config.PayloadOrganization,
-		PayloadScope:             "System",
-		PayloadRemovalDisallowed: false,
-		PayloadContent: []*CertificateRootProfile{{
-			PayloadType:         "com.apple.security.root",
-			PayloadVersion:      config.PayloadVersion,
-			PayloadIdentifier:   config.PayloadIdentifier + ".root-certificate",
-			PayloadUUID:         strings.ToUpper(u.String()),
-			PayloadDisplayName:  "Root Certificate",
-			PayloadOrganization: config.PayloadOrganization,
-			PayloadContent:      ca.Raw,
-		}},
+		PayloadScope:             config.PayloadScope,
+		PayloadRemovalDisallowed: config.PayloadRemovalDisallowed,
+		DurationUntilRemoval:     config.DurationUntilRemoval.Seconds(),
+	}
+
+	if config.ExpireWithCA {
+		expires := ca.NotAfter
+		for _, c := range intermediates {
+			if c.NotAfter.Before(expires) {
+				expires = c.NotAfter
+			}
+		}
+		p.PayloadExpirationDate = &expires
+		p.RemovalDate = &expires
 	}
 
+	if p.PayloadDisplayName == "" {
+		p.PayloadDisplayName = DefaultDisplayName
+	}
+	if p.PayloadDescription == "" {
+		p.PayloadDescription = DefaultDescription
+	}
+	if p.PayloadScope == "" {
+		p.PayloadScope = DefaultScope
+	}
+	if p.PayloadScope != "System" && p.PayloadScope != "User" {
+		return nil, fmt.Errorf("invalid scope: %q", p.PayloadScope)
+	}
+
+	root, err := NewCertificatePayload(config, PayloadTypeRoot, "Root Certificate", "root-certificate", ca.Raw)
+	if err != nil {
+		return nil, err
+	}
+	p.PayloadContent = append(p.PayloadContent, root)
+
+	for idx, c := range intermediates {
+		inter, err := NewCertificatePayload(config, PayloadTypePKCS1,
+			fmt.Sprintf("Intermediate Certificate (%s)", c.Subject.CommonName),
+			fmt.Sprintf("intermediate-certificate.%d", idx+1),
+			c.Raw,
+		)
+		if err != nil {
+			return nil, err
+		}
+		p.PayloadContent = append(p.PayloadContent, inter)
+	}
+
+	if config.RemovalPassword != "" {
+		removal, err := NewRemovalPasswordPayload(config, config.RemovalPassword)
+		if err != nil {
+			return nil, err
+		}
+		p.PayloadContent = append(p.PayloadContent, removal)
+	}
+
+	if config.FirefoxEnterpriseRoots || len(config.FirefoxCertificates) > 0 {
+		firefox, err := NewFirefoxPayload(config, config.FirefoxEnterpriseRoots, config.FirefoxCertificates)
+		if err != nil {
+			return nil, err
+		}
+		p.PayloadContent = append(p.PayloadContent, firefox)
+	}
+
+	p.PayloadContent = append(p.PayloadContent, config.Payloads...)
+
 	return p, nil
 }
@@ -0,0 +1,204 @@
+package profile_test
+
+import (
+	"bytes"
+	mrand "math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/groob/plist"
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/internal/testutil"
+	"github.com/korylprince/ls-relay-cert/internal/testutil/certtest"
+	"github.com/korylprince/ls-relay-cert/profile"
+)
+
+func TestNewGolden(t *testing.T) {
+	opts := certtest.Options()
+
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+
+	opts.Subject.CommonName = "Intermediate CA"
+	subCA, _, err := cert.GenerateSubCA(ca, caKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate sub CA: %v", err)
+	}
+
+	prof, err := profile.New(&profile.Config{
+		PayloadVersion:      1,
+		PayloadIdentifier:   "com.github.korylprince.ls-relay-cert",
+		PayloadUUID:         "00000000-0000-0000-0000-000000000000",
+		PayloadOrganization: "Lightspeed Systems",
+		Rand:                opts.Rand,
+	}, ca, subCA)
+	if err != nil {
+		t.Fatalf("could not generate profile: %v", err)
+	}
+
+	buf, err := plist.MarshalIndent(prof, "\t")
+	if err != nil {
+		t.Fatalf("could not marshal profile: %v", err)
+	}
+
+	testutil.Golden(t, "profile.golden", buf)
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	opts := cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeEd25519
+	ca, _, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+
+	config := &profile.Config{
+		PayloadVersion:           1,
+		PayloadIdentifier:        "com.example",
+		PayloadUUID:              "UUID",
+		PayloadDisplayName:       "Example",
+		PayloadScope:             "User",
+		PayloadRemovalDisallowed: true,
+		RemovalPassword:          "secret",
+	}
+
+	prefs, err := profile.NewPreferencesPayload(config, "com.example.app", "Example App", map[string]interface{}{"Enabled": true, "Name": "example"})
+	if err != nil {
+		t.Fatalf("could not create preferences payload: %v", err)
+	}
+
+	pemCert, err := profile.NewCertificatePayload(config, profile.PayloadTypePEM, "PEM Certificate", "pem-certificate", cert.ChainPEM(ca))
+	if err != nil {
+		t.Fatalf("could not create certificate payload: %v", err)
+	}
+	config.Payloads = []profile.Payload{pemCert, prefs}
+
+	prof, err := profile.New(config, ca)
+	if err != nil {
+		t.Fatalf("could not generate profile: %v", err)
+	}
+
+	buf, err := plist.Marshal(prof)
+	if err != nil {
+		t.Fatalf("could not marshal profile: %v", err)
+	}
+
+	parsed := new(profile.TopLevelProfile)
+	if err = plist.Unmarshal(buf, parsed); err != nil {
+		t.Fatalf("could not unmarshal profile: %v", err)
+	}
+
+	if parsed.PayloadDisplayName != "Example" || parsed.PayloadDescription != profile.DefaultDescription || parsed.PayloadScope != "User" || !parsed.PayloadRemovalDisallowed {
+		t.Errorf("unexpected top level keys: %+v", parsed)
+	}
+
+	if len(parsed.PayloadContent) != 4 {
+		t.Fatalf("want 4 payloads, got %d", len(parsed.PayloadContent))
+	}
+
+	if c, ok := parsed.PayloadContent[0].(*profile.CertificatePayload); !ok || c.PayloadType != profile.PayloadTypeRoot || !bytes.Equal(c.PayloadContent, ca.Raw) {
+		t.Errorf("unexpected root payload: %#v", parsed.PayloadContent[0])
+	}
+	if r, ok := parsed.PayloadContent[1].(*profile.RemovalPasswordPayload); !ok || r.RemovalPassword != "secret" {
+		t.Errorf("unexpected removal password payload: %#v", parsed.PayloadContent[1])
+	}
+	if c, ok := parsed.PayloadContent[2].(*profile.CertificatePayload); !ok || c.PayloadType != profile.PayloadTypePEM || !bytes.Equal(c.PayloadContent, pemCert.PayloadContent) {
+		t.Errorf("unexpected PEM payload: %#v", parsed.PayloadContent[2])
+	}
+	if p, ok := parsed.PayloadContent[3].(*profile.PreferencesPayload); !ok || p.PayloadType != "com.example.app" || p.PayloadIdentifier != "com.example.com.example.app" || !reflect.DeepEqual(p.Settings, prefs.Settings) {
+		t.Errorf("unexpected preferences payload: %#v", parsed.PayloadContent[3])
+	}
+}
+
+func TestFirefoxPayload(t *testing.T) {
+	opts := cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeEd25519
+	ca, _, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+
+	prof, err := profile.New(&profile.Config{
+		PayloadVersion:         1,
+		PayloadIdentifier:      "com.github.korylprince.ls-relay-cert",
+		PayloadUUID:            "00000000-0000-0000-0000-000000000000",
+		PayloadOrganization:    "Lightspeed Systems",
+		FirefoxEnterpriseRoots: true,
+		FirefoxCertificates:    []string{"/usr/local/etc/ca.pem"},
+		Rand:                   mrand.New(mrand.NewSource(1)),
+	}, ca)
+	if err != nil {
+		t.Fatalf("could not generate profile: %v", err)
+	}
+
+	if len(prof.PayloadContent) != 2 {
+		t.Fatalf("want 2 payloads, got %d", len(prof.PayloadContent))
+	}
+
+	firefox, ok := prof.PayloadContent[1].(*profile.PreferencesPayload)
+	if !ok || firefox.PayloadType != profile.PayloadTypeFirefox {
+		t.Fatalf("unexpected Firefox payload: %#v", prof.PayloadContent[1])
+	}
+
+	buf, err := plist.MarshalIndent(firefox, "\t")
+	if err != nil {
+		t.Fatalf("could not marshal payload: %v", err)
+	}
+
+	testutil.Golden(t, "firefox.golden", buf)
+}
+
+func TestExpireWithCA(t *testing.T) {
+	opts := cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeEd25519
+
+	ca, caKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate CA: %v", err)
+	}
+
+	opts.CAYears = 2
+	opts.Subject.CommonName = "Intermediate CA"
+	subCA, _, err := cert.GenerateSubCA(ca, caKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate sub CA: %v", err)
+	}
+
+	config := &profile.Config{PayloadIdentifier: "com.example", PayloadUUID: "UUID"}
+	prof, err := profile.New(config, ca, subCA)
+	if err != nil {
+		t.Fatalf("could not generate profile: %v", err)
+	}
+	if prof.PayloadExpirationDate != nil || prof.RemovalDate != nil || prof.DurationUntilRemoval != 0 {
+		t.Error("want no expiration by default")
+	}
+
+	config.ExpireWithCA = true
+	config.DurationUntilRemoval = 24 * time.Hour
+	if prof, err = profile.New(config, ca, subCA); err != nil {
+		t.Fatalf("could not generate profile: %v", err)
+	}
+
+	buf, err := plist.Marshal(prof)
+	if err != nil {
+		t.Fatalf("could not marshal profile: %v", err)
+	}
+
+	parsed, err := profile.Parse(buf)
+	if err != nil {
+		t.Fatalf("could not parse profile: %v", err)
+	}
+
+	if parsed.PayloadExpirationDate == nil || !parsed.PayloadExpirationDate.Equal(subCA.NotAfter) {
+		t.Errorf("want PayloadExpirationDate %v, got %v", subCA.NotAfter, parsed.PayloadExpirationDate)
+	}
+	if parsed.RemovalDate == nil || !parsed.RemovalDate.Equal(subCA.NotAfter) {
+		t.Errorf("want RemovalDate %v, got %v", subCA.NotAfter, parsed.RemovalDate)
+	}
+	if parsed.DurationUntilRemoval != 86400 {
+		t.Errorf("want DurationUntilRemoval 86400, got %v", parsed.DurationUntilRemoval)
+	}
+}
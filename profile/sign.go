@@ -0,0 +1,82 @@
+package profile
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/groob/plist"
+	"go.mozilla.org/pkcs7"
+)
+
+// Sign returns the profile marshaled and signed with the given key pair, e.g. a Developer ID identity.
+// chain contains certificates that issued cert, in any order, which are included with the signature. Certificates that aren't in cert's chain are ignored
+func Sign(profile *TopLevelProfile, cert *x509.Certificate, key crypto.Signer, chain ...*x509.Certificate) ([]byte, error) {
+	buf, err := plist.Marshal(profile)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal plist: %w", err)
+	}
+
+	sd, err := pkcs7.NewSignedData(buf)
+	if err != nil {
+		return nil, fmt.Errorf("could not init pkcs7: %w", err)
+	}
+
+	if err := sd.AddSignerChain(cert, key, orderParents(cert, chain), pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, fmt.Errorf("could not add pkcs7 signer: %w", err)
+	}
+
+	signed, err := sd.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal pkcs7: %w", err)
+	}
+
+	return signed, nil
+}
+
+// orderParents returns the certificates in pool that issued cert, ordered from cert's issuer towards the root. The root doesn't need to be in pool
+func orderParents(cert *x509.Certificate, pool []*x509.Certificate) []*x509.Certificate {
+	var parents []*x509.Certificate
+	for len(parents) < len(pool) && !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		var parent *x509.Certificate
+		for _, c := range pool {
+			if bytes.Equal(cert.RawIssuer, c.RawSubject) && cert.CheckSignatureFrom(c) == nil {
+				parent = c
+				break
+			}
+		}
+		if parent == nil {
+			break
+		}
+		parents = append(parents, parent)
+		cert = parent
+	}
+	return parents
+}
+
+// Verify verifies the signature of the signed profile in data and returns the signer's certificate.
+// If roots is not nil, the signer's certificate must also chain to roots through the certificates included with the signature
+func Verify(data []byte, roots *x509.CertPool) (*x509.Certificate, error) {
+	p7, err := pkcs7.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse pkcs7: %w", err)
+	}
+
+	return verify(p7, roots)
+}
+
+// verify verifies the signature of p7 and returns the signer's certificate. See Verify
+func verify(p7 *pkcs7.PKCS7, roots *x509.CertPool) (*x509.Certificate, error) {
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return nil, errors.New("profile must have exactly one signer")
+	}
+
+	if err := p7.VerifyWithChain(roots); err != nil {
+		return signer, fmt.Errorf("could not verify signature: %w", err)
+	}
+
+	return signer, nil
+}
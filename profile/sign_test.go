@@ -0,0 +1,64 @@
+package profile_test
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/profile"
+)
+
+func TestSignVerify(t *testing.T) {
+	opts := cert.DefaultOptions()
+	opts.KeyType = cert.KeyTypeECDSAP256
+
+	root, rootKey, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate root: %v", err)
+	}
+	opts.Subject.CommonName = "Intermediate CA"
+	inter, interKey, err := cert.GenerateSubCA(root, rootKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate intermediate: %v", err)
+	}
+	signer, signerKey, err := cert.GenerateLocalhost(inter, interKey, opts)
+	if err != nil {
+		t.Fatalf("could not generate signer: %v", err)
+	}
+
+	prof, err := profile.New(&profile.Config{PayloadIdentifier: "com.example", PayloadUUID: "UUID"}, root)
+	if err != nil {
+		t.Fatalf("could not generate profile: %v", err)
+	}
+
+	// chain is out of order and contains an unrelated certificate
+	other, _, err := cert.GenerateCA(opts)
+	if err != nil {
+		t.Fatalf("could not generate unrelated CA: %v", err)
+	}
+	signed, err := profile.Sign(prof, signer, signerKey, root, other, inter)
+	if err != nil {
+		t.Fatalf("could not sign profile: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	c, err := profile.Verify(signed, roots)
+	if err != nil {
+		t.Fatalf("could not verify profile: %v", err)
+	}
+	if !c.Equal(signer) {
+		t.Errorf("want signer %s, got %s", signer.Subject, c.Subject)
+	}
+
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(other)
+	if _, err = profile.Verify(signed, otherRoots); err == nil {
+		t.Error("want error verifying with untrusted roots, got nil")
+	}
+
+	if _, err = profile.Verify(signed, nil); err != nil {
+		t.Errorf("could not verify signature without roots: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+//go:build cgo
+// +build cgo
+
+package signer
+
+import (
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// NewPKCS11 returns a crypto.Signer for the key pair in the PKCS #11 token specified by config.
+// The returned io.Closer closes the PKCS #11 session and must be called when the signer is no longer needed
+func NewPKCS11(config *PKCS11Config) (crypto.Signer, io.Closer, error) {
+	if config.KeyLabel == "" && config.KeyID == "" {
+		return nil, nil, errors.New("key label or id must be specified")
+	}
+
+	var id []byte
+	if config.KeyID != "" {
+		var err error
+		if id, err = hex.DecodeString(config.KeyID); err != nil {
+			return nil, nil, fmt.Errorf("could not decode key id: %w", err)
+		}
+	}
+
+	var label []byte
+	if config.KeyLabel != "" {
+		label = []byte(config.KeyLabel)
+	}
+
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       config.Module,
+		TokenLabel: config.TokenLabel,
+		Pin:        config.PIN,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not configure PKCS #11 module: %w", err)
+	}
+
+	key, err := ctx.FindKeyPair(id, label)
+	if err != nil {
+		ctx.Close()
+		return nil, nil, fmt.Errorf("could not find key pair: %w", err)
+	}
+	if key == nil {
+		ctx.Close()
+		return nil, nil, errors.New("key pair not found")
+	}
+
+	return key, ctx, nil
+}
@@ -0,0 +1,15 @@
+//go:build !cgo
+// +build !cgo
+
+package signer
+
+import (
+	"crypto"
+	"errors"
+	"io"
+)
+
+// NewPKCS11 is not supported without cgo, and always returns an error
+func NewPKCS11(config *PKCS11Config) (crypto.Signer, io.Closer, error) {
+	return nil, nil, errors.New("PKCS #11 support requires cgo")
+}
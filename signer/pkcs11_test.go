@@ -0,0 +1,101 @@
+//go:build cgo && softhsm
+// +build cgo,softhsm
+
+package signer_test
+
+import (
+	"crypto/elliptic"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/korylprince/ls-relay-cert/signer"
+)
+
+// Run with: go test -tags softhsm ./signer/
+// SOFTHSM2_MODULE overrides the default module path
+
+const (
+	testTokenLabel = "ls-relay-cert-test"
+	testPIN        = "1234"
+)
+
+// softHSM initializes a new SoftHSM token in a temporary directory and returns the path to the module
+func softHSM(t *testing.T) string {
+	t.Helper()
+
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module == "" {
+		module = "/usr/lib/softhsm/libsofthsm2.so"
+	}
+	if _, err := os.Stat(module); err != nil {
+		t.Skipf("SoftHSM module not found: %v", err)
+	}
+	if _, err := exec.LookPath("softhsm2-util"); err != nil {
+		t.Skipf("softhsm2-util not found: %v", err)
+	}
+
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := os.WriteFile(conf, []byte(fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\n", dir)), 0600); err != nil {
+		t.Fatalf("could not write SoftHSM config: %v", err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	out, err := exec.Command("softhsm2-util", "--init-token", "--free", "--label", testTokenLabel, "--so-pin", testPIN, "--pin", testPIN).CombinedOutput()
+	if err != nil {
+		t.Fatalf("could not initialize token: %v: %s", err, out)
+	}
+
+	return module
+}
+
+func TestNewPKCS11(t *testing.T) {
+	module := softHSM(t)
+
+	ctx, err := crypto11.Configure(&crypto11.Config{Path: module, TokenLabel: testTokenLabel, Pin: testPIN})
+	if err != nil {
+		t.Fatalf("could not configure PKCS #11 module: %v", err)
+	}
+	key, err := ctx.GenerateECDSAKeyPairWithLabel([]byte{0x01, 0x02}, []byte("ca"), elliptic.P256())
+	if err != nil {
+		ctx.Close()
+		t.Fatalf("could not generate key: %v", err)
+	}
+	if err = ctx.Close(); err != nil {
+		t.Fatalf("could not close PKCS #11 session: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		config  *signer.PKCS11Config
+		wantErr bool
+	}{
+		{"label", &signer.PKCS11Config{Module: module, TokenLabel: testTokenLabel, PIN: testPIN, KeyLabel: "ca"}, false},
+		{"id", &signer.PKCS11Config{Module: module, TokenLabel: testTokenLabel, PIN: testPIN, KeyID: "0102"}, false},
+		{"missing key", &signer.PKCS11Config{Module: module, TokenLabel: testTokenLabel, PIN: testPIN, KeyLabel: "other"}, true},
+		{"no label or id", &signer.PKCS11Config{Module: module, TokenLabel: testTokenLabel, PIN: testPIN}, true},
+		{"invalid id", &signer.PKCS11Config{Module: module, TokenLabel: testTokenLabel, PIN: testPIN, KeyID: "zz"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, closer, err := signer.New(&signer.Config{Type: signer.TypePKCS11, PKCS11: test.config})
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not create signer: %v", err)
+			}
+			defer closer.Close()
+
+			verifySigner(t, s, key)
+		})
+	}
+}
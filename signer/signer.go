@@ -0,0 +1,78 @@
+package signer
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+)
+
+// Supported signer types
+const (
+	TypeFile   = "file"
+	TypePKCS11 = "pkcs11"
+)
+
+// Config is used to select and configure a signer
+type Config struct {
+	// Type is TypeFile or TypePKCS11. If empty, TypeFile is used
+	Type string
+
+	// KeyFile is the path to the PEM encoded private key for TypeFile
+	KeyFile string
+	// Passphrase is used to decrypt KeyFile, if it's encrypted
+	Passphrase string
+
+	// PKCS11 is the configuration for TypePKCS11
+	PKCS11 *PKCS11Config
+}
+
+// PKCS11Config configures a PKCS #11 signer
+type PKCS11Config struct {
+	// Module is the path to the PKCS #11 module, e.g. /usr/lib/softhsm/libsofthsm2.so
+	Module string
+	// TokenLabel is the label of the token containing the key
+	TokenLabel string
+	// PIN is the user PIN for the token
+	PIN string
+	// KeyLabel is the label of the key pair. Either KeyLabel or KeyID must be set
+	KeyLabel string
+	// KeyID is the hex encoded ID of the key pair
+	KeyID string
+}
+
+// New returns the crypto.Signer specified by config. The returned io.Closer should be closed when the signer is no longer needed
+func New(config *Config) (crypto.Signer, io.Closer, error) {
+	switch config.Type {
+	case TypeFile, "":
+		s, err := NewFile(config.KeyFile, config.Passphrase)
+		return s, nopCloser{}, err
+	case TypePKCS11:
+		if config.PKCS11 == nil {
+			return nil, nil, fmt.Errorf("missing %s configuration", TypePKCS11)
+		}
+		return NewPKCS11(config.PKCS11)
+	}
+	return nil, nil, fmt.Errorf("unsupported signer type: %q", config.Type)
+}
+
+// NewFile returns a crypto.Signer for the PEM encoded private key at path, decrypting it with passphrase if it's encrypted
+func NewFile(path, passphrase string) (crypto.Signer, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read private key: %w", err)
+	}
+
+	key, err := cert.ParseEncryptedPrivateKeyPEM(buf, []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse private key: %w", err)
+	}
+
+	return key, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
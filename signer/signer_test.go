@@ -0,0 +1,94 @@
+package signer_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/korylprince/ls-relay-cert/cert"
+	"github.com/korylprince/ls-relay-cert/signer"
+)
+
+// verifySigner checks that s signs with the same key as key
+func verifySigner(t *testing.T, s crypto.Signer, key crypto.Signer) {
+	t.Helper()
+
+	pub, ok := key.Public().(*ecdsa.PublicKey)
+	if !ok {
+		t.Fatalf("want ECDSA public key, got %T", key.Public())
+	}
+	if !pub.Equal(s.Public()) {
+		t.Fatal("signer public key doesn't match key")
+	}
+
+	digest := sha256.Sum256([]byte("test"))
+	sig, err := s.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("could not sign: %v", err)
+	}
+	if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		t.Error("could not verify signature")
+	}
+}
+
+func TestNew(t *testing.T) {
+	key, err := cert.GenerateKey(cert.KeyTypeECDSAP256, rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	plain, err := cert.MarshalPrivateKeyPEM(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+	encrypted, err := cert.MarshalEncryptedPrivateKeyPEM(key, []byte("secret"))
+	if err != nil {
+		t.Fatalf("could not marshal encrypted key: %v", err)
+	}
+
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "key.pem")
+	encryptedPath := filepath.Join(dir, "encrypted.pem")
+	if err = os.WriteFile(plainPath, plain, 0600); err != nil {
+		t.Fatalf("could not write key: %v", err)
+	}
+	if err = os.WriteFile(encryptedPath, encrypted, 0600); err != nil {
+		t.Fatalf("could not write encrypted key: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		config  *signer.Config
+		wantErr bool
+	}{
+		{"default type", &signer.Config{KeyFile: plainPath}, false},
+		{"file", &signer.Config{Type: signer.TypeFile, KeyFile: plainPath}, false},
+		{"encrypted", &signer.Config{Type: signer.TypeFile, KeyFile: encryptedPath, Passphrase: "secret"}, false},
+		{"wrong passphrase", &signer.Config{Type: signer.TypeFile, KeyFile: encryptedPath, Passphrase: "wrong"}, true},
+		{"missing file", &signer.Config{Type: signer.TypeFile, KeyFile: filepath.Join(dir, "missing.pem")}, true},
+		{"missing pkcs11 config", &signer.Config{Type: signer.TypePKCS11}, true},
+		{"unsupported type", &signer.Config{Type: "other"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, closer, err := signer.New(test.config)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not create signer: %v", err)
+			}
+			defer closer.Close()
+
+			verifySigner(t, s, key)
+		})
+	}
+}